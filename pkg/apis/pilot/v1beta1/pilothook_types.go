@@ -0,0 +1,114 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Hook backing types
+const (
+	// TypeBuiltin hooks are implemented by the pilot, and named by Spec.Builtin.
+	TypeBuiltin = "builtin"
+
+	// TypeHTTP hooks POST the pods transitions to an HTTP endpoint.
+	TypeHTTP = "http"
+
+	// TypeGRPC hooks send the pods transitions to a gRPC service.
+	TypeGRPC = "grpc"
+
+	// TypeExec hooks run commands in the statefulset pods.
+	TypeExec = "exec"
+
+	// TypeJob hooks run a Kubernetes Job for each pods transition.
+	TypeJob = "job"
+
+	// TypeScript hooks run shell scripts from the pilot.
+	TypeScript = "script"
+)
+
+// PilotHookSpec defines the desired state of PilotHook
+type PilotHookSpec struct {
+	// Type is the hook backing type: builtin, http, grpc, exec, job or script.
+	// +kubebuilder:validation:Enum=builtin,http,grpc,exec,job,script
+	Type string `json:"type"`
+
+	// Builtin is the name of the builtin hook, for the builtin type.
+	Builtin string `json:"builtin,omitempty"`
+
+	// Config holds the hook default settings, keyed by annotation name without
+	// the "statefulset-pilot/" prefix. The statefulsets annotations take precedence
+	// for builtin hooks; the other types only get this config.
+	Config map[string]string `json:"config,omitempty"`
+
+	// Namespaces restricts the hook to statefulsets in those namespaces.
+	// The hook is available to all namespaces when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// PilotHookStatus defines the observed state of PilotHook
+type PilotHookStatus struct {
+	// Resolvable is true when the pilot knows how to run this hook.
+	Resolvable bool `json:"resolvable"`
+
+	// Reason explains why the hook isn't resolvable.
+	Reason string `json:"reason,omitempty"`
+
+	// StatefulSets is the number of statefulsets using this hook.
+	StatefulSets int32 `json:"statefulSets"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PilotHook is the Schema for the pilothooks API
+// +k8s:openapi-gen=true
+type PilotHook struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PilotHookSpec   `json:"spec,omitempty"`
+	Status PilotHookStatus `json:"status,omitempty"`
+}
+
+// AllowsNamespace returns true if statefulsets in namespace ns may use this hook.
+func (h *PilotHook) AllowsNamespace(ns string) bool {
+	if len(h.Spec.Namespaces) == 0 {
+		return true
+	}
+	for _, allowed := range h.Spec.Namespaces {
+		if allowed == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PilotHookList contains a list of PilotHook
+type PilotHookList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PilotHook `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PilotHook{}, &PilotHookList{})
+}
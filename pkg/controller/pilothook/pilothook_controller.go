@@ -0,0 +1,143 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pilothook
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	pilotv1beta1 "github.com/bpineau/statefulset-pilot/pkg/apis/pilot/v1beta1"
+	"github.com/bpineau/statefulset-pilot/pkg/controller/sts"
+	hookfactory "github.com/bpineau/statefulset-pilot/pkg/hooks/factory"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+// Add creates a new PilotHook Controller and adds it to the Manager with default RBAC.
+// The Manager will set fields on the Controller and Start it when the Manager is Started.
+func Add(mgr manager.Manager) error {
+	return add(mgr, newReconciler(mgr))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager) reconcile.Reconciler {
+	return &ReconcilePilotHook{
+		Client: mgr.GetClient(),
+		log:    logf.Log.WithName("pilothook"),
+	}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New("pilothook-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to PilotHook
+	err = c.Watch(&source.Kind{Type: &pilotv1beta1.PilotHook{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// Watch for statefulsets (un)subscribing to a PilotHook, to maintain its usage count
+	err = c.Watch(
+		&source.Kind{Type: &appsv1.StatefulSet{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(mapStatefulSet)},
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// mapStatefulSet returns the PilotHook a statefulset is subscribed to.
+func mapStatefulSet(obj handler.MapObject) []reconcile.Request {
+	name, ok := obj.Meta.GetLabels()[sts.StatefulsetPilotLabelKey]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name}}}
+}
+
+var _ reconcile.Reconciler = &ReconcilePilotHook{}
+
+// ReconcilePilotHook reconciles a PilotHook object
+type ReconcilePilotHook struct {
+	client.Client
+	log logr.Logger
+}
+
+// Reconcile maintains the PilotHook status: whether the hook can be resolved,
+// and how many statefulsets are using it.
+// +kubebuilder:rbac:groups=pilot.datadoghq.com,resources=pilothooks,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch
+func (r *ReconcilePilotHook) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	// Fetch the PilotHook instance
+	instance := &pilotv1beta1.PilotHook{}
+	err := r.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	status := pilotv1beta1.PilotHookStatus{Resolvable: true}
+	if _, err := hookfactory.Resolve(instance); err != nil {
+		status.Resolvable = false
+		status.Reason = err.Error()
+	}
+
+	stsList := &appsv1.StatefulSetList{}
+	opts := client.MatchingLabels(map[string]string{sts.StatefulsetPilotLabelKey: instance.GetName()})
+	if err := r.List(context.TODO(), opts, stsList); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	for _, s := range stsList.Items {
+		if instance.AllowsNamespace(s.GetNamespace()) {
+			status.StatefulSets++
+		}
+	}
+
+	if status == instance.Status {
+		return reconcile.Result{}, nil
+	}
+
+	r.log.Info("updating pilothook status", "name", instance.GetName(),
+		"resolvable", status.Resolvable, "statefulsets", status.StatefulSets)
+
+	instance.Status = status
+	if err := r.Update(context.TODO(), instance); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pilothook
+
+import (
+	"testing"
+	"time"
+
+	pilotv1beta1 "github.com/bpineau/statefulset-pilot/pkg/apis/pilot/v1beta1"
+	"github.com/bpineau/statefulset-pilot/pkg/controller/sts"
+	"github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var c client.Client
+
+var expectedRequest = reconcile.Request{NamespacedName: types.NamespacedName{Name: "foo"}}
+var hookKey = types.NamespacedName{Name: "foo"}
+
+const timeout = time.Second * 5
+
+func TestReconcile(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	instance := &pilotv1beta1.PilotHook{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+		Spec: pilotv1beta1.PilotHookSpec{
+			Type:    pilotv1beta1.TypeBuiltin,
+			Builtin: "elasticsearch",
+		},
+	}
+
+	// Setup the Manager and Controller.  Wrap the Controller Reconcile function so it writes each request to a
+	// channel when it is finished.
+	mgr, err := manager.New(cfg, manager.Options{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	c = mgr.GetClient()
+
+	recFn, requests := SetupTestReconcile(newReconciler(mgr))
+	g.Expect(add(mgr, recFn)).NotTo(gomega.HaveOccurred())
+
+	stopMgr, mgrStopped := StartTestManager(mgr, g)
+
+	defer func() {
+		close(stopMgr)
+		mgrStopped.Wait()
+	}()
+
+	// Create the PilotHook object and expect the Reconcile
+	err = c.Create(context.TODO(), instance)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	defer c.Delete(context.TODO(), instance)
+	g.Eventually(requests, timeout).Should(gomega.Receive(gomega.Equal(expectedRequest)))
+
+	fetched := &pilotv1beta1.PilotHook{}
+	g.Eventually(func() (pilotv1beta1.PilotHookStatus, error) {
+		err := c.Get(context.TODO(), hookKey, fetched)
+		return fetched.Status, err
+	}, timeout).Should(gomega.Equal(pilotv1beta1.PilotHookStatus{Resolvable: true}))
+
+	// Subscribe a statefulset to the PilotHook, and expect its usage count to be updated
+	replicas := int32(1)
+	labels := map[string]string{"app": "es", sts.StatefulsetPilotLabelKey: "foo"}
+	statefulset := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "es", Namespace: "default", Labels: labels},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "es"}},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "es"}},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{Name: "es", Image: "elasticsearch"}},
+				},
+			},
+		},
+	}
+	g.Expect(c.Create(context.TODO(), statefulset)).NotTo(gomega.HaveOccurred())
+	defer c.Delete(context.TODO(), statefulset)
+	g.Eventually(requests, timeout).Should(gomega.Receive(gomega.Equal(expectedRequest)))
+
+	g.Eventually(func() (int32, error) {
+		err := c.Get(context.TODO(), hookKey, fetched)
+		return fetched.Status.StatefulSets, err
+	}, timeout).Should(gomega.Equal(int32(1)))
+
+	// Point the PilotHook to an unknown builtin, and expect it to be reported as such
+	fetched.Spec.Builtin = "nope"
+	g.Expect(c.Update(context.TODO(), fetched)).NotTo(gomega.HaveOccurred())
+	g.Eventually(requests, timeout).Should(gomega.Receive(gomega.Equal(expectedRequest)))
+
+	g.Eventually(func() (bool, error) {
+		err := c.Get(context.TODO(), hookKey, fetched)
+		return fetched.Status.Resolvable, err
+	}, timeout).Should(gomega.BeFalse())
+}
@@ -37,6 +37,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	pilotv1beta1 "github.com/bpineau/statefulset-pilot/pkg/apis/pilot/v1beta1"
 	"github.com/bpineau/statefulset-pilot/pkg/hooks"
 	hookfactory "github.com/bpineau/statefulset-pilot/pkg/hooks/factory"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
@@ -47,13 +48,22 @@ var (
 	// call between rollout steps. We ignore statefulsets without this label.
 	StatefulsetPilotLabelKey = "dd-statefulset-pilot"
 
+	// AbortedRevisionAnnotation records the UpdateRevision whose rollout was aborted
+	// by a hook. The rollout won't resume until the statefulset is updated again.
+	AbortedRevisionAnnotation = hooks.AnnotationPrefix + "aborted-revision"
+
+	// RolloutHookAnnotation records the hook piloting the ongoing rollout, so the
+	// hook can be told when the statefulset is unsubscribed before the rollout ends.
+	RolloutHookAnnotation = hooks.AnnotationPrefix + "rollout-hook"
+
 	retryInterval = 30 * time.Second
 	retryMessage  = "Not yet ready for update, will retry"
 
 	pred = predicate.Funcs{
 		UpdateFunc: func(e event.UpdateEvent) bool {
 			_, ok := e.MetaNew.GetLabels()[StatefulsetPilotLabelKey]
-			if !ok {
+			_, wasOk := e.MetaOld.GetLabels()[StatefulsetPilotLabelKey]
+			if !ok && !wasOk {
 				return false
 			}
 			return e.ObjectOld != e.ObjectNew
@@ -68,17 +78,32 @@ var (
 // Add creates a new sts Controller and adds it to the Manager with default RBAC.
 // The Manager will set fields on the Controller and Start it when the Manager is Started.
 func Add(mgr manager.Manager) error {
-	return add(mgr, newReconciler(mgr))
+	hooks.SetRestConfig(mgr.GetConfig())
+
+	r, err := newReconciler(mgr)
+	if err != nil {
+		return err
+	}
+
+	return add(mgr, r)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager) reconcile.Reconciler {
+func newReconciler(mgr manager.Manager) (reconcile.Reconciler, error) {
+	// Hooks may write to the statefulsets during a reconcile, so they are read
+	// again from the API server (rather than from the cache) before we update them
+	reader, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+	if err != nil {
+		return nil, err
+	}
+
 	return &ReconcileSts{
 		Client:   mgr.GetClient(),
+		reader:   reader,
 		scheme:   mgr.GetScheme(),
 		recorder: mgr.GetRecorder("statefulset-pilot"),
 		log:      logf.Log.WithName("reconcile"),
-	}
+	}, nil
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
@@ -99,14 +124,47 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	// Watch for changes to the PilotHooks the statefulsets are subscribed to
+	err = c.Watch(
+		&source.Kind{Type: &pilotv1beta1.PilotHook{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: &pilotHookMapper{mgr.GetClient()}},
+	)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// pilotHookMapper returns the statefulsets subscribed to a PilotHook.
+type pilotHookMapper struct {
+	client client.Client
+}
+
+func (m *pilotHookMapper) Map(obj handler.MapObject) []reconcile.Request {
+	list := &appsv1.StatefulSetList{}
+	opts := client.MatchingLabels(map[string]string{StatefulsetPilotLabelKey: obj.Meta.GetName()})
+	if err := m.client.List(context.TODO(), opts, list); err != nil {
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, s := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: s.GetNamespace(),
+			Name:      s.GetName(),
+		}})
+	}
+
+	return requests
+}
+
 var _ reconcile.Reconciler = &ReconcileSts{}
 
 // ReconcileSts reconciles a statefulset object
 type ReconcileSts struct {
 	client.Client
+	reader   client.Reader
 	scheme   *runtime.Scheme
 	recorder record.EventRecorder
 	log      logr.Logger
@@ -114,24 +172,43 @@ type ReconcileSts struct {
 
 // Reconcile make cluster changes according to the statefulset spec.
 // Automatically generate RBAC rules to allow the Controller to read and write Deployments
-// +kubebuilder:rbac:groups=apps,resources=statefulset,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=pilot.datadoghq.com,resources=pilothooks,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods/exec,verbs=create
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
 func (r *ReconcileSts) Reconcile(request reconcile.Request) (reconcile.Result, error) {
 
 	// Fetch the sts instance
 	instance := &appsv1.StatefulSet{}
-	name := request.NamespacedName.String()
 	err := r.Get(context.TODO(), request.NamespacedName, instance)
 	if err != nil {
 		if errors.IsNotFound(err) {
+			hookfactory.Release(request.Namespace, request.Name)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
 		return reconcile.Result{}, err
 	}
 
+	// The statefulset was unsubscribed, maybe during a rollout
+	if _, ok := instance.GetLabels()[StatefulsetPilotLabelKey]; !ok {
+		result, err := r.cancelRollout(instance)
+		if err == nil && !result.Requeue {
+			hookfactory.Release(instance.GetNamespace(), instance.GetName())
+		}
+		return result, err
+	}
+
 	// Fetch the hook named in StatefulsetPilotLabelKey label
-	hook, err := hookfactory.Get(instance, StatefulsetPilotLabelKey)
+	hook, err := hookfactory.Get(r.Client, instance, StatefulsetPilotLabelKey)
 	if err != nil {
+		name := fmt.Sprintf("%s/%s", instance.GetNamespace(), instance.GetName())
+		r.recorder.Eventf(instance, "Warning", "HookUnavailable", "can't use %s hook: %s",
+			instance.GetLabels()[StatefulsetPilotLabelKey], err.Error())
+		r.log.Info("ignoring statefulset", "statefulset", name, "reason", err.Error())
 		return reconcile.Result{}, nil
 	}
 
@@ -151,6 +228,16 @@ func (r *ReconcileSts) Reconcile(request reconcile.Request) (reconcile.Result, e
 		if currentPartition == 0 {
 			return r.finishRollout(instance, hook)
 		}
+		// The rollout was reverted before its end (ie. after an abort), or
+		// the statefulset was scaled up
+		if currentPartition < nReplicas {
+			return r.resetRollout(instance, hook)
+		}
+		return reconcile.Result{}, nil
+	}
+
+	// A hook aborted this revision's rollout
+	if instance.GetAnnotations()[AbortedRevisionAnnotation] == instance.Status.UpdateRevision {
 		return reconcile.Result{}, nil
 	}
 
@@ -188,12 +275,11 @@ func (r *ReconcileSts) Reconcile(request reconcile.Request) (reconcile.Result, e
 
 		// Ask hook if we should wait a bit longer before updating next pod
 		if err := hook.PodUpdateTransition(pod, next); err != nil {
-			r.log.Info(retryMessage, "statefulset", name, "reason", err.Error())
-			return reconcile.Result{Requeue: true, RequeueAfter: retryInterval}, nil
+			return r.hookFailed(instance, hook, err)
 		}
 
 		// Pod is up-to-date and considered ready, let's resume rollout with the next pod
-		return r.setPartitionNumber(instance, currentPartition-1)
+		return r.setPartitionNumber(instance, currentPartition-1, nil)
 	}
 
 	return reconcile.Result{}, nil
@@ -210,15 +296,16 @@ func (r *ReconcileSts) startRollout(instance *appsv1.StatefulSet, hook hooks.STS
 
 	// Ask hooks if we can start, or wait a bit longer
 	if err := hook.PodUpdateTransition(nil, pod); err != nil {
-		r.log.Info(retryMessage, "statefulset", name, "reason", err.Error())
-		return reconcile.Result{Requeue: true, RequeueAfter: retryInterval}, nil
+		return r.hookFailed(instance, hook, err)
 	}
 
 	r.recorder.Eventf(instance, "Normal", "Started", "starting %s rollout", name)
 	r.log.Info("starting statefulset rollout", "name", name, "hook", hook.Name())
 
 	// Starts rollout with the higher pod number
-	return r.setPartitionNumber(instance, nReplicas-1)
+	return r.setPartitionNumber(instance, nReplicas-1, map[string]string{
+		RolloutHookAnnotation: instance.GetLabels()[StatefulsetPilotLabelKey],
+	})
 }
 
 func (r *ReconcileSts) finishRollout(instance *appsv1.StatefulSet, hook hooks.STSRolloutHooks) (reconcile.Result, error) {
@@ -231,13 +318,15 @@ func (r *ReconcileSts) finishRollout(instance *appsv1.StatefulSet, hook hooks.ST
 	}
 
 	if err := hook.PodUpdateTransition(pod, nil); err != nil {
-		r.log.Info(retryMessage, "statefulset", name, "reason", err.Error())
-		return reconcile.Result{Requeue: true, RequeueAfter: retryInterval}, nil
+		return r.hookFailed(instance, hook, err)
 	}
 
 	// Reset partition number to max ordinal+1, so we'll intercept the next rollout
-	instance.Spec.UpdateStrategy.RollingUpdate.Partition = &nReplicas
-	err = r.Update(context.Background(), instance)
+	err = r.update(instance, func(sts *appsv1.StatefulSet) {
+		setPartition(sts, nReplicas)
+		delete(sts.Annotations, AbortedRevisionAnnotation)
+		delete(sts.Annotations, RolloutHookAnnotation)
+	})
 	if err != nil {
 		return reconcile.Result{}, err
 	}
@@ -248,17 +337,168 @@ func (r *ReconcileSts) finishRollout(instance *appsv1.StatefulSet, hook hooks.ST
 	return reconcile.Result{}, nil
 }
 
-func (r *ReconcileSts) setPartitionNumber(instance *appsv1.StatefulSet, pos int32) (reconcile.Result, error) {
+// resetRollout resets the partition of a reverted rollout, or of a scaled up
+// statefulset, so the next revision rollout starts from the last pod again.
+func (r *ReconcileSts) resetRollout(instance *appsv1.StatefulSet, hook hooks.STSRolloutHooks) (reconcile.Result, error) {
+	nReplicas := *instance.Spec.Replicas
+	name := fmt.Sprintf("%s/%s", instance.GetNamespace(), instance.GetName())
+
+	// Without an ongoing or aborted rollout, the statefulset was only scaled up
+	_, aborted := instance.GetAnnotations()[AbortedRevisionAnnotation]
+	_, piloted := instance.GetAnnotations()[RolloutHookAnnotation]
+	if !aborted && !piloted {
+		return r.setPartitionNumber(instance, nReplicas, nil)
+	}
+
+	// Let the hook undo its changes, unless that was done when the rollout was aborted
+	if canceler, ok := hook.(hooks.RolloutCanceler); ok && !aborted {
+		if err := canceler.RolloutCanceled(); err != nil {
+			r.log.Info("failed to cancel the hook rollout, will retry", "statefulset", name,
+				"reason", err.Error())
+			return reconcile.Result{Requeue: true, RequeueAfter: retryInterval}, nil
+		}
+	}
+
+	err := r.update(instance, func(sts *appsv1.StatefulSet) {
+		setPartition(sts, nReplicas)
+		delete(sts.Annotations, AbortedRevisionAnnotation)
+		delete(sts.Annotations, RolloutHookAnnotation)
+	})
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	r.recorder.Eventf(instance, "Normal", "Reverted", "%s rollout was reverted", name)
+	r.log.Info("reverted statefulset rollout", "name", name, "hook", hook.Name())
+
+	return reconcile.Result{}, nil
+}
+
+// hookFailed postpones the rollout, or aborts it when the hook asked so.
+func (r *ReconcileSts) hookFailed(instance *appsv1.StatefulSet, hook hooks.STSRolloutHooks, err error) (reconcile.Result, error) {
+	name := fmt.Sprintf("%s/%s", instance.GetNamespace(), instance.GetName())
+
+	if !hooks.IsAbort(err) {
+		if reason := hooks.WaitReason(err); reason != "" {
+			eventType := "Normal"
+			if hooks.IsWarning(err) {
+				eventType = "Warning"
+			}
+			r.recorder.Event(instance, eventType, reason, err.Error())
+		}
+		r.log.Info(retryMessage, "statefulset", name, "reason", err.Error())
+		return reconcile.Result{Requeue: true, RequeueAfter: retryInterval}, nil
+	}
+
+	// Let the hook undo its changes
+	if canceler, ok := hook.(hooks.RolloutCanceler); ok {
+		if cerr := canceler.RolloutCanceled(); cerr != nil {
+			r.log.Info("failed to cancel the hook rollout, will retry", "statefulset", name,
+				"reason", cerr.Error())
+			return reconcile.Result{Requeue: true, RequeueAfter: retryInterval}, nil
+		}
+	}
+
+	// Keep the partition where it is, so the remaining pods stay on the current revision
+	revision := instance.Status.UpdateRevision
+	uerr := r.update(instance, func(sts *appsv1.StatefulSet) {
+		setAnnotation(sts, AbortedRevisionAnnotation, revision)
+	})
+	if uerr != nil {
+		return reconcile.Result{}, uerr
+	}
+
+	r.recorder.Eventf(instance, "Warning", "Aborted", "aborted %s rollout: %s", name, err.Error())
+	r.log.Info("aborted statefulset rollout", "name", name, "hook", hook.Name(),
+		"revision", revision, "reason", err.Error())
+
+	return reconcile.Result{}, nil
+}
+
+// cancelRollout tells the hook piloting an ongoing rollout that the statefulset was unsubscribed.
+func (r *ReconcileSts) cancelRollout(instance *appsv1.StatefulSet) (reconcile.Result, error) {
+	label, ok := instance.GetAnnotations()[RolloutHookAnnotation]
+	if !ok {
+		return reconcile.Result{}, nil
+	}
+
+	name := fmt.Sprintf("%s/%s", instance.GetNamespace(), instance.GetName())
+
+	hook, err := hookfactory.GetByName(r.Client, instance, label)
+	if err != nil {
+		r.log.Info("can't cancel the hook rollout", "statefulset", name, "hook", label, "reason", err.Error())
+	} else if canceler, ok := hook.(hooks.RolloutCanceler); ok {
+		if err := canceler.RolloutCanceled(); err != nil {
+			r.log.Info("failed to cancel the hook rollout, will retry", "statefulset", name,
+				"hook", label, "reason", err.Error())
+			return reconcile.Result{Requeue: true, RequeueAfter: retryInterval}, nil
+		}
+	}
+
+	err = r.update(instance, func(sts *appsv1.StatefulSet) {
+		delete(sts.Annotations, RolloutHookAnnotation)
+	})
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	r.recorder.Eventf(instance, "Normal", "Canceled", "unsubscribed from the pilot during %s rollout", name)
+	r.log.Info("canceled statefulset rollout", "name", name, "hook", label)
+
+	return reconcile.Result{}, nil
+}
+
+// setPartitionNumber moves the rollout to pos, setting the given annotations along.
+func (r *ReconcileSts) setPartitionNumber(instance *appsv1.StatefulSet, pos int32, annotations map[string]string) (reconcile.Result, error) {
 	r.log.Info("updating statefulset partition", "namespace", instance.GetNamespace(),
 		"name", instance.GetName(), "partition", pos)
 
-	instance.Spec.UpdateStrategy.RollingUpdate.Partition = &pos
-	if err := r.Update(context.Background(), instance); err != nil {
+	err := r.update(instance, func(sts *appsv1.StatefulSet) {
+		setPartition(sts, pos)
+		for key, val := range annotations {
+			setAnnotation(sts, key, val)
+		}
+	})
+	if err != nil {
 		return reconcile.Result{Requeue: true, RequeueAfter: retryInterval}, nil
 	}
 	return reconcile.Result{}, nil
 }
 
+// update applies mutate to the statefulset and saves it. Hooks may have written
+// to the statefulset since instance was fetched, so mutate is applied to its
+// latest version, read from the API server rather than from the cache.
+func (r *ReconcileSts) update(instance *appsv1.StatefulSet, mutate func(sts *appsv1.StatefulSet)) error {
+	sts := &appsv1.StatefulSet{}
+	key := types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+	if err := r.reader.Get(context.TODO(), key, sts); err != nil {
+		return err
+	}
+
+	mutate(sts)
+	if err := r.Update(context.TODO(), sts); err != nil {
+		return err
+	}
+
+	sts.DeepCopyInto(instance)
+	return nil
+}
+
+// setPartition sets the statefulset rolling update partition, unless its
+// update strategy changed since the reconcile started.
+func setPartition(sts *appsv1.StatefulSet, pos int32) {
+	if sts.Spec.UpdateStrategy.RollingUpdate != nil {
+		sts.Spec.UpdateStrategy.RollingUpdate.Partition = &pos
+	}
+}
+
+func setAnnotation(sts *appsv1.StatefulSet, key, val string) {
+	if sts.Annotations == nil {
+		sts.Annotations = make(map[string]string)
+	}
+	sts.Annotations[key] = val
+}
+
 func (r *ReconcileSts) getPod(instance *appsv1.StatefulSet, pos int32) (*v1.Pod, error) {
 	podName := types.NamespacedName{
 		Namespace: instance.Namespace,
@@ -17,12 +17,23 @@ limitations under the License.
 package sts
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	hookfactory "github.com/bpineau/statefulset-pilot/pkg/hooks/factory"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
 
 var c client.Client
@@ -42,7 +53,9 @@ func TestReconcile(t *testing.T) {
 		g.Expect(err).NotTo(gomega.HaveOccurred())
 		c = mgr.GetClient()
 
-		recFn, requests := SetupTestReconcile(newReconciler(mgr))
+		r, err := newReconciler(mgr)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		recFn, requests := SetupTestReconcile(r)
 		g.Expect(add(mgr, recFn)).NotTo(gomega.HaveOccurred())
 
 		stopMgr, mgrStopped := StartTestManager(mgr, g)
@@ -65,3 +78,191 @@ func TestReconcile(t *testing.T) {
 		g.Eventually(requests, timeout).Should(gomega.Receive(gomega.Equal(expectedRequest)))
 	*/
 }
+
+// stubHook fails its transitions with err.
+type stubHook struct {
+	err         error
+	transitions []string
+	canceled    int
+}
+
+func (h *stubHook) Name() string {
+	return "stub"
+}
+
+func (h *stubHook) PodUpdateTransition(prev, next *v1.Pod) error {
+	h.transitions = append(h.transitions, fmt.Sprintf("%s>%s", podName(prev), podName(next)))
+	return h.err
+}
+
+func (h *stubHook) RolloutCanceled() error {
+	h.canceled++
+	return nil
+}
+
+func podName(pod *v1.Pod) string {
+	if pod == nil {
+		return "nil"
+	}
+	return pod.GetName()
+}
+
+func TestAbortRevertRollout(t *testing.T) {
+	hook := &stubHook{}
+	hookfactory.Register("stub", func(client.Client, *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+		return hook, nil
+	})
+
+	replicas, partition := int32(3), int32(3)
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			Labels:    map[string]string{StatefulsetPilotLabelKey: "stub"},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+			},
+		},
+		Status: appsv1.StatefulSetStatus{CurrentRevision: "foo-1", UpdateRevision: "foo-2"},
+	}
+
+	objs := []runtime.Object{sts}
+	for i := 0; i < 3; i++ {
+		objs = append(objs, &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("foo-%d", i),
+				Namespace: "default",
+				Labels:    map[string]string{appsv1.StatefulSetRevisionLabel: "foo-1"},
+			},
+			Status: v1.PodStatus{Phase: v1.PodRunning},
+		})
+	}
+
+	c := hookstest.NewFakeClient(objs...)
+	r := &ReconcileSts{Client: c, reader: c, recorder: record.NewFakeRecorder(10), log: logf.Log}
+
+	reconcileAndGet := func() *appsv1.StatefulSet {
+		if _, err := r.Reconcile(expectedRequest); err != nil {
+			t.Fatal(err)
+		}
+		instance := &appsv1.StatefulSet{}
+		if err := c.Get(context.TODO(), expectedRequest.NamespacedName, instance); err != nil {
+			t.Fatal(err)
+		}
+		return instance
+	}
+
+	setRevisions := func(current, update string) {
+		instance := &appsv1.StatefulSet{}
+		if err := c.Get(context.TODO(), expectedRequest.NamespacedName, instance); err != nil {
+			t.Fatal(err)
+		}
+		instance.Status.CurrentRevision, instance.Status.UpdateRevision = current, update
+		if err := c.Update(context.TODO(), instance); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setPodRevision := func(ordinal int, revision string) {
+		pod := &v1.Pod{}
+		key := types.NamespacedName{Namespace: "default", Name: fmt.Sprintf("foo-%d", ordinal)}
+		if err := c.Get(context.TODO(), key, pod); err != nil {
+			t.Fatal(err)
+		}
+		pod.Labels[appsv1.StatefulSetRevisionLabel] = revision
+		if err := c.Update(context.TODO(), pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The rollout starts with the last pod
+	if got := *reconcileAndGet().Spec.UpdateStrategy.RollingUpdate.Partition; got != 2 {
+		t.Fatalf("expected the rollout to start at partition 2, got %d", got)
+	}
+
+	// The hook aborts the rollout after the last pod update
+	setPodRevision(2, "foo-2")
+	hook.err = hooks.Abort(fmt.Errorf("error rate regressed"))
+	instance := reconcileAndGet()
+	if got := *instance.Spec.UpdateStrategy.RollingUpdate.Partition; got != 2 {
+		t.Errorf("expected the aborted rollout to stay at partition 2, got %d", got)
+	}
+	if got := instance.GetAnnotations()[AbortedRevisionAnnotation]; got != "foo-2" {
+		t.Errorf("expected foo-2 to be recorded as aborted, got %q", got)
+	}
+
+	// The statefulset is reverted, and the last pod rolled back
+	hook.err = nil
+	setRevisions("foo-1", "foo-1")
+	setPodRevision(2, "foo-1")
+	instance = reconcileAndGet()
+	if got := *instance.Spec.UpdateStrategy.RollingUpdate.Partition; got != 3 {
+		t.Errorf("expected the reverted rollout partition to be reset to 3, got %d", got)
+	}
+	for _, annotation := range []string{AbortedRevisionAnnotation, RolloutHookAnnotation} {
+		if _, ok := instance.GetAnnotations()[annotation]; ok {
+			t.Errorf("expected the %s annotation to be cleared", annotation)
+		}
+	}
+
+	// The next revision rollout starts with the last pod again, through the hook
+	hook.transitions = nil
+	setRevisions("foo-1", "foo-3")
+	if got := *reconcileAndGet().Spec.UpdateStrategy.RollingUpdate.Partition; got != 2 {
+		t.Errorf("expected the next rollout to start at partition 2, got %d", got)
+	}
+	if len(hook.transitions) != 1 || hook.transitions[0] != "nil>foo-2" {
+		t.Errorf("expected the hook to be called before foo-2 update, got %v", hook.transitions)
+	}
+}
+
+func TestScaleUp(t *testing.T) {
+	hook := &stubHook{}
+	hookfactory.Register("stub", func(client.Client, *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+		return hook, nil
+	})
+
+	// The statefulset was scaled from 3 to 5 replicas, out of any rollout
+	replicas, partition := int32(5), int32(3)
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			Labels:    map[string]string{StatefulsetPilotLabelKey: "stub"},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+			},
+		},
+		Status: appsv1.StatefulSetStatus{CurrentRevision: "foo-1", UpdateRevision: "foo-1"},
+	}
+
+	c := hookstest.NewFakeClient(sts)
+	recorder := record.NewFakeRecorder(10)
+	r := &ReconcileSts{Client: c, reader: c, recorder: recorder, log: logf.Log}
+
+	if _, err := r.Reconcile(expectedRequest); err != nil {
+		t.Fatal(err)
+	}
+	instance := &appsv1.StatefulSet{}
+	if err := c.Get(context.TODO(), expectedRequest.NamespacedName, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := *instance.Spec.UpdateStrategy.RollingUpdate.Partition; got != 5 {
+		t.Errorf("expected the partition to follow the replicas count, got %d", got)
+	}
+	if hook.canceled != 0 {
+		t.Errorf("expected no rollout to be canceled, got %d cancels", hook.canceled)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no event, got %q", <-recorder.Events)
+	}
+}
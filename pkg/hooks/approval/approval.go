@@ -0,0 +1,174 @@
+package approval
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// ApprovedThroughAnnotation is set by operators to approve the update of
+	// the pods down to this ordinal (pods are updated from the highest ordinal),
+	// or to "all" to approve the whole rollout.
+	ApprovedThroughAnnotation = hooks.AnnotationPrefix + "approved-through"
+
+	// WaitingAnnotation holds the ordinal of the pod waiting for an approval.
+	WaitingAnnotation = hooks.AnnotationPrefix + "waiting-for-approval"
+
+	// RevisionAnnotation holds the UpdateRevision the approvals were given for.
+	RevisionAnnotation = hooks.AnnotationPrefix + "approval-revision"
+
+	// LastApprovalAnnotation records the last approved pod, and its approver.
+	LastApprovalAnnotation = hooks.AnnotationPrefix + "last-approval"
+)
+
+// stateAnnotations are the annotations saved by the hook.
+var stateAnnotations = []string{
+	ApprovedThroughAnnotation,
+	WaitingAnnotation,
+	RevisionAnnotation,
+	LastApprovalAnnotation,
+}
+
+const (
+	// WaitingReason is the reason of the events emitted while waiting for an approval.
+	WaitingReason = "WaitingForApproval"
+
+	approveAll = "all"
+)
+
+// Hook waits for an operator approval before each pod update. The approvals
+// are reset on every new UpdateRevision, and the hook's state is kept in the
+// statefulset annotations.
+type Hook struct {
+	sts      *appsv1.StatefulSet
+	approver func(sts *appsv1.StatefulSet) (string, error)
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	return &Hook{
+		sts:      sts,
+		approver: managedFieldsApprover,
+	}, nil
+}
+
+func (h *Hook) Name() string {
+	return "approval"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// After the last pod, we just clean up the pending approval request
+	if next == nil {
+		return h.update(func(annotations map[string]string) {
+			delete(annotations, WaitingAnnotation)
+		})
+	}
+
+	ordinal, err := hooks.Ordinal(next)
+	if err != nil {
+		return err
+	}
+
+	// Approvals given for a previous revision don't apply to this one
+	annotations := h.sts.GetAnnotations()
+	if annotations[RevisionAnnotation] != h.sts.Status.UpdateRevision {
+		return h.wait(next, ordinal, true)
+	}
+
+	approved, err := approvedThrough(annotations, ordinal)
+	if err != nil {
+		return err
+	}
+	if !approved {
+		return h.wait(next, ordinal, false)
+	}
+
+	// Record the approval once
+	if strings.HasPrefix(annotations[LastApprovalAnnotation], next.GetName()+" ") {
+		return nil
+	}
+
+	approver, err := h.approver(h.sts)
+	if err != nil {
+		return fmt.Errorf("failed to find who approved %s update: %v", next.GetName(), err)
+	}
+
+	return h.update(func(annotations map[string]string) {
+		delete(annotations, WaitingAnnotation)
+		annotations[LastApprovalAnnotation] = fmt.Sprintf("%s approved by %s", next.GetName(), approver)
+	})
+}
+
+// wait records the pending approval request (after discarding the previous
+// revision's approvals when reset is true), and asks the controller to retry later.
+func (h *Hook) wait(pod *v1.Pod, ordinal int, reset bool) error {
+	err := h.update(func(annotations map[string]string) {
+		if reset {
+			delete(annotations, ApprovedThroughAnnotation)
+			delete(annotations, LastApprovalAnnotation)
+		}
+		annotations[RevisionAnnotation] = h.sts.Status.UpdateRevision
+		annotations[WaitingAnnotation] = strconv.Itoa(ordinal)
+	})
+	if err != nil {
+		return err
+	}
+
+	return hooks.Wait(WaitingReason, fmt.Errorf("waiting for approval to update %s: set the %s annotation to %d",
+		pod.GetName(), ApprovedThroughAnnotation, ordinal))
+}
+
+// update applies fn to the statefulset annotations, and patches the approval
+// annotations that changed. The other annotations (including the PilotHook
+// config merged into the hook's statefulset) are left as stored.
+func (h *Hook) update(fn func(annotations map[string]string)) error {
+	annotations := make(map[string]string)
+	for key, val := range h.sts.GetAnnotations() {
+		annotations[key] = val
+	}
+
+	fn(annotations)
+
+	changes := make(map[string]*string)
+	for _, key := range stateAnnotations {
+		val, ok := annotations[key]
+		old, wasOk := h.sts.GetAnnotations()[key]
+		switch {
+		case ok && (!wasOk || val != old):
+			changes[key] = &val
+		case !ok && wasOk:
+			changes[key] = nil
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	return hooks.PatchAnnotations(h.sts, changes)
+}
+
+// approvedThrough returns true if the pod with the given ordinal was approved.
+func approvedThrough(annotations map[string]string, ordinal int) (bool, error) {
+	val, ok := annotations[ApprovedThroughAnnotation]
+	if !ok {
+		return false, nil
+	}
+
+	if strings.TrimSpace(val) == approveAll {
+		return true, nil
+	}
+
+	through, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || through < 0 {
+		return false, fmt.Errorf("invalid %s annotation: %q isn't an ordinal or %q",
+			ApprovedThroughAnnotation, val, approveAll)
+	}
+
+	return ordinal >= through, nil
+}
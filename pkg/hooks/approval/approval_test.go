@@ -0,0 +1,192 @@
+package approval
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+func pod(name string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+}
+
+func statefulset(revision string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Status:     appsv1.StatefulSetStatus{UpdateRevision: revision},
+	}
+}
+
+func get(t *testing.T, c kubernetes.Interface) *appsv1.StatefulSet {
+	sts, err := c.AppsV1().StatefulSets("default").Get("db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sts
+}
+
+// newHook builds a hook on a fresh copy of the stored statefulset, as the controller would.
+func newHook(t *testing.T, c kubernetes.Interface, revision string) *Hook {
+	sts := get(t, c)
+	sts.Status.UpdateRevision = revision
+
+	h, _ := New(nil, sts)
+	h.(*Hook).approver = func(*appsv1.StatefulSet) (string, error) {
+		return "alice", nil
+	}
+
+	return h.(*Hook)
+}
+
+// approve plays the operator part.
+func approve(t *testing.T, c kubernetes.Interface, through string) {
+	sts := get(t, c)
+	sts.Annotations[ApprovedThroughAnnotation] = through
+	if _, err := c.AppsV1().StatefulSets("default").Update(sts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func annotations(t *testing.T, c kubernetes.Interface) map[string]string {
+	return get(t, c).GetAnnotations()
+}
+
+func expectWaiting(t *testing.T, err error, c kubernetes.Interface, ordinal string) {
+	if hooks.WaitReason(err) != WaitingReason {
+		t.Fatalf("expected to wait for an approval, got: %v", err)
+	}
+	if got := annotations(t, c)[WaitingAnnotation]; got != ordinal {
+		t.Errorf("expected to wait for pod %s approval, got %q", ordinal, got)
+	}
+}
+
+func TestPodUpdateTransition(t *testing.T) {
+	c := hookstest.NewFakeClientset(statefulset(""))
+
+	// A new rollout waits for the first pod approval
+	err := newHook(t, c, "rev1").PodUpdateTransition(nil, pod("db-2"))
+	expectWaiting(t, err, c, "2")
+	if got := annotations(t, c)[RevisionAnnotation]; got != "rev1" {
+		t.Errorf("expected approvals to apply to rev1, got %q", got)
+	}
+
+	// Approving db-2 lets the rollout start, and records the approver
+	approve(t, c, "2")
+	if err := newHook(t, c, "rev1").PodUpdateTransition(nil, pod("db-2")); err != nil {
+		t.Fatalf("expected approved update, got: %v", err)
+	}
+	got := annotations(t, c)
+	if got[LastApprovalAnnotation] != "db-2 approved by alice" {
+		t.Errorf("unexpected approval record: %q", got[LastApprovalAnnotation])
+	}
+	if _, ok := got[WaitingAnnotation]; ok {
+		t.Error("expected the approval request to be cleared")
+	}
+
+	// But not the next pod's
+	err = newHook(t, c, "rev1").PodUpdateTransition(pod("db-2"), pod("db-1"))
+	expectWaiting(t, err, c, "1")
+
+	// A batch approval approves all the remaining pods
+	approve(t, c, "all")
+	for _, next := range []string{"db-1", "db-0"} {
+		if err := newHook(t, c, "rev1").PodUpdateTransition(nil, pod(next)); err != nil {
+			t.Fatalf("expected %s approved update, got: %v", next, err)
+		}
+	}
+	if err := newHook(t, c, "rev1").PodUpdateTransition(pod("db-0"), nil); err != nil {
+		t.Fatalf("expected rollout end, got: %v", err)
+	}
+
+	// Approvals are reset on new revisions
+	err = newHook(t, c, "rev2").PodUpdateTransition(nil, pod("db-2"))
+	expectWaiting(t, err, c, "2")
+	got = annotations(t, c)
+	if _, ok := got[ApprovedThroughAnnotation]; ok {
+		t.Error("expected rev1 approvals to be reset")
+	}
+	if _, ok := got[LastApprovalAnnotation]; ok {
+		t.Error("expected rev1 approvals records to be reset")
+	}
+
+	// Typos aren't approvals
+	approve(t, c, "two")
+	err = newHook(t, c, "rev2").PodUpdateTransition(nil, pod("db-2"))
+	if err == nil || hooks.WaitReason(err) != "" {
+		t.Errorf("expected an invalid annotation error, got: %v", err)
+	}
+}
+
+func TestUpdateOnlySavesApprovals(t *testing.T) {
+	sts := statefulset("")
+	sts.Annotations = map[string]string{"owner": "team-a"}
+	c := hookstest.NewFakeClientset(sts)
+
+	// The hook's statefulset holds a merged PilotHook config, and went stale
+	h := newHook(t, c, "rev1")
+	h.sts.Annotations[hooks.AnnotationPrefix+"config"] = "from-pilothook"
+	sts = get(t, c)
+	sts.Annotations["owner"] = "team-b"
+	if _, err := c.AppsV1().StatefulSets("default").Update(sts); err != nil {
+		t.Fatal(err)
+	}
+
+	err := h.PodUpdateTransition(nil, pod("db-2"))
+	expectWaiting(t, err, c, "2")
+
+	got := annotations(t, c)
+	if _, ok := got[hooks.AnnotationPrefix+"config"]; ok {
+		t.Error("expected the PilotHook config not to be saved")
+	}
+	if got["owner"] != "team-b" {
+		t.Errorf("expected the other annotations to be left as stored, got owner=%q", got["owner"])
+	}
+}
+
+func TestFetchApprover(t *testing.T) {
+	tests := []struct {
+		fields string
+		want   string
+	}{
+		{"", unknownApprover},
+		{fmt.Sprintf(`[
+			{"manager": "statefulset-pilot", "time": "2019-01-01T10:00:00Z",
+			 "fieldsV1": {"f:metadata": {"f:annotations": {"f:%[1]s": {}}}}},
+			{"manager": "kube-controller-manager", "time": "2019-01-01T12:00:00Z",
+			 "fieldsV1": {"f:status": {}}},
+			{"manager": "kubectl-annotate", "time": "2019-01-01T11:00:00Z",
+			 "fieldsV1": {"f:metadata": {"f:annotations": {"f:%[1]s": {}}}}}
+		]`, ApprovedThroughAnnotation), "kubectl-annotate"},
+	}
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/apis/apps/v1/namespaces/default/statefulsets/db" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fields := tt.fields
+			if fields == "" {
+				fields = "null"
+			}
+			fmt.Fprintf(w, `{"metadata": {"name": "db", "managedFields": %s}}`, fields)
+		}))
+
+		got, err := fetchApprover(srv.Client(), srv.URL+"/apis/apps/v1/namespaces/default/statefulsets/db")
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("fetchApprover() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package approval
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/client-go/rest"
+)
+
+const unknownApprover = "unknown"
+
+// managedFieldsEntry is the subset of a metadata.managedFields entry we need.
+// managedFields aren't part of our vendored ObjectMeta, so we decode them from
+// the raw API response.
+type managedFieldsEntry struct {
+	Manager  string                 `json:"manager"`
+	Time     string                 `json:"time"`
+	FieldsV1 map[string]interface{} `json:"fieldsV1"`
+}
+
+// managedFieldsApprover returns the field manager that last set the
+// approved-through annotation on the statefulset.
+func managedFieldsApprover(sts *appsv1.StatefulSet) (string, error) {
+	cfg, err := hooks.RestConfig()
+	if err != nil {
+		return "", err
+	}
+
+	transport, err := rest.TransportFor(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/apis/apps/v1/namespaces/%s/statefulsets/%s",
+		strings.TrimSuffix(cfg.Host, "/"), sts.GetNamespace(), sts.GetName())
+
+	return fetchApprover(&http.Client{Transport: transport, Timeout: 30 * time.Second}, url)
+}
+
+func fetchApprover(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code from %s: %d", url, resp.StatusCode)
+	}
+
+	var obj struct {
+		Metadata struct {
+			ManagedFields []managedFieldsEntry `json:"managedFields"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %v", url, err)
+	}
+
+	return approverOf(obj.Metadata.ManagedFields), nil
+}
+
+// approverOf returns the manager of the most recent entry owning the
+// approved-through annotation. Clusters not tracking managedFields
+// give an "unknown" approver.
+func approverOf(entries []managedFieldsEntry) string {
+	approver, latest := unknownApprover, ""
+	for _, entry := range entries {
+		if !ownsApproval(entry.FieldsV1) || entry.Time < latest {
+			continue
+		}
+		approver, latest = entry.Manager, entry.Time
+	}
+	return approver
+}
+
+func ownsApproval(fields map[string]interface{}) bool {
+	metadata, ok := fields["f:metadata"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	annotations, ok := metadata["f:annotations"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	_, ok = annotations["f:"+ApprovedThroughAnnotation]
+	return ok
+}
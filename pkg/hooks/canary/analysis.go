@@ -0,0 +1,55 @@
+package canary
+
+import (
+	"fmt"
+	"math"
+)
+
+// Analysis decides whether canaries are significantly worse than the baseline.
+// The canaries mean must exceed the baseline mean by more than the relative
+// tolerance, the standard deviations and the absolute margin to be considered worse.
+type Analysis struct {
+	Tolerance      float64
+	Deviations     float64
+	Margin         float64
+	HigherIsBetter bool
+}
+
+// Compare returns an error if the canaries values are worse than the baseline values.
+func (a Analysis) Compare(baseline, canaries []float64) error {
+	if len(baseline) == 0 || len(canaries) == 0 {
+		return nil
+	}
+
+	bmean, bstddev := meanStddev(baseline)
+	cmean, _ := meanStddev(canaries)
+
+	margin := math.Max(a.Tolerance*math.Abs(bmean), a.Deviations*bstddev)
+	margin = math.Max(margin, a.Margin)
+
+	if a.HigherIsBetter && cmean < bmean-margin {
+		return fmt.Errorf("canaries mean %g is below baseline mean %g by more than %g",
+			cmean, bmean, margin)
+	}
+
+	if !a.HigherIsBetter && cmean > bmean+margin {
+		return fmt.Errorf("canaries mean %g is above baseline mean %g by more than %g",
+			cmean, bmean, margin)
+	}
+
+	return nil
+}
+
+func meanStddev(values []float64) (float64, float64) {
+	var sum, sq float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	for _, v := range values {
+		sq += (v - mean) * (v - mean)
+	}
+
+	return mean, math.Sqrt(sq / float64(len(values)))
+}
@@ -0,0 +1,200 @@
+package canary
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// SourceAnnotation selects the metric source: "prometheus" (the default) or "scrape".
+	SourceAnnotation = hooks.AnnotationPrefix + "canary-source"
+
+	// PrometheusURLAnnotation is the Prometheus API base url, for the prometheus source.
+	PrometheusURLAnnotation = hooks.AnnotationPrefix + "canary-prometheus-url"
+
+	// QueryAnnotation is the compared metric: a PromQL expression template returning
+	// one value per pod for the prometheus source, or a series selector such as
+	// `http_requests_errors{code="500"}` for the scrape source.
+	QueryAnnotation = hooks.AnnotationPrefix + "canary-query"
+
+	// MetricsPortAnnotation is the pods metrics port, for the scrape source.
+	MetricsPortAnnotation = hooks.AnnotationPrefix + "canary-metrics-port"
+
+	// MetricsPathAnnotation is the pods metrics path, for the scrape source.
+	MetricsPathAnnotation = hooks.AnnotationPrefix + "canary-metrics-path"
+
+	// WindowAnnotation is how long updated pods must have been ready before they're
+	// compared to the baseline. It's also available to queries as {{.Window}}.
+	WindowAnnotation = hooks.AnnotationPrefix + "canary-window"
+
+	// ToleranceAnnotation is the accepted degradation, relative to the baseline mean.
+	ToleranceAnnotation = hooks.AnnotationPrefix + "canary-tolerance"
+
+	// DeviationsAnnotation is the accepted degradation, in baseline standard deviations.
+	DeviationsAnnotation = hooks.AnnotationPrefix + "canary-deviations"
+
+	// MarginAnnotation is the accepted degradation, as an absolute value.
+	MarginAnnotation = hooks.AnnotationPrefix + "canary-margin"
+
+	// HigherIsBetterAnnotation should be "true" when the metric is better when higher
+	// (eg. throughput). By default lower values are considered better (eg. errors, latency).
+	HigherIsBetterAnnotation = hooks.AnnotationPrefix + "canary-higher-is-better"
+
+	defaultWindow     = 5 * time.Minute
+	defaultTolerance  = 0.1
+	defaultDeviations = 2.0
+)
+
+// Hook compares a metric between the pods already updated to the statefulset's
+// UpdateRevision (the canaries) and the pods still on its CurrentRevision (the
+// baseline), and aborts the rollout when the canaries are significantly worse.
+type Hook struct {
+	client   client.Client
+	sts      *appsv1.StatefulSet
+	source   Source
+	window   time.Duration
+	analysis Analysis
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		client: c,
+		sts:    sts,
+		window: defaultWindow,
+		analysis: Analysis{
+			Tolerance:  defaultTolerance,
+			Deviations: defaultDeviations,
+		},
+	}
+
+	var err error
+	if val, ok := annotations[WindowAnnotation]; ok {
+		if h.window, err = time.ParseDuration(val); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", WindowAnnotation))
+		}
+	}
+
+	floats := map[string]*float64{
+		ToleranceAnnotation:  &h.analysis.Tolerance,
+		DeviationsAnnotation: &h.analysis.Deviations,
+		MarginAnnotation:     &h.analysis.Margin,
+	}
+	for key, dest := range floats {
+		if val, ok := annotations[key]; ok {
+			if *dest, err = strconv.ParseFloat(val, 64); err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", key))
+			}
+		}
+	}
+
+	if val, ok := annotations[HigherIsBetterAnnotation]; ok {
+		if h.analysis.HigherIsBetter, err = strconv.ParseBool(val); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", HigherIsBetterAnnotation))
+		}
+	}
+
+	if h.source, err = newSource(annotations, h.window); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "canary"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// Nothing was updated yet when starting a rollout
+	if prev == nil {
+		return nil
+	}
+
+	baseline, canaries, err := h.populations()
+	if err != nil {
+		return err
+	}
+
+	// Nothing left to compare to once the last pod is updated
+	if len(baseline) == 0 || len(canaries) == 0 {
+		return nil
+	}
+
+	for _, pod := range canaries {
+		if since := readySince(pod); since.IsZero() || time.Since(since) < h.window {
+			return fmt.Errorf("waiting for pod %s to be ready for %s", pod.GetName(), h.window)
+		}
+	}
+
+	baseValues, err := h.values(baseline)
+	if err != nil {
+		return err
+	}
+
+	canaryValues, err := h.values(canaries)
+	if err != nil {
+		return err
+	}
+
+	if err := h.analysis.Compare(baseValues, canaryValues); err != nil {
+		return hooks.Abort(errors.Wrap(err, fmt.Sprintf("canary analysis failed for revision %s",
+			h.sts.Status.UpdateRevision)))
+	}
+
+	return nil
+}
+
+// populations splits the running statefulset pods by revision.
+func (h *Hook) populations() (baseline, canaries []*v1.Pod, err error) {
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+
+		// Revision label is maintained by statefulset controller
+		switch pod.GetLabels()[appsv1.StatefulSetRevisionLabel] {
+		case h.sts.Status.CurrentRevision:
+			baseline = append(baseline, pod)
+		case h.sts.Status.UpdateRevision:
+			canaries = append(canaries, pod)
+		}
+	}
+
+	return baseline, canaries, nil
+}
+
+func (h *Hook) values(pods []*v1.Pod) ([]float64, error) {
+	values := make([]float64, 0, len(pods))
+	for _, pod := range pods {
+		val, err := h.source.Value(pod)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to get metric for pod %s", pod.GetName()))
+		}
+		values = append(values, val)
+	}
+	return values, nil
+}
+
+func readySince(pod *v1.Pod) time.Time {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady && cond.Status == v1.ConditionTrue {
+			return cond.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,218 @@
+package canary
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func statefulset(annotations map[string]string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		},
+		Status: appsv1.StatefulSetStatus{
+			CurrentRevision: "web-1",
+			UpdateRevision:  "web-2",
+		},
+	}
+}
+
+func pod(ordinal int, revision string, readyFor time.Duration) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("web-%d", ordinal),
+			Namespace: "default",
+			Labels: map[string]string{
+				"app":                           "web",
+				appsv1.StatefulSetRevisionLabel: revision,
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: fmt.Sprintf("10.0.0.%d", ordinal),
+			Conditions: []v1.PodCondition{{
+				Type:               v1.PodReady,
+				Status:             v1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(time.Now().Add(-readyFor)),
+			}},
+		},
+	}
+}
+
+// stubMetrics serves each pod's metrics, indexed by pod ip.
+// The returned func stops the stub.
+func stubMetrics(errorsByIP map[string]string) func() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := r.URL.Query().Get("ip")
+		fmt.Fprintf(w, "# HELP http_errors Errors.\n# TYPE http_errors gauge\n")
+		fmt.Fprintf(w, "http_errors{code=\"500\",path=\"/\"} %s\n", errorsByIP[ip])
+		fmt.Fprintf(w, "http_errors{code=\"404\",path=\"/\"} 1000\n")
+	}))
+
+	addr := scrapeAddress
+	scrapeAddress = func(pod *v1.Pod, port int) (string, error) {
+		return strings.TrimPrefix(srv.URL, "http://") + "/?ip=" + pod.Status.PodIP + "&", nil
+	}
+
+	return func() {
+		scrapeAddress = addr
+		srv.Close()
+	}
+}
+
+func newHook(t *testing.T, sts *appsv1.StatefulSet, pods ...runtime.Object) *Hook {
+	h, err := New(hookstest.NewFakeClient(pods...), sts)
+	if err != nil {
+		t.Fatalf("failed to create hook: %v", err)
+	}
+	return h.(*Hook)
+}
+
+func TestScrapeSource(t *testing.T) {
+	stop := stubMetrics(map[string]string{
+		"10.0.0.0": "10",
+		"10.0.0.1": "11",
+		"10.0.0.2": "11.5",
+		"10.0.0.3": "40",
+	})
+	defer stop()
+
+	sts := statefulset(map[string]string{
+		SourceAnnotation:      "scrape",
+		QueryAnnotation:       `http_errors{code="500"}`,
+		MetricsPortAnnotation: "8080",
+		WindowAnnotation:      "5m",
+	})
+
+	tests := []struct {
+		name    string
+		pods    []runtime.Object
+		wantErr bool
+		abort   bool
+	}{
+		{"canary within baseline",
+			[]runtime.Object{pod(0, "web-1", time.Hour), pod(1, "web-1", time.Hour), pod(2, "web-2", time.Hour)},
+			false, false},
+		{"canary not ready long enough",
+			[]runtime.Object{pod(0, "web-1", time.Hour), pod(1, "web-1", time.Hour), pod(3, "web-2", time.Minute)},
+			true, false},
+		{"canary worse than baseline",
+			[]runtime.Object{pod(0, "web-1", time.Hour), pod(1, "web-1", time.Hour), pod(3, "web-2", time.Hour)},
+			true, true},
+		{"no baseline left",
+			[]runtime.Object{pod(3, "web-2", time.Hour)},
+			false, false},
+	}
+
+	for _, tt := range tests {
+		h := newHook(t, sts, tt.pods...)
+		err := h.PodUpdateTransition(pod(9, "web-2", time.Hour), nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: PodUpdateTransition() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if hooks.IsAbort(err) != tt.abort {
+			t.Errorf("%s: PodUpdateTransition() abort = %v, want %v", tt.name, hooks.IsAbort(err), tt.abort)
+		}
+	}
+}
+
+func TestScrapeAddress(t *testing.T) {
+	p := pod(1, "web-1", time.Hour)
+	if addr, err := scrapeAddress(p, 8080); err != nil || addr != "10.0.0.1:8080" {
+		t.Errorf("unexpected address %q, error: %v", addr, err)
+	}
+
+	p.Status.PodIP = ""
+	if _, err := scrapeAddress(p, 8080); err == nil || err.Error() != "pod has no ip address yet" {
+		t.Errorf("expected a missing ip error, got: %v", err)
+	}
+}
+
+func TestPrometheusSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := map[string]string{
+			`rate(errors{pod="web-0"}[10m])`: "0.5",
+			`rate(errors{pod="web-1"}[10m])`: "0.6",
+			`rate(errors{pod="web-2"}[10m])`: "0.1",
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"%s"]}]}}`,
+			values[r.URL.Query().Get("query")])
+	}))
+	defer srv.Close()
+
+	sts := statefulset(map[string]string{
+		PrometheusURLAnnotation:  srv.URL,
+		QueryAnnotation:          `rate(errors{pod="{{.Pod}}"}[{{.Window}}])`,
+		WindowAnnotation:         "10m",
+		HigherIsBetterAnnotation: "true",
+	})
+
+	h := newHook(t, sts, pod(0, "web-1", time.Hour), pod(1, "web-1", time.Hour), pod(2, "web-2", time.Hour))
+	err := h.PodUpdateTransition(pod(2, "web-2", time.Hour), pod(1, "web-1", time.Hour))
+	if !hooks.IsAbort(err) {
+		t.Errorf("PodUpdateTransition() should abort, got: %v", err)
+	}
+
+	if err := h.PodUpdateTransition(nil, pod(2, "web-1", time.Hour)); err != nil {
+		t.Errorf("PodUpdateTransition() shouldn't analyse before the first update, got: %v", err)
+	}
+}
+
+func TestAnalysis(t *testing.T) {
+	tests := []struct {
+		name      string
+		analysis  Analysis
+		baseline  []float64
+		canaries  []float64
+		wantWorse bool
+	}{
+		{"equal", Analysis{}, []float64{1, 1}, []float64{1}, false},
+		{"within tolerance", Analysis{Tolerance: 0.2}, []float64{10, 10}, []float64{11.9}, false},
+		{"above tolerance", Analysis{Tolerance: 0.2}, []float64{10, 10}, []float64{12.1}, true},
+		{"within deviations", Analysis{Deviations: 2}, []float64{8, 12}, []float64{13.9}, false},
+		{"above deviations", Analysis{Deviations: 2}, []float64{8, 12}, []float64{14.1}, true},
+		{"within margin", Analysis{Margin: 0.01}, []float64{0, 0}, []float64{0.005}, false},
+		{"above margin", Analysis{Margin: 0.01}, []float64{0, 0}, []float64{0.02}, true},
+		{"better", Analysis{}, []float64{10}, []float64{2}, false},
+		{"higher is better", Analysis{HigherIsBetter: true}, []float64{10}, []float64{2}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.analysis.Compare(tt.baseline, tt.canaries)
+		if (err != nil) != tt.wantWorse {
+			t.Errorf("%s: Compare() = %v, want worse: %v", tt.name, err, tt.wantWorse)
+		}
+	}
+}
+
+func TestParseSeries(t *testing.T) {
+	name, labels, rest, err := parseSeries(`http_errors{code="500",path="/a \"b\", c"} 12 1535000000`)
+	if err != nil {
+		t.Fatalf("parseSeries() failed: %v", err)
+	}
+
+	if name != "http_errors" || labels["code"] != "500" || labels["path"] != `/a "b", c` ||
+		strings.TrimSpace(rest) != "12 1535000000" {
+		t.Errorf("parseSeries() = %q, %v, %q", name, labels, rest)
+	}
+
+	if _, _, err := parseSelector(`http_errors{code="500"`); err == nil {
+		t.Error("parseSelector() should fail on unterminated labels")
+	}
+}
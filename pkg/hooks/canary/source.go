@@ -0,0 +1,289 @@
+package canary
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/prometheus"
+	"github.com/pkg/errors"
+	resty "gopkg.in/resty.v1"
+	"k8s.io/api/core/v1"
+)
+
+var (
+	timeout = time.Duration(30 * time.Second)
+
+	// scrapeAddress returns the host:port a pod's metrics are scraped from.
+	scrapeAddress = func(pod *v1.Pod, port int) (string, error) {
+		return hooks.PodAddr(nil, pod, hooks.DiscoveryIP, port)
+	}
+)
+
+// Source returns a pod's value for the analysed metric.
+type Source interface {
+	Value(pod *v1.Pod) (float64, error)
+}
+
+// QueryVars are made available to the prometheus source queries templates.
+type QueryVars struct {
+	hooks.TemplateVars
+	Window string
+}
+
+func newSource(annotations map[string]string, window time.Duration) (Source, error) {
+	query, ok := annotations[QueryAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("missing %s annotation", QueryAnnotation)
+	}
+
+	client := resty.New().
+		SetRetryCount(3).
+		SetTimeout(timeout)
+
+	switch source := annotations[SourceAnnotation]; source {
+	case "", "prometheus":
+		url, ok := annotations[PrometheusURLAnnotation]
+		if !ok {
+			return nil, fmt.Errorf("missing %s annotation", PrometheusURLAnnotation)
+		}
+
+		tmpl, err := template.New(QueryAnnotation).Option("missingkey=error").Parse(query)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", QueryAnnotation))
+		}
+
+		return &prometheusSource{
+			client: client,
+			url:    strings.TrimSuffix(url, "/"),
+			query:  tmpl,
+			window: promDuration(window),
+		}, nil
+
+	case "scrape":
+		val, ok := annotations[MetricsPortAnnotation]
+		if !ok {
+			return nil, fmt.Errorf("missing %s annotation", MetricsPortAnnotation)
+		}
+		port, err := strconv.Atoi(val)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", MetricsPortAnnotation, val)
+		}
+
+		path, ok := annotations[MetricsPathAnnotation]
+		if !ok {
+			path = "/metrics"
+		}
+
+		name, labels, err := parseSelector(query)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", QueryAnnotation))
+		}
+
+		return &scrapeSource{
+			client: client,
+			port:   port,
+			path:   path,
+			name:   name,
+			labels: labels,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported %s annotation: %s", SourceAnnotation, source)
+	}
+}
+
+type prometheusSource struct {
+	client *resty.Client
+	url    string
+	query  *template.Template
+	window string
+}
+
+func (s *prometheusSource) Value(pod *v1.Pod) (float64, error) {
+	vars, err := hooks.NewTemplateVars(pod)
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	if err := s.query.Execute(&buf, QueryVars{TemplateVars: vars, Window: s.window}); err != nil {
+		return 0, err
+	}
+
+	values, err := prometheus.Query(s.client, s.url, buf.String())
+	if err != nil {
+		return 0, err
+	}
+
+	if len(values) != 1 {
+		return 0, fmt.Errorf("query returned %d values instead of one: %s", len(values), buf.String())
+	}
+
+	return values[0], nil
+}
+
+// scrapeSource sums the pod's exposed series matching a name and labels.
+type scrapeSource struct {
+	client *resty.Client
+	port   int
+	path   string
+	name   string
+	labels map[string]string
+}
+
+func (s *scrapeSource) Value(pod *v1.Pod) (float64, error) {
+	addr, err := scrapeAddress(pod, s.port)
+	if err != nil {
+		return 0, err
+	}
+
+	url := fmt.Sprintf("http://%s%s", addr, s.path)
+	resp, err := s.client.R().Get(url)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode() != 200 {
+		return 0, fmt.Errorf("%s http status code was %d", url, resp.StatusCode())
+	}
+
+	var sum float64
+	found := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(resp.Body()))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, labels, rest, err := parseSeries(line)
+		if err != nil || name != s.name || !matches(labels, s.labels) {
+			continue
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+
+		val, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value for %s: %s", s.name, fields[0])
+		}
+
+		sum += val
+		found = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if !found {
+		return 0, fmt.Errorf("no %s series exposed at %s", s.name, url)
+	}
+
+	return sum, nil
+}
+
+func matches(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSelector parses a `name{label="value",...}` series selector.
+func parseSelector(selector string) (string, map[string]string, error) {
+	name, labels, rest, err := parseSeries(strings.TrimSpace(selector))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if strings.TrimSpace(rest) != "" {
+		return "", nil, fmt.Errorf("unexpected %q after series selector", rest)
+	}
+
+	return name, labels, nil
+}
+
+// parseSeries parses the `name{label="value",...}` prefix of a text
+// exposition format line, and returns what follows it.
+func parseSeries(line string) (string, map[string]string, string, error) {
+	labels := make(map[string]string)
+
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		return line, labels, "", nil
+	}
+
+	name := line[:end]
+	if name == "" {
+		return "", nil, "", fmt.Errorf("missing metric name in %q", line)
+	}
+
+	if line[end] != '{' {
+		return name, labels, line[end:], nil
+	}
+
+	i := end + 1
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == ',') {
+			i++
+		}
+		if i >= len(line) {
+			return "", nil, "", fmt.Errorf("unterminated labels in %q", line)
+		}
+		if line[i] == '}' {
+			return name, labels, line[i+1:], nil
+		}
+
+		eq := strings.Index(line[i:], "=\"")
+		if eq < 0 {
+			return "", nil, "", fmt.Errorf("malformed labels in %q", line)
+		}
+		key := strings.TrimSpace(line[i : i+eq])
+		i += eq + 2
+
+		var val strings.Builder
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+				switch line[i] {
+				case 'n':
+					val.WriteByte('\n')
+				default:
+					val.WriteByte(line[i])
+				}
+				continue
+			}
+			val.WriteByte(line[i])
+		}
+		if i >= len(line) {
+			return "", nil, "", fmt.Errorf("unterminated label value in %q", line)
+		}
+		labels[key] = val.String()
+		i++
+	}
+}
+
+// promDuration formats a duration the way PromQL range selectors expect it (eg. 5m, 90s).
+func promDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
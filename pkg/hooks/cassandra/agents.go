@@ -0,0 +1,258 @@
+package cassandra
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/exec"
+	resty "gopkg.in/resty.v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// StateUpNormal is the state of healthy nodes, as shown by nodetool status.
+const StateUpNormal = "UN"
+
+// gossipView is the state of the nodes a node knows about, by ip address:
+// their status (U for up, D for down) followed by their state (N for normal,
+// J for joining, L for leaving, M for moving), like in nodetool status.
+type gossipView map[string]string
+
+// newGossipView builds a view from the nodes lists the management apis return.
+func newGossipView(live, down, joining, leaving, moving []string) gossipView {
+	view := make(gossipView)
+	for _, ip := range live {
+		view[ip] = "UN"
+	}
+	for _, ip := range down {
+		view[ip] = "DN"
+	}
+
+	for state, ips := range map[byte][]string{'J': joining, 'L': leaving, 'M': moving} {
+		for _, ip := range ips {
+			if status, ok := view[ip]; ok {
+				view[ip] = string([]byte{status[0], state})
+			}
+		}
+	}
+
+	return view
+}
+
+func (g gossipView) ips() []string {
+	var ips []string
+	for ip := range g {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// agent reaches a node's management interface.
+type agent interface {
+	// drain flushes the node's memtables, and stops it accepting writes
+	drain(pod *v1.Pod) error
+
+	// gossip returns the nodes states, as seen by the node
+	gossip(pod *v1.Pod) (gossipView, error)
+}
+
+// nodetool runs nodetool in the pods, through the exec subresource.
+type nodetool struct {
+	config    *rest.Config
+	container string
+	username  string
+	password  string
+}
+
+func (n *nodetool) run(pod *v1.Pod, args ...string) (string, error) {
+	command := []string{"nodetool"}
+	if n.username != "" {
+		command = append(command, "-u", n.username, "-pw", n.password)
+	}
+
+	return exec.Run(n.config, pod, n.container, append(command, args...))
+}
+
+func (n *nodetool) drain(pod *v1.Pod) error {
+	_, err := n.run(pod, "drain")
+	return err
+}
+
+func (n *nodetool) gossip(pod *v1.Pod) (gossipView, error) {
+	out, err := n.run(pod, "status")
+	if err != nil {
+		return nil, err
+	}
+	return parseStatus(out)
+}
+
+// parseStatus reads the nodes states from a nodetool status output, whose
+// nodes lines start with their state and address (eg. "UN  10.8.2.14  1.42 GiB ...").
+func parseStatus(out string) (gossipView, error) {
+	view := make(gossipView)
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || len(fields[0]) != 2 ||
+			!strings.ContainsAny(fields[0][:1], "UD") || !strings.ContainsAny(fields[0][1:], "NJLM") {
+			continue
+		}
+
+		// Cassandra 4 may show the storage port with the address
+		host := fields[1]
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		view[host] = fields[0]
+	}
+
+	if len(view) == 0 {
+		return nil, fmt.Errorf("no node in nodetool status output")
+	}
+
+	return view, nil
+}
+
+// restAgent is the common part of the http agents.
+type restAgent struct {
+	client *resty.Client
+	scheme string
+
+	// addr returns the host:port reaching a pod's agent
+	addr func(pod *v1.Pod) (string, error)
+}
+
+func (r *restAgent) url(pod *v1.Pod, path string) (string, error) {
+	addr, err := r.addr(pod)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s://%s%s", r.scheme, addr, path), nil
+}
+
+// do sends a request, and decodes the json response into v (when not nil).
+func (r *restAgent) do(pod *v1.Pod, method, path string, body, v interface{}) error {
+	url, err := r.url(pod, path)
+	if err != nil {
+		return err
+	}
+
+	req := r.client.R()
+	if body != nil {
+		req.SetBody(body)
+	}
+
+	resp, err := req.Execute(method, url)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("%s %s http status code was %d for %s", method, path, resp.StatusCode(), pod.GetName())
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Body(), v)
+}
+
+// jolokia calls the StorageService MBean through a Jolokia agent.
+type jolokia struct {
+	restAgent
+}
+
+const storageService = "org.apache.cassandra.db:type=StorageService"
+
+type JolokiaRequest struct {
+	Type      string   `json:"type"`
+	MBean     string   `json:"mbean"`
+	Operation string   `json:"operation,omitempty"`
+	Attribute []string `json:"attribute,omitempty"`
+}
+
+type JolokiaResponse struct {
+	Status int             `json:"status"`
+	Error  string          `json:"error"`
+	Value  json.RawMessage `json:"value"`
+}
+
+type JolokiaNodes struct {
+	LiveNodes        []string `json:"LiveNodes"`
+	UnreachableNodes []string `json:"UnreachableNodes"`
+	JoiningNodes     []string `json:"JoiningNodes"`
+	LeavingNodes     []string `json:"LeavingNodes"`
+	MovingNodes      []string `json:"MovingNodes"`
+}
+
+// call sends a request to the agent, which reports the MBean errors in the response's status.
+func (j *jolokia) call(pod *v1.Pod, req JolokiaRequest) (json.RawMessage, error) {
+	resp := JolokiaResponse{}
+	if err := j.do(pod, "POST", "/jolokia/", req, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Status != 200 {
+		return nil, fmt.Errorf("jolokia %s %s failed with status %d: %s", req.Type, req.MBean, resp.Status, resp.Error)
+	}
+
+	return resp.Value, nil
+}
+
+func (j *jolokia) drain(pod *v1.Pod) error {
+	_, err := j.call(pod, JolokiaRequest{Type: "exec", MBean: storageService, Operation: "drain"})
+	return err
+}
+
+func (j *jolokia) gossip(pod *v1.Pod) (gossipView, error) {
+	val, err := j.call(pod, JolokiaRequest{
+		Type:      "read",
+		MBean:     storageService,
+		Attribute: []string{"LiveNodes", "UnreachableNodes", "JoiningNodes", "LeavingNodes", "MovingNodes"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := JolokiaNodes{}
+	if err := json.Unmarshal(val, &m); err != nil {
+		return nil, err
+	}
+
+	return newGossipView(m.LiveNodes, m.UnreachableNodes, m.JoiningNodes, m.LeavingNodes, m.MovingNodes), nil
+}
+
+// scylla calls the Scylla REST api.
+type scylla struct {
+	restAgent
+}
+
+func (s *scylla) drain(pod *v1.Pod) error {
+	return s.do(pod, "POST", "/storage_service/drain", nil, nil)
+}
+
+func (s *scylla) gossip(pod *v1.Pod) (gossipView, error) {
+	lists := make([][]string, 5)
+	paths := []string{
+		"/gossiper/endpoint/live/",
+		"/gossiper/endpoint/down/",
+		"/storage_service/nodes/joining",
+		"/storage_service/nodes/leaving",
+		"/storage_service/nodes/moving",
+	}
+
+	for i, path := range paths {
+		if err := s.do(pod, "GET", path, nil, &lists[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return newGossipView(lists[0], lists[1], lists[2], lists[3], lists[4]), nil
+}
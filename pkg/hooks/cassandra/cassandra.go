@@ -0,0 +1,266 @@
+package cassandra
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	resty "gopkg.in/resty.v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// EndpointAnnotation selects how nodes are managed: by running nodetool in
+	// the pods (exec, the default), through a Jolokia agent (jolokia), or through
+	// the Scylla REST api (scylla).
+	EndpointAnnotation = hooks.AnnotationPrefix + "cassandra-endpoint"
+
+	// PortAnnotation is the Jolokia agent port (defaults to 8778), or the
+	// Scylla REST api port (defaults to 10000).
+	PortAnnotation = hooks.AnnotationPrefix + "cassandra-port"
+
+	// SchemeAnnotation is the http endpoints scheme: http (the default) or https.
+	SchemeAnnotation = hooks.AnnotationPrefix + "cassandra-scheme"
+
+	// CredentialsSecretAnnotation names a Secret holding a "username" and a
+	// "password": the JMX credentials given to nodetool, or the http endpoints
+	// basic auth credentials.
+	CredentialsSecretAnnotation = hooks.AnnotationPrefix + "cassandra-credentials-secret"
+
+	// ContainerAnnotation is the container running nodetool (defaults to the first one).
+	ContainerAnnotation = hooks.AnnotationPrefix + "cassandra-container"
+
+	// TimeoutAnnotation is the http endpoints requests timeout, drains included
+	// (a duration, defaults to 2m).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "cassandra-timeout"
+
+	defaultJolokiaPort = 8778
+	defaultScyllaPort  = 10000
+	defaultTimeout     = 2 * time.Minute
+)
+
+const (
+	EndpointExec    = "exec"
+	EndpointJolokia = "jolokia"
+	EndpointScylla  = "scylla"
+
+	usernameKey = "username"
+	passwordKey = "password"
+)
+
+// Hook restarts nodes one at a time: a node is only restarted when all the other
+// nodes see each other as Up/Normal, and it's drained before its restart. The next
+// node waits until all the other nodes see the restarted one as Up/Normal again.
+type Hook struct {
+	client client.Client
+	sts    *appsv1.StatefulSet
+	agent  agent
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		client: c,
+		sts:    sts,
+	}
+
+	var username, password string
+	if name, ok := annotations[CredentialsSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		username, password = string(secret.Data[usernameKey]), string(secret.Data[passwordKey])
+		if username == "" {
+			return nil, fmt.Errorf("secret %s has no %s key", name, usernameKey)
+		}
+	}
+
+	endpoint := EndpointExec
+	if val, ok := annotations[EndpointAnnotation]; ok {
+		endpoint = val
+	}
+
+	if endpoint == EndpointExec {
+		cfg, err := hooks.RestConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		h.agent = &nodetool{
+			config:    cfg,
+			container: annotations[ContainerAnnotation],
+			username:  username,
+			password:  password,
+		}
+
+		return h, nil
+	}
+
+	r := restAgent{scheme: "http"}
+
+	var port int
+	switch endpoint {
+	case EndpointJolokia:
+		port = defaultJolokiaPort
+	case EndpointScylla:
+		port = defaultScyllaPort
+	default:
+		return nil, fmt.Errorf("invalid %s annotation: %q", EndpointAnnotation, endpoint)
+	}
+
+	if val, ok := annotations[PortAnnotation]; ok {
+		var err error
+		if port, err = strconv.Atoi(val); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", PortAnnotation, val)
+		}
+	}
+
+	if val, ok := annotations[SchemeAnnotation]; ok {
+		if val != "http" && val != "https" {
+			return nil, fmt.Errorf("invalid %s annotation: %q", SchemeAnnotation, val)
+		}
+		r.scheme = val
+	}
+
+	timeout := defaultTimeout
+	if val, ok := annotations[TimeoutAnnotation]; ok {
+		var err error
+		if timeout, err = time.ParseDuration(val); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", TimeoutAnnotation, val)
+		}
+	}
+
+	r.addr = func(pod *v1.Pod) (string, error) {
+		return hooks.PodAddr(sts, pod, hooks.DiscoveryIP, port)
+	}
+
+	r.client = resty.New().SetTimeout(timeout)
+	if username != "" {
+		r.client.SetBasicAuth(username, password)
+	}
+
+	if endpoint == EndpointJolokia {
+		h.agent = &jolokia{r}
+	} else {
+		h.agent = &scylla{r}
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "cassandra"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil {
+		if err := h.afterUpdate(prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil {
+		if err := h.beforeUpdate(next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+// beforeUpdate checks no other node is down, then drains next.
+func (h *Hook) beforeUpdate(next *v1.Pod) error {
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return err
+	}
+
+	var issues []string
+	for i := range pods {
+		if pods[i].GetName() == next.GetName() {
+			continue
+		}
+
+		view, err := h.agent.gossip(&pods[i])
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to get %s gossip view", pods[i].GetName()))
+		}
+
+		for _, ip := range view.ips() {
+			if ip != next.Status.PodIP && view[ip] != StateUpNormal {
+				issues = append(issues, fmt.Sprintf("%s sees %s as %s", pods[i].GetName(), node(pods, ip), view[ip]))
+			}
+		}
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("nodes aren't all up and normal: %s", strings.Join(issues, ", "))
+	}
+
+	if err := h.agent.drain(next); err != nil {
+		// There's nothing to drain on a node that's down
+		if !hooks.PodReady(next) {
+			return nil
+		}
+		return errors.Wrap(err, "drain failed")
+	}
+
+	return nil
+}
+
+// afterUpdate waits until all the other nodes see prev as up and normal.
+func (h *Hook) afterUpdate(prev *v1.Pod) error {
+	if prev.Status.PodIP == "" {
+		return fmt.Errorf("pod has no ip address yet")
+	}
+
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return err
+	}
+
+	var issues []string
+	for i := range pods {
+		if pods[i].GetName() == prev.GetName() {
+			continue
+		}
+
+		view, err := h.agent.gossip(&pods[i])
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to get %s gossip view", pods[i].GetName()))
+		}
+
+		state, ok := view[prev.Status.PodIP]
+		switch {
+		case !ok:
+			issues = append(issues, fmt.Sprintf("%s doesn't know %s yet", pods[i].GetName(), prev.Status.PodIP))
+		case state != StateUpNormal:
+			issues = append(issues, fmt.Sprintf("%s sees it as %s", pods[i].GetName(), state))
+		}
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("node isn't up and normal yet: %s", strings.Join(issues, ", "))
+	}
+
+	return nil
+}
+
+// node names the node having the given ip address, after its pod when it's part of the statefulset.
+func node(pods []v1.Pod, ip string) string {
+	for _, pod := range pods {
+		if pod.Status.PodIP == ip {
+			return fmt.Sprintf("%s (%s)", pod.GetName(), ip)
+		}
+	}
+	return ip
+}
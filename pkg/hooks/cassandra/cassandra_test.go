@@ -0,0 +1,326 @@
+package cassandra
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var cassandraStatefulSet = hookstest.StatefulSet("cassandra", nil)
+
+// fakeCluster serves the Jolokia and Scylla REST apis of the cassandra-0 to
+// cassandra-n-1 nodes (whose ips are 10.0.0.1 to 10.0.0.n), each on its own
+// 127.0.0.1 port.
+type fakeCluster struct {
+	addrs     hookstest.Addrs
+	listeners []net.Listener
+
+	mu sync.Mutex
+	// views are the nodes gossip views, by node ip
+	views   map[string]gossipView
+	drained map[string]bool
+	// down nodes don't answer
+	down map[string]bool
+	user string
+}
+
+func newFakeCluster(t *testing.T, n int) *fakeCluster {
+	f := &fakeCluster{
+		addrs:   hookstest.Addrs{},
+		views:   make(map[string]gossipView),
+		drained: make(map[string]bool),
+		down:    make(map[string]bool),
+	}
+
+	for i := 0; i < n; i++ {
+		p := pod(i)
+		l := f.addrs.Listen(t, p.GetName())
+		f.listeners = append(f.listeners, l)
+
+		node := p.Status.PodIP
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f.serve(node, w, r)
+		})}
+		go srv.Serve(l)
+	}
+
+	// All nodes see each other as up and normal
+	for i := 0; i < n; i++ {
+		view := make(gossipView)
+		for j := 0; j < n; j++ {
+			view[pod(j).Status.PodIP] = StateUpNormal
+		}
+		f.views[pod(i).Status.PodIP] = view
+	}
+
+	return f
+}
+
+func (f *fakeCluster) close() {
+	for _, l := range f.listeners {
+		l.Close()
+	}
+}
+
+// set changes how a node is seen by the others.
+func (f *fakeCluster) set(ip, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for node, view := range f.views {
+		if node != ip {
+			view[ip] = state
+		}
+	}
+}
+
+// list returns the ips a node sees in a given status (U or D) or state (N, J, L or M).
+func (f *fakeCluster) list(node string, status, state byte) []string {
+	ips := []string{}
+	for ip, s := range f.views[node] {
+		if (status == 0 || s[0] == status) && (state == 0 || s[1] == state) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func (f *fakeCluster) serve(node string, w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down[node] {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if user, _, _ := r.BasicAuth(); user != f.user {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var resp interface{}
+
+	switch r.URL.Path {
+	case "/storage_service/drain":
+		f.drained[node] = true
+	case "/gossiper/endpoint/live/":
+		resp = f.list(node, 'U', 0)
+	case "/gossiper/endpoint/down/":
+		resp = f.list(node, 'D', 0)
+	case "/storage_service/nodes/joining":
+		resp = f.list(node, 0, 'J')
+	case "/storage_service/nodes/leaving":
+		resp = f.list(node, 0, 'L')
+	case "/storage_service/nodes/moving":
+		resp = f.list(node, 0, 'M')
+
+	case "/jolokia/":
+		req := JolokiaRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MBean != storageService {
+			resp = map[string]interface{}{"status": 404, "error": "javax.management.InstanceNotFoundException"}
+			break
+		}
+		switch {
+		case req.Type == "exec" && req.Operation == "drain":
+			f.drained[node] = true
+			resp = map[string]interface{}{"status": 200, "value": nil}
+		case req.Type == "read":
+			resp = map[string]interface{}{"status": 200, "value": map[string][]string{
+				"LiveNodes":        f.list(node, 'U', 0),
+				"UnreachableNodes": f.list(node, 'D', 0),
+				"JoiningNodes":     f.list(node, 0, 'J'),
+				"LeavingNodes":     f.list(node, 0, 'L'),
+				"MovingNodes":      f.list(node, 0, 'M'),
+			}}
+		default:
+			resp = map[string]interface{}{"status": 400, "error": "unsupported request"}
+		}
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+func pod(ordinal int) *v1.Pod {
+	return hookstest.Pod(cassandraStatefulSet, ordinal, fmt.Sprintf("10.0.0.%d", ordinal+1))
+}
+
+func newHook(t *testing.T, f *fakeCluster, annotations map[string]string) *Hook {
+	objs := []runtime.Object{
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "jmx", Namespace: "default"},
+			Data:       map[string][]byte{usernameKey: []byte("pilot"), passwordKey: []byte("secret")},
+		},
+	}
+	for i := range f.listeners {
+		objs = append(objs, pod(i))
+	}
+
+	h, err := New(hookstest.NewFakeClient(objs...), hookstest.StatefulSet("cassandra", annotations))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch a := h.(*Hook).agent.(type) {
+	case *jolokia:
+		a.addr = f.addrs.Addr
+	case *scylla:
+		a.addr = f.addrs.Addr
+	}
+
+	return h.(*Hook)
+}
+
+func TestRollout(t *testing.T) {
+	for _, endpoint := range []string{EndpointJolokia, EndpointScylla} {
+		f := newFakeCluster(t, 3)
+		h := newHook(t, f, map[string]string{EndpointAnnotation: endpoint})
+
+		if err := h.PodUpdateTransition(nil, pod(2)); err != nil {
+			t.Errorf("%s: unexpected error: %v", endpoint, err)
+		}
+		if !f.drained["10.0.0.3"] || len(f.drained) != 1 {
+			t.Errorf("%s: expected cassandra-2 to be drained, got: %v", endpoint, f.drained)
+		}
+
+		// cassandra-2 restarts
+		f.set("10.0.0.3", "DN")
+		err := h.PodUpdateTransition(pod(2), pod(1))
+		want := "node isn't up and normal yet: cassandra-0 sees it as DN, cassandra-1 sees it as DN"
+		if err == nil || !strings.HasSuffix(err.Error(), want) {
+			t.Errorf("%s: expected %q error, got: %v", endpoint, want, err)
+		}
+
+		f.set("10.0.0.3", "UJ")
+		if err := h.PodUpdateTransition(pod(2), pod(1)); err == nil || !strings.Contains(err.Error(), "sees it as UJ") {
+			t.Errorf("%s: expected a joining node error, got: %v", endpoint, err)
+		}
+
+		f.set("10.0.0.3", StateUpNormal)
+		if err := h.PodUpdateTransition(pod(2), pod(1)); err != nil {
+			t.Errorf("%s: unexpected error: %v", endpoint, err)
+		}
+		if !f.drained["10.0.0.2"] {
+			t.Errorf("%s: expected cassandra-1 to be drained", endpoint)
+		}
+
+		f.close()
+	}
+}
+
+func TestNodeDown(t *testing.T) {
+	f := newFakeCluster(t, 3)
+	defer f.close()
+	h := newHook(t, f, map[string]string{EndpointAnnotation: EndpointScylla})
+
+	// cassandra-0 is down: cassandra-2 can't be restarted
+	f.set("10.0.0.1", "DN")
+	f.down["10.0.0.1"] = true
+
+	err := h.PodUpdateTransition(nil, pod(2))
+	if err == nil || !strings.Contains(err.Error(), "failed to get cassandra-0 gossip view") {
+		t.Errorf("expected an unreachable node error, got: %v", err)
+	}
+
+	// cassandra-0 is up, but cassandra-1 doesn't see it yet
+	f.down["10.0.0.1"] = false
+	f.views["10.0.0.3"]["10.0.0.1"] = StateUpNormal
+	err = h.PodUpdateTransition(nil, pod(2))
+	want := "nodes aren't all up and normal: cassandra-1 sees cassandra-0 (10.0.0.1) as DN"
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+	if len(f.drained) > 0 {
+		t.Errorf("unexpected drain: %v", f.drained)
+	}
+
+	// The next node itself may be down
+	f.set("10.0.0.1", StateUpNormal)
+	f.set("10.0.0.3", "DN")
+	f.down["10.0.0.3"] = true
+	next := pod(2)
+	next.Status.Conditions[0].Status = v1.ConditionFalse
+	if err := h.PodUpdateTransition(nil, next); err != nil {
+		t.Errorf("unexpected error restarting a down node: %v", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	f := newFakeCluster(t, 1)
+	defer f.close()
+	f.user = "pilot"
+
+	h := newHook(t, f, map[string]string{EndpointAnnotation: EndpointJolokia})
+	if err := h.PodUpdateTransition(nil, pod(0)); err == nil || !strings.Contains(err.Error(), "http status code was 401") {
+		t.Errorf("expected an unauthorized error, got: %v", err)
+	}
+
+	h = newHook(t, f, map[string]string{EndpointAnnotation: EndpointJolokia, CredentialsSecretAnnotation: "jmx"})
+	if err := h.PodUpdateTransition(nil, pod(0)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	out := `Datacenter: dc1
+===============
+Status=Up/Down
+|/ State=Normal/Leaving/Joining/Moving
+--  Address         Load       Tokens  Owns (effective)  Host ID                               Rack
+UN  10.8.2.14       1.42 GiB   256     66.7%             8d5ed9f4-7764-4dbd-bad8-43fddce94b7c  rack1
+DN  10.8.3.7:7000   1.38 GiB   256     66.7%             2a9b5f8e-1d3c-4c52-9d0a-8b1c0f7e6a45  rack1
+UJ  10.8.1.22       210 KiB    256     ?                 c4e0a3b1-9f2d-4e8a-b6c7-5d1e2f3a4b5c  rack1
+`
+
+	view, err := parseStatus(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := gossipView{"10.8.2.14": "UN", "10.8.3.7": "DN", "10.8.1.22": "UJ"}
+	if len(view) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, view)
+	}
+	for ip, state := range expected {
+		if view[ip] != state {
+			t.Errorf("expected %s to be %s, got %s", ip, state, view[ip])
+		}
+	}
+
+	if _, err := parseStatus("nodetool: Failed to connect to '127.0.0.1:7199'"); err == nil {
+		t.Error("expected an error without nodes")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{map[string]string{EndpointAnnotation: EndpointJolokia}, false},
+		{map[string]string{EndpointAnnotation: EndpointScylla, SchemeAnnotation: "https"}, false},
+		{map[string]string{EndpointAnnotation: "jmx"}, true},
+		{map[string]string{EndpointAnnotation: EndpointJolokia, PortAnnotation: "0"}, true},
+		{map[string]string{EndpointAnnotation: EndpointJolokia, SchemeAnnotation: "ftp"}, true},
+		{map[string]string{EndpointAnnotation: EndpointJolokia, TimeoutAnnotation: "10"}, true},
+		{map[string]string{EndpointAnnotation: EndpointJolokia, TimeoutAnnotation: "0s"}, true},
+		{map[string]string{EndpointAnnotation: EndpointJolokia, TimeoutAnnotation: "-5s"}, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(hookstest.NewFakeClient(), hookstest.StatefulSet("cassandra", tt.annotations)); (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error: %v, got: %v", tt.annotations, tt.wantErr, err)
+		}
+	}
+}
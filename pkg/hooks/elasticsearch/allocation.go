@@ -0,0 +1,79 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+)
+
+const allocationSetting = "cluster.routing.allocation.enable"
+
+// savedAllocation is the allocation setting found before the rollout started.
+// Nil values stand for unset settings.
+type savedAllocation struct {
+	Transient  *string `json:"transient"`
+	Persistent *string `json:"persistent"`
+}
+
+func getAllocation(n nodes) (*savedAllocation, error) {
+	m := ESClusterSettings{}
+	if err := get(n, "/_cluster/settings?flat_settings=true", &m); err != nil {
+		return nil, err
+	}
+
+	saved := &savedAllocation{}
+	if val, ok := m.Transient[allocationSetting].(string); ok {
+		saved.Transient = &val
+	}
+	if val, ok := m.Persistent[allocationSetting].(string); ok {
+		saved.Persistent = &val
+	}
+
+	return saved, nil
+}
+
+// saveAllocation records the allocation setting in the statefulset annotations,
+// before the rollout first changes it.
+func (h *ESHook) saveAllocation(es nodes) error {
+	if _, ok := h.sts.GetAnnotations()[SavedAllocationAnnotation]; ok {
+		return nil
+	}
+
+	saved, err := getAllocation(es)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the allocation setting")
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	val := string(data)
+	return hooks.PatchAnnotations(h.sts, map[string]*string{SavedAllocationAnnotation: &val})
+}
+
+// restoreAllocation restores the allocation setting saved by saveAllocation.
+func (h *ESHook) restoreAllocation(es nodes) error {
+	val, ok := h.sts.GetAnnotations()[SavedAllocationAnnotation]
+	if !ok {
+		return nil
+	}
+
+	saved := &savedAllocation{}
+	if err := json.Unmarshal([]byte(val), saved); err != nil {
+		return fmt.Errorf("invalid %s annotation: %v", SavedAllocationAnnotation, err)
+	}
+
+	err := putSettings(es, ESSettings{
+		Transient:  map[string]*string{allocationSetting: saved.Transient},
+		Persistent: map[string]*string{allocationSetting: saved.Persistent},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to restore the allocation setting")
+	}
+
+	return hooks.PatchAnnotations(h.sts, map[string]*string{SavedAllocationAnnotation: nil})
+}
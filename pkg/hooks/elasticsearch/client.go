@@ -3,24 +3,156 @@ package elasticsearch
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
+	"github.com/go-logr/logr"
 	resty "gopkg.in/resty.v1"
+	appsv1 "k8s.io/api/apps/v1"
 )
 
-var timeout = time.Duration(60 * time.Second)
+// esClient sends a hook's requests to the es nodes, with the statefulset's settings.
+type esClient struct {
+	settings *settings
+	log      logr.Logger
+	pool     *clientPool
+}
+
+// clientPool holds a statefulset's http clients. The hooks are built on every
+// reconciliation, so the pools are kept in pools, and outlive the hooks:
+// requests to a node reuse their connections, and aren't affected by the other
+// statefulsets settings.
+type clientPool struct {
+	key string
+
+	mu sync.Mutex
+	// clients are by the name the nodes certificates are verified against
+	clients map[string]*resty.Client
+}
+
+// idleConnTimeout closes the connections left idle between reconciliations.
+const idleConnTimeout = 90 * time.Second
+
+var (
+	poolsMu sync.Mutex
+	// pools are by statefulset (namespace/name)
+	pools = make(map[string]*clientPool)
+)
+
+func newClientPool(key string) *clientPool {
+	return &clientPool{key: key, clients: make(map[string]*resty.Client)}
+}
+
+// close closes the pool's idle connections.
+func (p *clientPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, client := range p.clients {
+		if t, ok := client.GetClient().Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+// newESClient returns a client with its own http clients.
+func newESClient(s *settings, log logr.Logger) *esClient {
+	return &esClient{settings: s, log: log, pool: newClientPool(s.clientKey)}
+}
+
+// sharedESClient returns a client reusing the statefulset's http clients, as long
+// as they were built with the same settings. Otherwise, they're replaced.
+func sharedESClient(sts *appsv1.StatefulSet, s *settings, log logr.Logger) *esClient {
+	name := sts.GetNamespace() + "/" + sts.GetName()
+
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+
+	pool, ok := pools[name]
+	if !ok || pool.key != s.clientKey {
+		if ok {
+			pool.close()
+		}
+		pool = newClientPool(s.clientKey)
+		pools[name] = pool
+	}
+
+	return &esClient{settings: s, log: log, pool: pool}
+}
+
+// ReleaseClients closes and forgets the statefulset's http clients, once the
+// statefulset was deleted or unsubscribed from the pilot.
+func ReleaseClients(namespace, name string) {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+
+	key := namespace + "/" + name
+	if pool, ok := pools[key]; ok {
+		pool.close()
+		delete(pools, key)
+	}
+}
+
+// request returns a request for a node whose certificate is verified against serverName.
+func (c *esClient) request(serverName string) *resty.Request {
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+
+	if client, ok := c.pool.clients[serverName]; ok {
+		return client.R()
+	}
+
+	// Each client has its own transport (rather than resty's default, the shared
+	// http.DefaultTransport), so its connections can be closed with the pool.
+	// resty's retry count is the number of attempts.
+	client := resty.New().
+		SetTransport(&http.Transport{Proxy: http.ProxyFromEnvironment, IdleConnTimeout: idleConnTimeout}).
+		SetRedirectPolicy(resty.FlexibleRedirectPolicy(5)).
+		SetRetryCount(c.settings.retries + 1).
+		SetRetryWaitTime(c.settings.retryWait).
+		SetRetryMaxWaitTime(c.settings.retryMaxWait).
+		SetTimeout(c.settings.timeout)
+
+	if c.settings.tls != nil {
+		cfg := c.settings.tls.Clone()
+		cfg.ServerName = serverName
+		client.SetTLSClientConfig(cfg)
+	}
+
+	switch {
+	case c.settings.apiKey != "":
+		client.SetHeader("Authorization", "ApiKey "+c.settings.apiKey)
+	case c.settings.username != "":
+		client.SetBasicAuth(c.settings.username, c.settings.password)
+	}
+
+	log := c.log
+	client.OnAfterResponse(func(_ *resty.Client, resp *resty.Response) error {
+		log.V(1).Info("es request", "method", resp.Request.Method, "url", resp.Request.URL,
+			"status", resp.StatusCode(), "duration", resp.Time().String())
+		return nil
+	})
+
+	c.pool.clients[serverName] = client
+	return client.R()
+}
 
 type ESHealth struct {
 	Status  string `json:"status"`
 	Cluster string `json:"cluster"`
 }
 
+// ESSettings are cluster settings updates. Nil values reset settings to their default.
 type ESSettings struct {
-	Persistent ESPersistentSetting `json:"persistent"`
+	Transient  map[string]*string `json:"transient,omitempty"`
+	Persistent map[string]*string `json:"persistent,omitempty"`
 }
 
-type ESPersistentSetting struct {
-	Reallocation string `json:"cluster.routing.allocation.enable"`
+// ESClusterSettings are the cluster settings, as returned with flat_settings.
+type ESClusterSettings struct {
+	Transient  map[string]interface{} `json:"transient"`
+	Persistent map[string]interface{} `json:"persistent"`
 }
 
 type ESSettingsAck struct {
@@ -37,35 +169,74 @@ type ESFlushShards struct {
 	Failed     int64 `json:"failed"`
 }
 
-func flushSync(host string) error {
-	_, err := resty.
-		SetRedirectPolicy(resty.FlexibleRedirectPolicy(5)).
-		SetRetryCount(3).
-		SetTimeout(timeout).R().
-		Post(fmt.Sprintf("http://%s:9200/_flush/synced", host))
+// flushSync fails when some shards couldn't be synced (ie. while they're indexing).
+func flushSync(n nodes) error {
+	resp, e, err := n.do(func(e *endpoint) (*resty.Response, error) {
+		return e.request().
+			Post(e.url("/_flush/synced"))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("/_flush/synced http status code was %d for %s",
+			resp.StatusCode(), e.base)
+	}
 
-	return err
+	return nil
 }
 
-func setAllocation(host string, target string) error {
-	resp, err := resty.
-		SetRedirectPolicy(resty.FlexibleRedirectPolicy(5)).
-		SetRetryCount(3).
-		SetTimeout(timeout).R().
-		SetBody(ESSettings{
-			Persistent: ESPersistentSetting{
-				Reallocation: target,
-			},
-		}).
-		Put(fmt.Sprintf("http://%s:9200/_cluster/settings", host))
+func flush(n nodes) error {
+	resp, e, err := n.do(func(e *endpoint) (*resty.Response, error) {
+		return e.request().
+			Post(e.url("/_flush"))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("/_flush http status code was %d for %s",
+			resp.StatusCode(), e.base)
+	}
+
+	return nil
+}
+
+func setAllocation(n nodes, scope string, target string) error {
+	return setSetting(n, scope, allocationSetting, &target)
+}
+
+// setSetting updates a cluster setting in the given scope (or resets it when val is nil).
+func setSetting(n nodes, scope, key string, val *string) error {
+	body := ESSettings{}
+	setting := map[string]*string{key: val}
+	if scope == ScopeTransient {
+		body.Transient = setting
+	} else {
+		body.Persistent = setting
+	}
+
+	return putSettings(n, body)
+}
+
+func putSettings(n nodes, body ESSettings) error {
+	resp, e, err := n.do(func(e *endpoint) (*resty.Response, error) {
+		return e.request().
+			SetBody(body).
+			Put(e.url("/_cluster/settings"))
+	})
 
 	if err != nil {
 		return err
 	}
 
 	if resp.StatusCode() != 200 {
-		return fmt.Errorf("setAllocation http status code was %d for %s",
-			resp.StatusCode(), host)
+		return fmt.Errorf("/_cluster/settings http status code was %d for %s",
+			resp.StatusCode(), e.base)
 	}
 
 	m := ESSettingsAck{}
@@ -74,18 +245,17 @@ func setAllocation(host string, target string) error {
 	}
 
 	if !m.Acknowledged {
-		return fmt.Errorf("setAllocation wasn't acknowledged for host %s", host)
+		return fmt.Errorf("settings update wasn't acknowledged for host %s", e.base)
 	}
 
 	return nil
 }
 
-func isGreen(host string) error {
-	resp, err := resty.
-		SetRedirectPolicy(resty.FlexibleRedirectPolicy(5)).
-		SetRetryCount(3).
-		SetTimeout(timeout).R().
-		Get(fmt.Sprintf("http://%s:9200/_cat/health?format=json", host))
+func isGreen(n nodes) error {
+	resp, e, err := n.do(func(e *endpoint) (*resty.Response, error) {
+		return e.request().
+			Get(e.url("/_cat/health?format=json"))
+	})
 
 	if err != nil {
 		return err
@@ -93,7 +263,7 @@ func isGreen(host string) error {
 
 	if resp.StatusCode() != 200 {
 		return fmt.Errorf("/_cat/health http status code was %d for %s",
-			resp.StatusCode(), host)
+			resp.StatusCode(), e.base)
 	}
 
 	m := make([]ESHealth, 1)
@@ -102,7 +272,7 @@ func isGreen(host string) error {
 	}
 
 	if m[0].Status != "green" {
-		return fmt.Errorf("/_cat/health is %s for host %s", m[0].Status, host)
+		return fmt.Errorf("/_cat/health is %s for host %s", m[0].Status, e.base)
 	}
 
 	return nil
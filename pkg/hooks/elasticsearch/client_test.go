@@ -0,0 +1,256 @@
+package elasticsearch
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/elasticsearch/fakees"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+// testNodes returns the nodes reaching srv, with the settings from annotations.
+func testNodes(t *testing.T, srv *httptest.Server, annotations map[string]string) nodes {
+	s, err := loadSettings(nil, esStatefulSet(annotations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nodes{{base: srv.URL, client: newESClient(s, logf.Log)}}
+}
+
+// testHookNodes returns the cluster nodes of a new hook for an "es" statefulset.
+func testHookNodes(t *testing.T, annotations map[string]string) nodes {
+	sts := esStatefulSet(annotations)
+	h, err := New(hookstest.NewFakeClient(sts.DeepCopy()), sts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := h.(*ESHook).clusterNodes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestIsGreen(t *testing.T) {
+	tests := []struct {
+		title   string
+		es      *fakees.ES
+		wantErr string
+	}{
+		{title: "green", es: &fakees.ES{}},
+		{title: "yellow", es: &fakees.ES{Status: "yellow"}, wantErr: "/_cat/health is yellow"},
+		{
+			title:   "unavailable",
+			es:      &fakees.ES{Failures: map[string]int{"GET /_cat/health": 503}},
+			wantErr: "/_cat/health http status code was 503",
+		},
+	}
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(tt.es)
+		err := isGreen(testNodes(t, srv, nil))
+		srv.Close()
+
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.title, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: expected %q error, got: %v", tt.title, tt.wantErr, err)
+		}
+	}
+}
+
+func TestSetAllocation(t *testing.T) {
+	es := &fakees.ES{Persistent: map[string]string{"indices.recovery.max_bytes_per_sec": "50mb"}}
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+	n := testNodes(t, srv, nil)
+
+	for _, scope := range []string{ScopePersistent, ScopeTransient} {
+		if err := setAllocation(n, scope, "primaries"); err != nil {
+			t.Fatalf("%s: unexpected error: %v", scope, err)
+		}
+		if got := es.Allocation(scope); got != "primaries" {
+			t.Errorf("%s: expected primaries allocation, got %q", scope, got)
+		}
+	}
+
+	if got := es.Setting(ScopePersistent, "indices.recovery.max_bytes_per_sec"); got != "50mb" {
+		t.Errorf("other settings were changed: %v", es.Persistent)
+	}
+
+	es.Lock()
+	es.Unacknowledged = true
+	es.Unlock()
+	if err := setAllocation(n, ScopePersistent, "all"); err == nil {
+		t.Error("expected unacknowledged settings updates to fail")
+	}
+
+	es.Lock()
+	es.Failures = map[string]int{"PUT /_cluster/settings": 500}
+	es.Unlock()
+	if err := setAllocation(n, ScopePersistent, "all"); err == nil {
+		t.Error("expected failed settings updates to fail")
+	}
+}
+
+func TestFlushSync(t *testing.T) {
+	tests := []struct {
+		title   string
+		es      *fakees.ES
+		wantErr bool
+	}{
+		{title: "synced", es: &fakees.ES{Version: "6.8.23"}},
+		{title: "removed in 8.0", es: &fakees.ES{Version: "8.11.1"}, wantErr: true},
+		{
+			title:   "some shards not synced",
+			es:      &fakees.ES{Version: "7.5.2", Failures: map[string]int{"POST /_flush/synced": 409}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(tt.es)
+		err := flushSync(testNodes(t, srv, nil))
+		srv.Close()
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: flushSync() error = %v, wantErr %v", tt.title, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConnectionsReuse(t *testing.T) {
+	var mu sync.Mutex
+	conns := 0
+
+	srv := httptest.NewUnstartedServer(&fakees.ES{})
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	// The hooks are built on every reconciliation
+	annotations := map[string]string{URLAnnotation: srv.URL}
+	for i := 0; i < 3; i++ {
+		if err := isGreen(testHookNodes(t, annotations)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	if conns != 1 {
+		t.Errorf("expected the hooks requests to share a connection, got %d connections", conns)
+	}
+	mu.Unlock()
+
+	// New settings get new connections
+	annotations[TimeoutAnnotation] = "30s"
+	if err := isGreen(testHookNodes(t, annotations)); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 2 {
+		t.Errorf("expected the settings change to open a new connection, got %d connections", conns)
+	}
+}
+
+func TestReleaseClients(t *testing.T) {
+	srv := httptest.NewServer(&fakees.ES{})
+	defer srv.Close()
+
+	annotations := map[string]string{URLAnnotation: srv.URL}
+	if err := isGreen(testHookNodes(t, annotations)); err != nil {
+		t.Fatal(err)
+	}
+
+	pooled := func() bool {
+		poolsMu.Lock()
+		defer poolsMu.Unlock()
+		_, ok := pools["default/es"]
+		return ok
+	}
+	if !pooled() {
+		t.Fatal("expected the statefulset clients to be kept")
+	}
+
+	ReleaseClients("default", "es")
+	if pooled() {
+		t.Error("expected the released statefulset clients to be forgotten")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+
+	// Drops the first two connections
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		drop := attempts <= 2
+		mu.Unlock()
+
+		if drop {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`[{"cluster": "es", "status": "green"}]`))
+	}))
+	defer srv.Close()
+
+	backoff := map[string]string{RetryWaitAnnotation: "1ms", RetryMaxWaitAnnotation: "5ms"}
+
+	backoff[RetriesAnnotation] = "1"
+	if err := isGreen(testNodes(t, srv, backoff)); err == nil {
+		t.Error("expected a failure after a single retry")
+	}
+
+	mu.Lock()
+	attempts = 0
+	mu.Unlock()
+	backoff[RetriesAnnotation] = "2"
+	if err := isGreen(testNodes(t, srv, backoff)); err != nil {
+		t.Errorf("expected a success after two retries, got: %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`[{"cluster": "es", "status": "green"}]`))
+	}))
+	defer srv.Close()
+
+	n := testNodes(t, srv, map[string]string{TimeoutAnnotation: "20ms", RetriesAnnotation: "0"})
+	if err := isGreen(n); err == nil {
+		t.Error("expected the request to time out")
+	}
+}
+
+func TestClientSettings(t *testing.T) {
+	for _, annotations := range []map[string]string{
+		{TimeoutAnnotation: "60"},
+		{TimeoutAnnotation: "-1s"},
+		{RetriesAnnotation: "-1"},
+		{RetryWaitAnnotation: "soon"},
+	} {
+		if _, err := loadSettings(nil, esStatefulSet(annotations)); err == nil {
+			t.Errorf("expected %v annotations to be rejected", annotations)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+)
+
+// CriticalDeprecationsReason is the reason of the Warning events emitted while
+// critical issues prevent a major version upgrade.
+const CriticalDeprecationsReason = "CriticalDeprecations"
+
+type ESDeprecation struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	URL     string `json:"url"`
+	Details string `json:"details"`
+}
+
+type ESIndexSettings struct {
+	Settings map[string]string `json:"settings"`
+}
+
+// criticalDeprecations lists the critical issues reported by the deprecations api
+// (an x-pack api, moved out of _xpack in 7.0). Its sections are either lists of issues
+// (ie. "cluster_settings"), or lists of issues by resource (ie. "index_settings").
+func criticalDeprecations(n nodes, v version) ([]string, error) {
+	path := "/_migration/deprecations"
+	if v.major < 7 {
+		path = "/_xpack/migration/deprecations"
+	}
+
+	m := make(map[string]json.RawMessage)
+	if err := get(n, path, &m); err != nil {
+		return nil, err
+	}
+
+	var issues []string
+	for section, raw := range m {
+		var list []ESDeprecation
+		if err := json.Unmarshal(raw, &list); err == nil {
+			issues = append(issues, critical(section, list)...)
+			continue
+		}
+
+		var byName map[string][]ESDeprecation
+		if err := json.Unmarshal(raw, &byName); err != nil {
+			// Not an issues section
+			continue
+		}
+		for name, list := range byName {
+			issues = append(issues, critical(fmt.Sprintf("%s[%s]", section, name), list)...)
+		}
+	}
+
+	sort.Strings(issues)
+	return issues, nil
+}
+
+func critical(section string, list []ESDeprecation) []string {
+	var issues []string
+	for _, d := range list {
+		if d.Level == "critical" {
+			issues = append(issues, fmt.Sprintf("%s: %s", section, d.Message))
+		}
+	}
+	return issues
+}
+
+// openSearchVersionMask flags the OpenSearch version ids.
+const openSearchVersionMask = 0x08000000
+
+// incompatibleIndices lists the indices the target version can't read: indices
+// are readable by the next major version only.
+func incompatibleIndices(n nodes, target version) ([]string, error) {
+	m := make(map[string]ESIndexSettings)
+	path := "/_all/_settings/index.version.created?flat_settings=true&expand_wildcards=all"
+	if err := get(n, path, &m); err != nil {
+		return nil, err
+	}
+
+	var indices []string
+	for name, index := range m {
+		// Version ids are major*1000000 + minor*10000 + revision*100 + build
+		id, err := strconv.Atoi(index.Settings["index.version.created"])
+		if err != nil {
+			continue
+		}
+		created := version{distribution: DistributionElasticsearch}
+		if id&openSearchVersionMask != 0 {
+			created.distribution, id = DistributionOpenSearch, id^openSearchVersionMask
+		}
+		created.major, created.minor = id/1000000, id/10000%100
+		created.number = fmt.Sprintf("%d.%d", created.major, created.minor)
+
+		if created.esMajor() < target.esMajor()-1 {
+			indices = append(indices, fmt.Sprintf("index %s was created with %s", name, created))
+		}
+	}
+
+	sort.Strings(indices)
+	return indices, nil
+}
+
+// upgradeChecks refuses to start a major version upgrade while the cluster has
+// critical deprecation issues, or indices the target version can't read.
+// OpenSearch has no deprecations api.
+func upgradeChecks(es nodes, current, target version) error {
+	var issues []string
+	if !current.isOpenSearch() {
+		var err error
+		if issues, err = criticalDeprecations(es, current); err != nil {
+			return errors.Wrap(err, "failed to get the deprecations")
+		}
+	}
+
+	indices, err := incompatibleIndices(es, target)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the indices versions")
+	}
+	issues = append(issues, indices...)
+
+	if len(issues) == 0 {
+		return nil
+	}
+
+	return hooks.Warn(CriticalDeprecationsReason,
+		fmt.Errorf("%d critical issues must be fixed before upgrading from %s to %s: %s",
+			len(issues), current, target, hooks.List(issues, "; ")))
+}
@@ -0,0 +1,140 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+)
+
+const excludeNameSetting = "cluster.routing.allocation.exclude._name"
+
+type ESShard struct {
+	Index  string `json:"index"`
+	Shard  string `json:"shard"`
+	PriRep string `json:"prirep"`
+	State  string `json:"state"`
+	Node   string `json:"node"`
+}
+
+// getExcludedNames returns the nodes names excluded from allocation in the given scope.
+func getExcludedNames(n nodes, scope string) ([]string, error) {
+	m := ESClusterSettings{}
+	if err := get(n, "/_cluster/settings?flat_settings=true", &m); err != nil {
+		return nil, err
+	}
+
+	settings := m.Persistent
+	if scope == ScopeTransient {
+		settings = m.Transient
+	}
+
+	val, _ := settings[excludeNameSetting].(string)
+
+	var names []string
+	for _, name := range strings.Split(val, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// setExcludedNames updates the allocation exclusions, resetting the setting when names is empty.
+func setExcludedNames(n nodes, scope string, names []string) error {
+	if len(names) == 0 {
+		return setSetting(n, scope, excludeNameSetting, nil)
+	}
+
+	val := strings.Join(names, ",")
+	return setSetting(n, scope, excludeNameSetting, &val)
+}
+
+// shardsLeft checks that no shard is allocated to the node anymore.
+func shardsLeft(n nodes, name string) error {
+	var m []ESShard
+	if err := get(n, "/_cat/shards?format=json&h=index,shard,prirep,state,node", &m); err != nil {
+		return err
+	}
+
+	var left []string
+	for _, s := range m {
+		if s.Node == name {
+			left = append(left, fmt.Sprintf("%s[%s] %s", s.Index, s.Shard, s.State))
+		}
+	}
+
+	if len(left) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d shards left on node %s: %s", len(left), name, hooks.List(left, ", "))
+}
+
+// drain excludes the pod's node from allocation (keeping the operator's exclusions),
+// and waits for its shards to move to other nodes.
+func (h *ESHook) drain(es nodes, pod *v1.Pod) error {
+	name, err := h.settings.nodeName(pod)
+	if err != nil {
+		return errors.Wrap(err, "failed to render the es node name")
+	}
+
+	names, err := getExcludedNames(es, h.settings.allocationScope)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the allocation exclusions")
+	}
+
+	if !contains(names, name) {
+		if err := setExcludedNames(es, h.settings.allocationScope, append(names, name)); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to exclude %s from allocation", name))
+		}
+	}
+
+	if err := shardsLeft(es, name); err != nil {
+		return errors.Wrap(err, "node not yet drained")
+	}
+
+	return nil
+}
+
+// undrain removes the pod's node from the allocation exclusions.
+func (h *ESHook) undrain(es nodes, pod *v1.Pod) error {
+	name, err := h.settings.nodeName(pod)
+	if err != nil {
+		return errors.Wrap(err, "failed to render the es node name")
+	}
+
+	names, err := getExcludedNames(es, h.settings.allocationScope)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the allocation exclusions")
+	}
+
+	if !contains(names, name) {
+		return nil
+	}
+
+	var kept []string
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+
+	if err := setExcludedNames(es, h.settings.allocationScope, kept); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to include %s in allocation again", name))
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -5,63 +5,235 @@ import (
 
 	"github.com/bpineau/statefulset-pilot/pkg/hooks"
 	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
 
-type ESHook struct{}
+// ESHook pilots Elasticsearch and OpenSearch rollouts. The rolling restart procedure
+// follows the running cluster's distribution and version, while the hook's own
+// distribution is the one the statefulset is upgraded to.
+type ESHook struct {
+	client       client.Client
+	sts          *appsv1.StatefulSet
+	settings     *settings
+	esClient     *esClient
+	distribution string
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	return newHook(c, sts, DistributionElasticsearch)
+}
 
-func New() (hooks.STSRolloutHooks, error) {
-	return &ESHook{}, nil
+// NewOpenSearch returns the hook for OpenSearch statefulsets.
+func NewOpenSearch(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	return newHook(c, sts, DistributionOpenSearch)
+}
+
+func newHook(c client.Client, sts *appsv1.StatefulSet, distribution string) (hooks.STSRolloutHooks, error) {
+	s, err := loadSettings(c, sts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The OpenSearch security plugin authenticates with basic auth or client certificates
+	if distribution == DistributionOpenSearch && s.apiKey != "" {
+		return nil, fmt.Errorf("the %s secret holds an api key, which opensearch doesn't support",
+			sts.GetAnnotations()[CredentialsSecretAnnotation])
+	}
+
+	log := logf.Log.WithName(distribution).WithValues("statefulset", sts.GetNamespace()+"/"+sts.GetName())
+
+	return &ESHook{client: c, sts: sts, settings: s, esClient: sharedESClient(sts, s, log), distribution: distribution}, nil
 }
 
 func (h *ESHook) Name() string {
-	return "elasticsearch"
+	return h.distribution
 }
 
 func (h *ESHook) PodUpdateTransition(prev, next *v1.Pod) error {
 	// prev or next may be nil, when we're on the rollout's first or last pod
 	if prev != nil {
-		if err := afterUpdate(prev); err != nil {
+		if err := h.afterUpdate(prev); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("pod: %s", prev.GetName()))
 		}
 	}
 
 	if next != nil {
-		if err := beforeUpdate(next); err != nil {
+		// The rollout is about to start
+		if prev == nil {
+			if err := h.beforeRollout(next); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("pod: %s", next.GetName()))
+			}
+		}
+
+		if err := h.beforeUpdate(next); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("pod: %s", next.GetName()))
 		}
+		return nil
 	}
 
-	return nil
+	// The last pod was updated: give the operator's allocation setting back
+	es, err := h.clusterNodes(prev)
+	if err != nil {
+		return err
+	}
+
+	return h.restoreAllocation(es)
 }
 
-func beforeUpdate(pod *v1.Pod) error {
-	host := pod.Status.PodIP
+// RolloutCanceled restores the allocation setting, and clears the voting
+// configuration exclusions, when the rollout is stopped midway.
+func (h *ESHook) RolloutCanceled() error {
+	es, err := h.clusterNodes(nil)
+	if err != nil {
+		return err
+	}
+
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return err
+	}
+
+	for i := range pods {
+		if err := h.includeMaster(es, &pods[i]); err != nil {
+			return err
+		}
+		if h.settings.strategy != StrategyDrain {
+			continue
+		}
+		if err := h.undrain(es, &pods[i]); err != nil {
+			return err
+		}
+	}
+
+	return h.restoreAllocation(es)
+}
+
+// beforeRollout checks major version upgrades are possible, and snapshots the
+// cluster first when a snapshot repository is configured.
+func (h *ESHook) beforeRollout(pod *v1.Pod) error {
+	es, err := h.clusterNodes(pod)
+	if err != nil {
+		return err
+	}
+
+	current, err := getVersion(es)
+	if err != nil {
+		return errors.Wrap(err, "failed to get es version")
+	}
+
+	// The target version is unknown when the image isn't tagged with a version
+	target, err := imageVersion(h.sts, h.distribution, h.settings.container)
+	known := err == nil
+	sameMajor := known && target.distribution == current.distribution && target.major == current.major
+
+	if known && !sameMajor && target.esMajor() >= current.esMajor() {
+		if err := upgradeChecks(es, current, target); err != nil {
+			return err
+		}
+	}
 
-	if err := isGreen(host); err != nil {
+	// Snapshot anyway when the target version is unknown
+	if h.settings.snapshotRepository == "" || sameMajor {
+		return nil
+	}
+
+	return h.snapshot(es)
+}
+
+func (h *ESHook) beforeUpdate(pod *v1.Pod) error {
+	es, err := h.clusterNodes(pod)
+	if err != nil {
+		return err
+	}
+
+	if err := isGreen(es); err != nil {
 		return errors.Wrap(err, "es cluster not yet green")
 	}
 
-	if err := setAllocation(host, "new_primaries"); err != nil {
-		return errors.Wrap(err, "failed to set allocation to new_primaries")
+	v, err := getVersion(es)
+	if err != nil {
+		return errors.Wrap(err, "failed to get es version")
+	}
+
+	if v.hasVotingConfig() {
+		if err := h.excludeMaster(es, v, pod); err != nil {
+			return err
+		}
+	}
+
+	if h.settings.strategy == StrategyDrain {
+		if err := h.drain(es, pod); err != nil {
+			return err
+		}
+	} else {
+		if err := h.saveAllocation(es); err != nil {
+			return err
+		}
+
+		// Rolling restarts only allow allocating primaries while a node is down
+		if err := setAllocation(es, h.settings.allocationScope, "primaries"); err != nil {
+			return errors.Wrap(err, "failed to set allocation to primaries")
+		}
+	}
+
+	if v.hasSyncedFlush() {
+		if err := flushSync(es); err != nil {
+			return errors.Wrap(err, "flush sync failed for es pod")
+		}
+		return nil
 	}
 
-	if err := flushSync(host); err != nil {
-		return errors.Wrap(err, "flush sync failed for es pod")
+	if err := flush(es); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("flush failed for es %s pod", v))
 	}
 
 	return nil
 }
 
-func afterUpdate(pod *v1.Pod) error {
-	host := pod.Status.PodIP
+func (h *ESHook) afterUpdate(pod *v1.Pod) error {
+	es, err := h.clusterNodes(pod)
+	if err != nil {
+		return err
+	}
+
+	// Once the allocation setting was restored (ie. when retrying the last pod's
+	// transition), it must not be overridden again
+	_, saved := h.sts.GetAnnotations()[SavedAllocationAnnotation]
+	if h.settings.strategy != StrategyDrain && saved {
+		if err := setAllocation(es, h.settings.allocationScope, "all"); err != nil {
+			return errors.Wrap(err, "failed to set allocation to all")
+		}
+	}
 
-	if err := setAllocation(host, "all"); err != nil {
-		return errors.Wrap(err, "failed to set allocation to all")
+	name, err := h.settings.nodeName(pod)
+	if err != nil {
+		return errors.Wrap(err, "failed to render the es node name")
 	}
 
-	if err := isGreen(host); err != nil {
-		return errors.Wrap(err, "es cluster not yet green")
+	if err := hasJoined(es, name); err != nil {
+		return err
+	}
+
+	// Let the shards move back to the node
+	if h.settings.strategy == StrategyDrain {
+		if err := h.undrain(es, pod); err != nil {
+			return err
+		}
+	}
+
+	if err := h.includeMaster(es, pod); err != nil {
+		return err
+	}
+
+	if err := isRecovered(es); err != nil {
+		return errors.Wrap(err, "es cluster not yet recovered")
+	}
+
+	if err := noRecoveries(es); err != nil {
+		return errors.Wrap(err, "es cluster not yet recovered")
 	}
 
 	return nil
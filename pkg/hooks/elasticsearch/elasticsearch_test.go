@@ -0,0 +1,613 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/elasticsearch/fakees"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestHook returns a hook for an "es" statefulset, stored in a fake client
+// and in the fake clientset the hook patches.
+func newTestHook(t *testing.T, annotations map[string]string) *ESHook {
+	sts := esStatefulSet(annotations)
+	hookstest.NewFakeClientset(sts.DeepCopy())
+	h, err := New(hookstest.NewFakeClient(sts.DeepCopy()), sts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*ESHook)
+}
+
+func TestVersions(t *testing.T) {
+	tests := []struct {
+		distribution string
+		version      string
+		flush        string
+		voting       bool
+	}{
+		{"", "6.8.23", "POST /_flush/synced", false},
+		{"", "7.5.2", "POST /_flush/synced", true},
+		{"", "7.17.9", "POST /_flush", true},
+		{"", "8.11.1", "POST /_flush", true},
+		{DistributionOpenSearch, "1.3.13", "POST /_flush", true},
+		{DistributionOpenSearch, "2.11.0", "POST /_flush", true},
+	}
+
+	for _, tt := range tests {
+		es := &fakees.ES{Distribution: tt.distribution, Version: tt.version}
+		srv := httptest.NewServer(es)
+
+		h := newTestHook(t, map[string]string{URLAnnotation: srv.URL})
+
+		if err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2")); err != nil {
+			t.Errorf("%s: before update failed: %v", tt.version, err)
+		}
+		if !es.Called(tt.flush) {
+			t.Errorf("%s: expected %s, got %v", tt.version, tt.flush, es.Calls)
+		}
+		if tt.flush != "POST /_flush/synced" && es.Called("POST /_flush/synced") {
+			t.Errorf("%s: unexpected synced flush", tt.version)
+		}
+		if got := es.Allocation(ScopePersistent); got != "primaries" {
+			t.Errorf("%s: expected primaries allocation before update, got %q", tt.version, got)
+		}
+		if got := es.Excluded("es-2"); got != tt.voting {
+			t.Errorf("%s: expected es-2 excluded from voting = %v, got %v", tt.version, tt.voting, got)
+		}
+
+		if err := h.PodUpdateTransition(runningPod("es-2", "10.0.0.2"), runningPod("es-1", "10.0.0.1")); err != nil {
+			t.Errorf("%s: after update failed: %v", tt.version, err)
+		}
+		if got := es.Allocation(ScopePersistent); got != "primaries" {
+			t.Errorf("%s: expected primaries allocation before next update, got %q", tt.version, got)
+		}
+
+		if err := h.PodUpdateTransition(runningPod("es-1", "10.0.0.1"), nil); err != nil {
+			t.Errorf("%s: after update failed: %v", tt.version, err)
+		}
+		if got := es.Allocation(ScopePersistent); got != "" {
+			t.Errorf("%s: expected allocation setting to be reset, got %q", tt.version, got)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		number  string
+		synced  bool
+		wantErr bool
+	}{
+		{"5.6.16", true, false},
+		{"7.5.0", true, false},
+		{"7.6.0", false, false},
+		{"8.0.0-rc1", false, false},
+		{"eight", false, true},
+		{"", false, true},
+	}
+
+	for _, tt := range tests {
+		v, err := parseVersion(tt.number)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseVersion(%q) error = %v, wantErr %v", tt.number, err, tt.wantErr)
+			continue
+		}
+		if err == nil && v.hasSyncedFlush() != tt.synced {
+			t.Errorf("parseVersion(%q).hasSyncedFlush() = %v, want %v", tt.number, !tt.synced, tt.synced)
+		}
+	}
+}
+
+func TestRecoveryChecks(t *testing.T) {
+	tests := []struct {
+		title   string
+		es      *fakees.ES
+		wantErr string
+	}{
+		{
+			title: "recovered",
+			es:    &fakees.ES{},
+		},
+		{
+			title:   "node not rejoined",
+			es:      &fakees.ES{Nodes: []string{"es-0", "es-1"}},
+			wantErr: "node es-2 hasn't rejoined the cluster yet",
+		},
+		{
+			title:   "shards recovering",
+			es:      &fakees.ES{ClusterHealth: `{"status": "yellow", "initializing_shards": 2, "unassigned_shards": 3}`},
+			wantErr: "cluster is yellow, with 3 unassigned shards, 2 initializing shards",
+		},
+		{
+			title:   "shards relocating",
+			es:      &fakees.ES{ClusterHealth: `{"status": "green", "relocating_shards": 1}`},
+			wantErr: "cluster is green, with 1 relocating shards",
+		},
+		{
+			title:   "red cluster",
+			es:      &fakees.ES{ClusterHealth: `{"status": "red"}`},
+			wantErr: "cluster is red",
+		},
+		{
+			title: "recoveries in flight",
+			es: &fakees.ES{Recoveries: `[{"index": "logs", "shard": "0", "stage": "translog",
+				"source_node": "es-0", "target_node": "es-2"}]`},
+			wantErr: "1 shard recoveries in flight: logs[0] es-0 to es-2 (translog)",
+		},
+	}
+
+	for _, tt := range tests {
+		tt.es.Version = "7.17.9"
+		srv := httptest.NewServer(tt.es)
+
+		h := newTestHook(t, map[string]string{URLAnnotation: srv.URL})
+
+		err := h.PodUpdateTransition(runningPod("es-2", "10.0.0.2"), nil)
+		srv.Close()
+
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.title, err)
+		case tt.wantErr != "" && (err == nil || !strings.HasSuffix(err.Error(), tt.wantErr)):
+			t.Errorf("%s: expected %q error, got: %v", tt.title, tt.wantErr, err)
+		}
+	}
+}
+
+func TestAllocationRestore(t *testing.T) {
+	for _, scope := range []string{ScopePersistent, ScopeTransient} {
+		es := &fakees.ES{
+			Version:    "7.17.9",
+			Transient:  map[string]string{allocationSetting: "new_primaries"},
+			Persistent: map[string]string{allocationSetting: "none", "indices.recovery.max_bytes_per_sec": "50mb"},
+		}
+		srv := httptest.NewServer(es)
+
+		// The url comes from a PilotHook config, and isn't on the stored statefulset
+		stored := esStatefulSet(map[string]string{AllocationScopeAnnotation: scope})
+		c, cs := hookstest.NewFakeClient(stored.DeepCopy()), hookstest.NewFakeClientset(stored.DeepCopy())
+		sts := esStatefulSet(map[string]string{URLAnnotation: srv.URL, AllocationScopeAnnotation: scope})
+		hook, err := New(c, sts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := hook.(*ESHook)
+
+		if err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2")); err != nil {
+			t.Fatalf("%s: before update failed: %v", scope, err)
+		}
+		if got := es.Allocation(scope); got != "primaries" {
+			t.Errorf("%s: expected primaries allocation, got %q", scope, got)
+		}
+		if _, ok := h.sts.GetAnnotations()[SavedAllocationAnnotation]; !ok {
+			t.Errorf("%s: expected the original allocation to be saved", scope)
+		}
+		stored, err = cs.AppsV1().StatefulSets("default").Get("es", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := stored.GetAnnotations()[SavedAllocationAnnotation]; !ok {
+			t.Errorf("%s: expected the original allocation to be saved on the statefulset", scope)
+		}
+		if _, ok := stored.GetAnnotations()[URLAnnotation]; ok {
+			t.Errorf("%s: expected only the saved allocation to be written on the statefulset", scope)
+		}
+
+		// Later calls don't save our own setting
+		if err := h.PodUpdateTransition(runningPod("es-2", "10.0.0.2"), runningPod("es-1", "10.0.0.1")); err != nil {
+			t.Fatalf("%s: transition failed: %v", scope, err)
+		}
+
+		if err := h.RolloutCanceled(); err != nil {
+			t.Fatalf("%s: cancel failed: %v", scope, err)
+		}
+		if es.Transient[allocationSetting] != "new_primaries" || es.Persistent[allocationSetting] != "none" {
+			t.Errorf("%s: expected allocation settings to be restored, got %v and %v",
+				scope, es.Transient, es.Persistent)
+		}
+		if es.Persistent["indices.recovery.max_bytes_per_sec"] != "50mb" {
+			t.Errorf("%s: other settings were changed: %v", scope, es.Persistent)
+		}
+		if _, ok := h.sts.GetAnnotations()[SavedAllocationAnnotation]; ok {
+			t.Errorf("%s: expected the saved allocation to be cleared", scope)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestAllocationRestoredOnce(t *testing.T) {
+	es := &fakees.ES{Version: "7.17.9", Persistent: map[string]string{allocationSetting: "none"}}
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+	h := newTestHook(t, map[string]string{URLAnnotation: srv.URL})
+
+	if err := h.PodUpdateTransition(nil, runningPod("es-0", "10.0.0.0")); err != nil {
+		t.Fatalf("before update failed: %v", err)
+	}
+	if got := es.Allocation(ScopePersistent); got != "primaries" {
+		t.Errorf("expected primaries allocation, got %q", got)
+	}
+
+	// The last transition is retried when the controller fails to save the
+	// rollout's end: the restored setting must not be overridden then
+	for i := 0; i < 2; i++ {
+		if err := h.PodUpdateTransition(runningPod("es-0", "10.0.0.0"), nil); err != nil {
+			t.Fatalf("after update failed: %v", err)
+		}
+		if got := es.Allocation(ScopePersistent); got != "none" {
+			t.Errorf("expected the allocation setting to be restored, got %q", got)
+		}
+	}
+}
+
+func TestVotingExclusions(t *testing.T) {
+	tests := []struct {
+		title    string
+		es       *fakees.ES
+		excluded bool
+		waiting  bool
+	}{
+		{title: "master-eligible node", es: &fakees.ES{Version: "7.17.9"}, excluded: true},
+		{title: "before 7.8", es: &fakees.ES{Version: "7.5.2"}, excluded: true},
+		{title: "data node", es: &fakees.ES{Version: "8.11.1", DataOnly: map[string]bool{"es-2": true}}},
+		{title: "no voting configuration", es: &fakees.ES{Version: "6.8.23"}},
+		{title: "elected master", es: &fakees.ES{Version: "7.17.9", Master: "es-2"}, excluded: true},
+		{
+			title:    "elected master, still in charge",
+			es:       &fakees.ES{Version: "7.17.9", Master: "es-2", KeepMaster: true},
+			excluded: true,
+			waiting:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(tt.es)
+		h := newTestHook(t, map[string]string{URLAnnotation: srv.URL})
+
+		err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2"))
+		if tt.waiting {
+			if hooks.WaitReason(err) != WaitingForMasterReason {
+				t.Errorf("%s: expected to wait for a new master, got: %v", tt.title, err)
+			}
+			srv.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: before update failed: %v", tt.title, err)
+		}
+
+		if got := tt.es.Excluded("es-2"); got != tt.excluded {
+			t.Errorf("%s: expected es-2 excluded = %v, got %v", tt.title, tt.excluded, got)
+		}
+		if tt.es.Master == "es-2" {
+			t.Errorf("%s: expected es-2 to not be the master anymore", tt.title)
+		}
+
+		if err := h.PodUpdateTransition(runningPod("es-2", "10.0.0.2"), nil); err != nil {
+			t.Fatalf("%s: after update failed: %v", tt.title, err)
+		}
+		if len(tt.es.Exclusions) > 0 {
+			t.Errorf("%s: expected exclusions to be cleared, got %v", tt.title, tt.es.Exclusions)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestDrain(t *testing.T) {
+	for _, scope := range []string{ScopePersistent, ScopeTransient} {
+		es := &fakees.ES{
+			Version:    "7.17.9",
+			Persistent: map[string]string{excludeNameSetting: "es-old"},
+			Transient:  map[string]string{excludeNameSetting: "es-old"},
+		}
+		srv := httptest.NewServer(es)
+
+		h := newTestHook(t, map[string]string{
+			URLAnnotation:             srv.URL,
+			StrategyAnnotation:        StrategyDrain,
+			AllocationScopeAnnotation: scope,
+		})
+
+		es.StuckShards = true
+		err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2"))
+		if want := "1 shards left on node es-2: logs[2] STARTED"; err == nil || !strings.HasSuffix(err.Error(), want) {
+			t.Errorf("%s: expected %q error, got: %v", scope, want, err)
+		}
+
+		es.StuckShards = false
+		if err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2")); err != nil {
+			t.Fatalf("%s: before update failed: %v", scope, err)
+		}
+		settings := es.Persistent
+		if scope == ScopeTransient {
+			settings = es.Transient
+		}
+		if got := settings[excludeNameSetting]; got != "es-old,es-2" {
+			t.Errorf("%s: expected es-2 to be excluded from allocation, got %q", scope, got)
+		}
+		if got := es.Allocation(scope); got != "" {
+			t.Errorf("%s: unexpected allocation setting: %q", scope, got)
+		}
+
+		if err := h.PodUpdateTransition(runningPod("es-2", "10.0.0.2"), nil); err != nil {
+			t.Fatalf("%s: after update failed: %v", scope, err)
+		}
+		if got := settings[excludeNameSetting]; got != "es-old" {
+			t.Errorf("%s: expected es-2 exclusion to be removed, got %q", scope, got)
+		}
+
+		// A canceled rollout doesn't leave nodes excluded
+		if err := h.client.Create(context.TODO(), runningPod("es-1", "10.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.PodUpdateTransition(nil, runningPod("es-1", "10.0.0.1")); err != nil {
+			t.Fatalf("%s: before update failed: %v", scope, err)
+		}
+		if err := h.RolloutCanceled(); err != nil {
+			t.Fatalf("%s: cancel failed: %v", scope, err)
+		}
+		if got := settings[excludeNameSetting]; got != "es-old" {
+			t.Errorf("%s: expected es-1 exclusion to be removed, got %q", scope, got)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		title    string
+		image    string
+		repo     string
+		snapshot bool
+	}{
+		{title: "no repository", image: "elasticsearch:8.11.1"},
+		{title: "minor upgrade", image: "elasticsearch:7.17.10", repo: "backups"},
+		{title: "major upgrade", image: "docker.elastic.co/elasticsearch/elasticsearch:8.11.1", repo: "backups", snapshot: true},
+		{title: "unknown target version", image: "elasticsearch:latest", repo: "backups", snapshot: true},
+	}
+
+	for _, tt := range tests {
+		es := &fakees.ES{Version: "7.17.9"}
+		srv := httptest.NewServer(es)
+
+		annotations := map[string]string{URLAnnotation: srv.URL}
+		if tt.repo != "" {
+			annotations[SnapshotRepositoryAnnotation] = tt.repo
+		}
+		h := newTestHook(t, annotations)
+		h.sts.Status.UpdateRevision = "es-7d4b9c8f5"
+		h.sts.Spec.Template.Spec.Containers = []v1.Container{{Name: "elasticsearch", Image: tt.image}}
+
+		err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2"))
+		if !tt.snapshot {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.title, err)
+			}
+			if len(es.Snapshots) > 0 {
+				t.Errorf("%s: unexpected snapshot: %v", tt.title, es.Snapshots)
+			}
+			srv.Close()
+			continue
+		}
+
+		snap, ok := es.Snapshots["statefulset-pilot-es-es-7d4b9c8f5"]
+		if !ok {
+			t.Fatalf("%s: expected a snapshot, got %v", tt.title, es.Snapshots)
+		}
+		if hooks.WaitReason(err) != WaitingForSnapshotReason {
+			t.Errorf("%s: expected to wait for the snapshot, got: %v", tt.title, err)
+		}
+
+		err = h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2"))
+		if hooks.WaitReason(err) != WaitingForSnapshotReason {
+			t.Errorf("%s: expected to wait for the snapshot in progress, got: %v", tt.title, err)
+		}
+		if es.Called("POST /_flush") {
+			t.Errorf("%s: the rollout started before the snapshot completed", tt.title)
+		}
+
+		snap.State = "SUCCESS"
+		if err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2")); err != nil {
+			t.Errorf("%s: unexpected error after the snapshot: %v", tt.title, err)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestSnapshotFailure(t *testing.T) {
+	es := &fakees.ES{Version: "6.8.23", Snapshots: map[string]*fakees.Snapshot{
+		"statefulset-pilot-es-es-7d4b9c8f5": {State: "PARTIAL", Reason: "2 shards failed"},
+	}}
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+
+	h := newTestHook(t, map[string]string{URLAnnotation: srv.URL, SnapshotRepositoryAnnotation: "backups"})
+	h.sts.Status.UpdateRevision = "es-7d4b9c8f5"
+	h.sts.Spec.Template.Spec.Containers = []v1.Container{{Name: "elasticsearch", Image: "elasticsearch:7.17.9"}}
+
+	err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2"))
+	if !hooks.IsAbort(err) {
+		t.Fatalf("expected the rollout to be aborted, got: %v", err)
+	}
+	if want := "ended in state PARTIAL: 2 shards failed"; !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+}
+
+func TestImageVersion(t *testing.T) {
+	tests := []struct {
+		containers   []v1.Container
+		distribution string
+		container    string
+		want         string
+		wantErr      bool
+	}{
+		{containers: []v1.Container{{Name: "es", Image: "elasticsearch:7.17.9"}}, want: "7.17.9"},
+		{containers: []v1.Container{{Name: "es", Image: "registry:5000/es/es:v8.1.0@sha256:abcd"}}, want: "8.1.0"},
+		{
+			containers: []v1.Container{{Name: "exporter", Image: "exporter:1.5.0"}, {Name: "elasticsearch", Image: "elasticsearch:8.11.1"}},
+			want:       "8.11.1",
+		},
+		{
+			containers: []v1.Container{{Name: "exporter", Image: "exporter:1.5.0"}, {Name: "search", Image: "elasticsearch:6.8.23"}},
+			container:  "search",
+			want:       "6.8.23",
+		},
+		{
+			containers:   []v1.Container{{Name: "exporter", Image: "exporter:1.5.0"}, {Name: "opensearch", Image: "opensearch:2.11.0"}},
+			distribution: DistributionOpenSearch,
+			want:         "opensearch 2.11.0",
+		},
+		{containers: []v1.Container{{Name: "es", Image: "elasticsearch:7.17.9"}}, container: "search", wantErr: true},
+		{containers: []v1.Container{{Name: "es", Image: "registry:5000/elasticsearch"}}, wantErr: true},
+		{wantErr: true},
+	}
+
+	for _, tt := range tests {
+		sts := esStatefulSet(nil)
+		sts.Spec.Template.Spec.Containers = tt.containers
+
+		if tt.distribution == "" {
+			tt.distribution = DistributionElasticsearch
+		}
+
+		v, err := imageVersion(sts, tt.distribution, tt.container)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("imageVersion(%v) error = %v, wantErr %v", tt.containers, err, tt.wantErr)
+			continue
+		}
+		if err == nil && v.String() != tt.want {
+			t.Errorf("imageVersion(%v) = %s, want %s", tt.containers, v, tt.want)
+		}
+	}
+}
+
+func TestUpgradeChecks(t *testing.T) {
+	deprecations := `{
+		"cluster_settings": [{"level": "critical", "message": "Cluster name cannot contain ':'"}],
+		"node_settings": [{"level": "warning", "message": "Realm order will be required"}],
+		"index_settings": {
+			"logs": [{"level": "critical", "message": "Index created before 7.0"}],
+			"metrics": [{"level": "info", "message": "Field type deprecated"}]
+		},
+		"ml_settings": []
+	}`
+
+	tests := []struct {
+		title   string
+		image   string
+		es      *fakees.ES
+		wantErr string
+	}{
+		{
+			title: "no issue",
+			image: "elasticsearch:8.11.1",
+			es:    &fakees.ES{Indices: map[string]string{"logs": "7170999"}},
+		},
+		{
+			title: "minor upgrade",
+			image: "elasticsearch:7.17.10",
+			es:    &fakees.ES{Deprecations: deprecations, Indices: map[string]string{"logs": "6082399"}},
+		},
+		{
+			title:   "critical deprecations",
+			image:   "elasticsearch:8.11.1",
+			es:      &fakees.ES{Deprecations: deprecations},
+			wantErr: "2 critical issues must be fixed before upgrading from 7.17.9 to 8.11.1: cluster_settings: Cluster name cannot contain ':'; index_settings[logs]: Index created before 7.0",
+		},
+		{
+			title:   "incompatible indices",
+			image:   "elasticsearch:8.11.1",
+			es:      &fakees.ES{Indices: map[string]string{"logs": "6082399", "metrics": "7100299"}},
+			wantErr: "1 critical issues must be fixed before upgrading from 7.17.9 to 8.11.1: index logs was created with 6.8",
+		},
+	}
+
+	for _, tt := range tests {
+		tt.es.Version = "7.17.9"
+		srv := httptest.NewServer(tt.es)
+
+		h := newTestHook(t, map[string]string{URLAnnotation: srv.URL})
+		h.sts.Spec.Template.Spec.Containers = []v1.Container{{Name: "elasticsearch", Image: tt.image}}
+
+		err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2"))
+		srv.Close()
+
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.title, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.HasSuffix(err.Error(), tt.wantErr) {
+			t.Errorf("%s: expected %q error, got: %v", tt.title, tt.wantErr, err)
+		}
+		if hooks.WaitReason(err) != CriticalDeprecationsReason || !hooks.IsWarning(err) {
+			t.Errorf("%s: expected a %s warning, got: %v", tt.title, CriticalDeprecationsReason, err)
+		}
+		if tt.es.Called("POST /_flush") {
+			t.Errorf("%s: the rollout started despite critical issues", tt.title)
+		}
+	}
+}
+
+func TestOpenSearchUpgradeChecks(t *testing.T) {
+	es := &fakees.ES{Distribution: DistributionOpenSearch, Version: "1.3.13", Indices: map[string]string{
+		"legacy":  "6082399",
+		"logs":    "7100299",
+		"metrics": fmt.Sprint(1030099 ^ openSearchVersionMask),
+	}}
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+
+	h := newTestHook(t, map[string]string{URLAnnotation: srv.URL})
+	h.distribution = DistributionOpenSearch
+	h.sts.Spec.Template.Spec.Containers = []v1.Container{
+		{Name: "opensearch", Image: "opensearchproject/opensearch:2.11.0"},
+	}
+
+	err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2"))
+	want := "1 critical issues must be fixed before upgrading from opensearch 1.3.13 to opensearch 2.11.0: " +
+		"index legacy was created with 6.8"
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+	if es.Called("GET /_migration/deprecations") {
+		t.Errorf("unexpected deprecations api call")
+	}
+
+	delete(es.Indices, "legacy")
+	if err := h.PodUpdateTransition(nil, runningPod("es-2", "10.0.0.2")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestOpenSearchAPIKey(t *testing.T) {
+	sts := esStatefulSet(map[string]string{CredentialsSecretAnnotation: "es-creds"})
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "es-creds", Namespace: "default"},
+		Data:       map[string][]byte{apiKeyKey: []byte("aWQ6a2V5")},
+	}
+	c := hookstest.NewFakeClient(sts.DeepCopy(), secret)
+
+	if _, err := New(c, sts); err != nil {
+		t.Errorf("unexpected elasticsearch error: %v", err)
+	}
+	if _, err := NewOpenSearch(c, sts); err == nil {
+		t.Errorf("expected opensearch to refuse api keys")
+	}
+}
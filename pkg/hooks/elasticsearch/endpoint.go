@@ -0,0 +1,110 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	resty "gopkg.in/resty.v1"
+	"k8s.io/api/core/v1"
+)
+
+// endpoint is an es node (or a service in front of the cluster), reached
+// with the statefulset's client.
+type endpoint struct {
+	base       string
+	serverName string
+	client     *esClient
+}
+
+// newEndpoint returns the endpoint reaching pod, on its IP or on its headless service DNS name.
+func newEndpoint(c *esClient, pod *v1.Pod) (*endpoint, error) {
+	s := c.settings
+	host, err := s.host(pod)
+	if err != nil {
+		return nil, fmt.Errorf("pod %s: %v", pod.GetName(), err)
+	}
+
+	e := &endpoint{
+		base:   fmt.Sprintf("%s://%s", s.scheme, net.JoinHostPort(host, strconv.Itoa(s.port))),
+		client: c,
+	}
+
+	if s.tls != nil {
+		name, err := s.serverName(pod)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render the tls server name: %v", err)
+		}
+		e.serverName = name
+	}
+
+	return e, nil
+}
+
+func (e *endpoint) url(path string) string {
+	return e.base + path
+}
+
+func (e *endpoint) request() *resty.Request {
+	return e.client.request(e.serverName)
+}
+
+// nodes are the endpoints cluster level calls are sent to, by order of preference.
+type nodes []*endpoint
+
+// do calls fn on the first node, and fails over to the next ones while the
+// nodes are unreachable. It returns the response and the node that answered.
+func (n nodes) do(fn func(e *endpoint) (*resty.Response, error)) (*resty.Response, *endpoint, error) {
+	if len(n) == 0 {
+		return nil, nil, fmt.Errorf("no reachable es node")
+	}
+
+	var err error
+	for _, e := range n {
+		var resp *resty.Response
+		if resp, err = fn(e); err == nil {
+			return resp, e, nil
+		}
+		e.client.log.Info("es node unreachable", "node", e.base, "reason", err.Error())
+	}
+
+	return nil, nil, err
+}
+
+// clusterNodes returns the nodes cluster level calls about pod are sent to:
+// the configured cluster url or service, or else pod (when not nil), then its peers.
+func (h *ESHook) clusterNodes(pod *v1.Pod) (nodes, error) {
+	if h.settings.clusterURL != "" {
+		return nodes{{base: h.settings.clusterURL, client: h.esClient}}, nil
+	}
+
+	// The pod may have no ip yet (eg. while being recreated): its peers will do
+	var n nodes
+	if pod != nil {
+		e, err := newEndpoint(h.esClient, pod)
+		if err == nil {
+			n = append(n, e)
+		} else {
+			h.esClient.log.Info("skipping es node", "pod", pod.GetName(), "reason", err.Error())
+		}
+	}
+
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].GetName() < pods[j].GetName() })
+
+	for i := range pods {
+		if (pod != nil && pods[i].GetName() == pod.GetName()) || pods[i].Status.Phase != v1.PodRunning {
+			continue
+		}
+		if e, err := newEndpoint(h.esClient, &pods[i]); err == nil {
+			n = append(n, e)
+		}
+	}
+
+	return n, nil
+}
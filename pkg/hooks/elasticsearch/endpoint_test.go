@@ -0,0 +1,144 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func esStatefulSet(annotations map[string]string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "es", Namespace: "default", Annotations: annotations},
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: "es-headless",
+			Selector:    &metav1.LabelSelector{MatchLabels: map[string]string{"app": "es"}},
+		},
+	}
+}
+
+func runningPod(name, ip string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "es"}},
+		Status:     v1.PodStatus{PodIP: ip, Phase: v1.PodRunning},
+	}
+}
+
+func TestClusterNodes(t *testing.T) {
+	tests := []struct {
+		title       string
+		annotations map[string]string
+		pod         *v1.Pod
+		want        []string
+	}{
+		{
+			title: "pod ip, then peers",
+			want:  []string{"http://10.0.0.1:9200", "http://[fd00::2]:9200"},
+		},
+		{
+			title: "pod without an ip yet, only peers",
+			pod:   runningPod("es-1", ""),
+			want:  []string{"http://[fd00::2]:9200"},
+		},
+		{
+			title:       "headless service dns names, on a custom port",
+			annotations: map[string]string{DiscoveryAnnotation: hooks.DiscoveryDNS, PortAnnotation: "9201"},
+			want: []string{
+				"http://es-1.es-headless.default.svc:9201",
+				"http://es-2.es-headless.default.svc:9201",
+			},
+		},
+		{
+			title:       "cluster service",
+			annotations: map[string]string{ServiceAnnotation: "es-http", SchemeAnnotation: "https"},
+			want:        []string{"https://es-http.default.svc:9200"},
+		},
+		{
+			title: "explicit url",
+			annotations: map[string]string{
+				ServiceAnnotation: "es-http",
+				URLAnnotation:     "https://es.example.com:443/",
+			},
+			want: []string{"https://es.example.com:443"},
+		},
+	}
+
+	pending := runningPod("es-0", "")
+	pending.Status.Phase = v1.PodPending
+	c := hookstest.NewFakeClient(pending, runningPod("es-1", "10.0.0.1"), runningPod("es-2", "fd00::2"))
+
+	for _, tt := range tests {
+		h, err := New(c, esStatefulSet(tt.annotations))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.title, err)
+		}
+
+		pod := tt.pod
+		if pod == nil {
+			pod = runningPod("es-1", "10.0.0.1")
+		}
+		n, err := h.(*ESHook).clusterNodes(pod)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.title, err)
+		}
+
+		var got []string
+		for _, e := range n {
+			got = append(got, e.base)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: clusterNodes() = %v, want %v", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"cluster": "es", "status": "green"}]`))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	// es-2 is the updated pod, and isn't reachable yet (nothing listens on 127.0.0.2)
+	c := hookstest.NewFakeClient(runningPod("es-1", "127.0.0.1"), runningPod("es-2", "127.0.0.2"))
+	h, err := New(c, esStatefulSet(map[string]string{PortAnnotation: port}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := h.(*ESHook).clusterNodes(runningPod("es-2", "127.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := isGreen(n); err != nil {
+		t.Errorf("expected isGreen to fail over to es-1, got: %v", err)
+	}
+
+	if err := isGreen(n[:1]); err == nil {
+		t.Error("expected isGreen to fail without peers")
+	}
+}
+
+func TestDiscoverySettings(t *testing.T) {
+	for _, annotations := range []map[string]string{
+		{PortAnnotation: "http"},
+		{PortAnnotation: "70000"},
+		{DiscoveryAnnotation: "mdns"},
+		{URLAnnotation: "es:9200"},
+	} {
+		if _, err := loadSettings(nil, esStatefulSet(annotations)); err == nil {
+			t.Errorf("expected %v annotations to be rejected", annotations)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// Package fakees provides a fake Elasticsearch (or OpenSearch) cluster, serving
+// the endpoints used by the elasticsearch hook, for tests.
+package fakees
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	allocationSetting  = "cluster.routing.allocation.enable"
+	excludeNameSetting = "cluster.routing.allocation.exclude._name"
+	opensearch         = "opensearch"
+)
+
+// ES mimics a cluster of a given distribution and version. It defaults to a
+// green es-0, es-1 and es-2 nodes cluster, all master-eligible, with es-0 as
+// the elected master. Its fields can be changed between requests, under lock.
+type ES struct {
+	sync.Mutex
+
+	// Distribution is reported by GET / when set (ie. "opensearch")
+	Distribution string
+	Version      string
+
+	// Nodes are the nodes names (es-0, es-1 and es-2 by default)
+	Nodes []string
+
+	// Status is the _cat/health status (green by default)
+	Status string
+
+	// ClusterHealth and Recoveries are the raw _cluster/health and _cat/recovery responses
+	ClusterHealth string
+	Recoveries    string
+
+	// Transient and Persistent are the cluster settings
+	Transient  map[string]string
+	Persistent map[string]string
+
+	// Unacknowledged settings updates are applied, but not acknowledged
+	Unacknowledged bool
+
+	// Failures are the http status codes returned to the given calls (ie. "POST /_flush")
+	Failures map[string]int
+
+	// Calls lists the calls received, as "METHOD /path"
+	Calls []string
+
+	// DataOnly nodes aren't master-eligible
+	DataOnly map[string]bool
+
+	// Master is the elected master. It fails over to another master-eligible
+	// node once excluded from the voting configuration, unless KeepMaster is set.
+	Master     string
+	KeepMaster bool
+
+	// Exclusions lists the nodes excluded from the voting configuration
+	Exclusions []string
+
+	// StuckShards don't move away from the nodes excluded from allocation
+	StuckShards bool
+
+	// Snapshots are the snapshots by name. They're created in progress.
+	Snapshots map[string]*Snapshot
+
+	// Deprecations is the raw _migration/deprecations response
+	Deprecations string
+
+	// Indices are the indices index.version.created settings, by index name
+	Indices map[string]string
+}
+
+type Snapshot struct {
+	Snapshot string `json:"snapshot"`
+	State    string `json:"state"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type shard struct {
+	Index  string `json:"index"`
+	Shard  string `json:"shard"`
+	PriRep string `json:"prirep"`
+	State  string `json:"state"`
+	Node   string `json:"node"`
+}
+
+type nodeInfo struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+type votingExclusion struct {
+	NodeID   string `json:"node_id"`
+	NodeName string `json:"node_name"`
+}
+
+func (f *ES) version() (major, minor int) {
+	parts := strings.SplitN(f.Version, ".", 3)
+	major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major, minor
+}
+
+func (f *ES) isOpenSearch() bool {
+	return f.Distribution == opensearch
+}
+
+func (f *ES) nodeNames() []string {
+	if f.Nodes == nil {
+		return []string{"es-0", "es-1", "es-2"}
+	}
+	return f.Nodes
+}
+
+// Excluded tells if the node is excluded from the voting configuration.
+func (f *ES) Excluded(name string) bool {
+	for _, e := range f.Exclusions {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// electedMaster fails over to a voting node when the master was excluded.
+func (f *ES) electedMaster() string {
+	if f.Master == "" {
+		f.Master = "es-0"
+	}
+	if f.Excluded(f.Master) && !f.KeepMaster {
+		for _, name := range f.nodeNames() {
+			if !f.DataOnly[name] && !f.Excluded(name) {
+				f.Master = name
+				break
+			}
+		}
+	}
+	return f.Master
+}
+
+// allocationExcluded tells if the node is excluded from shards allocation.
+func (f *ES) allocationExcluded(name string) bool {
+	for _, settings := range []map[string]string{f.Transient, f.Persistent} {
+		for _, e := range strings.Split(settings[excludeNameSetting], ",") {
+			if e == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shards returns a shard per node, moved away from the nodes excluded from allocation
+// (unless they're stuck).
+func (f *ES) shards() []shard {
+	var m []shard
+	names := f.nodeNames()
+	for i, name := range names {
+		node := name
+		if f.allocationExcluded(name) && !f.StuckShards {
+			node = names[(i+1)%len(names)]
+		}
+		m = append(m, shard{Index: "logs", Shard: fmt.Sprint(i), PriRep: "p", State: "STARTED", Node: node})
+	}
+	return m
+}
+
+// snapshot creates snapshots in progress, and reports their state.
+func (f *ES) snapshot(w http.ResponseWriter, r *http.Request) {
+	if f.Snapshots == nil {
+		f.Snapshots = make(map[string]*Snapshot)
+	}
+	name := path.Base(r.URL.Path)
+	snap, ok := f.Snapshots[name]
+
+	switch {
+	case r.Method == http.MethodPut && !ok:
+		f.Snapshots[name] = &Snapshot{Snapshot: name, State: "IN_PROGRESS"}
+		w.Write([]byte(`{"accepted": true}`))
+	case r.Method == http.MethodGet && ok:
+		json.NewEncoder(w).Encode(map[string][]Snapshot{"snapshots": {*snap}})
+	case r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"type": "snapshot_missing_exception"}, "status": 404}`))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// voting handles the voting configuration exclusions calls, whose api changed in 7.8.
+func (f *ES) voting(w http.ResponseWriter, r *http.Request) {
+	major, minor := f.version()
+	name := strings.TrimPrefix(r.URL.Path, "/_cluster/voting_config_exclusions")
+
+	switch {
+	case r.Method == http.MethodDelete && name == "" && r.URL.Query().Get("wait_for_removal") == "false":
+		f.Exclusions = nil
+	case r.Method == http.MethodPost && name == "" && (minor >= 8 || f.isOpenSearch()):
+		f.Exclusions = append(f.Exclusions, r.URL.Query().Get("node_names"))
+	case r.Method == http.MethodPost && name != "" && major == 7 && minor < 8:
+		f.Exclusions = append(f.Exclusions, strings.TrimPrefix(name, "/"))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte(`{}`))
+}
+
+func (f *ES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	call := r.Method + " " + r.URL.Path
+	f.Calls = append(f.Calls, call)
+
+	if code, ok := f.Failures[call]; ok {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error": "failure", "status": %d}`, code)
+		return
+	}
+
+	major, _ := f.version()
+
+	switch call {
+	case "GET /":
+		if f.Distribution != "" {
+			fmt.Fprintf(w, `{"name": "es-0", "version": {"distribution": %q, "number": %q}}`, f.Distribution, f.Version)
+			return
+		}
+		fmt.Fprintf(w, `{"name": "es-0", "version": {"number": %q}}`, f.Version)
+	case "GET /_cat/health":
+		if f.Status == "" {
+			f.Status = "green"
+		}
+		fmt.Fprintf(w, `[{"cluster": "es", "status": %q}]`, f.Status)
+	case "GET /_cat/nodes":
+		var m []map[string]string
+		for _, name := range f.nodeNames() {
+			m = append(m, map[string]string{"name": name})
+		}
+		json.NewEncoder(w).Encode(m)
+	case "GET /_nodes":
+		m := make(map[string]nodeInfo)
+		for _, name := range f.nodeNames() {
+			roles := []string{"data", "master"}
+			if f.isOpenSearch() && major >= 2 {
+				roles = []string{"data", "cluster_manager"}
+			}
+			if f.DataOnly[name] {
+				roles = []string{"data"}
+			}
+			m["id-"+name] = nodeInfo{Name: name, Roles: roles}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"nodes": m})
+	case "GET /_cat/master":
+		master := f.electedMaster()
+		fmt.Fprintf(w, `[{"id": "id-%s", "node": %q}]`, master, master)
+	case "GET /_cluster/state/metadata":
+		if !f.isOpenSearch() && major < 7 {
+			w.Write([]byte(`{}`))
+			return
+		}
+		voters, exclusions := []string{}, []votingExclusion{}
+		for _, name := range f.nodeNames() {
+			if f.Excluded(name) {
+				exclusions = append(exclusions, votingExclusion{NodeID: "id-" + name, NodeName: name})
+			} else if !f.DataOnly[name] {
+				voters = append(voters, "id-"+name)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"cluster_coordination": map[string]interface{}{
+					"last_committed_config":    voters,
+					"voting_config_exclusions": exclusions,
+				},
+			},
+		})
+	case "GET /_cluster/health":
+		if f.ClusterHealth == "" {
+			f.ClusterHealth = `{"status": "green", "relocating_shards": 0, "initializing_shards": 0, "unassigned_shards": 0}`
+		}
+		w.Write([]byte(f.ClusterHealth))
+	case "GET /_cat/recovery":
+		if f.Recoveries == "" {
+			f.Recoveries = "[]"
+		}
+		w.Write([]byte(f.Recoveries))
+	case "GET /_cat/shards":
+		json.NewEncoder(w).Encode(f.shards())
+	case "GET /_migration/deprecations", "GET /_xpack/migration/deprecations":
+		if f.isOpenSearch() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f.Deprecations == "" {
+			f.Deprecations = "{}"
+		}
+		w.Write([]byte(f.Deprecations))
+	case "GET /_all/_settings/index.version.created":
+		m := make(map[string]interface{})
+		for name, created := range f.Indices {
+			m[name] = map[string]interface{}{"settings": map[string]string{"index.version.created": created}}
+		}
+		json.NewEncoder(w).Encode(m)
+	case "GET /_cluster/settings":
+		json.NewEncoder(w).Encode(map[string]map[string]string{
+			"transient":  f.Transient,
+			"persistent": f.Persistent,
+		})
+	case "PUT /_cluster/settings":
+		var body map[string]map[string]*string
+		json.NewDecoder(r.Body).Decode(&body)
+		f.Transient = update(f.Transient, body["transient"])
+		f.Persistent = update(f.Persistent, body["persistent"])
+		fmt.Fprintf(w, `{"acknowledged": %v}`, !f.Unacknowledged)
+	case "POST /_flush/synced":
+		if major >= 8 || (f.isOpenSearch() && major >= 2) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "no handler found for uri [/_flush/synced] and method [POST]"}`))
+			return
+		}
+		w.Write([]byte(`{"_shards": {"total": 2, "successful": 2, "failed": 0}}`))
+	case "POST /_flush":
+		w.Write([]byte(`{"_shards": {"total": 2, "successful": 2, "failed": 0}}`))
+	default:
+		if strings.HasPrefix(r.URL.Path, "/_snapshot/") {
+			f.snapshot(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/_cluster/voting_config_exclusions") {
+			f.voting(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// update applies settings updates, where nil values reset settings.
+func update(settings map[string]string, updates map[string]*string) map[string]string {
+	if settings == nil {
+		settings = make(map[string]string)
+	}
+	for key, val := range updates {
+		if val == nil {
+			delete(settings, key)
+		} else {
+			settings[key] = *val
+		}
+	}
+	return settings
+}
+
+// Setting returns a cluster setting, in the "transient" or "persistent" scope.
+func (f *ES) Setting(scope, key string) string {
+	f.Lock()
+	defer f.Unlock()
+
+	if scope == "transient" {
+		return f.Transient[key]
+	}
+	return f.Persistent[key]
+}
+
+// Allocation returns the allocation setting, in the "transient" or "persistent" scope.
+func (f *ES) Allocation(scope string) string {
+	return f.Setting(scope, allocationSetting)
+}
+
+// Called tells if the cluster received the call (ie. "POST /_flush").
+func (f *ES) Called(call string) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, c := range f.Calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
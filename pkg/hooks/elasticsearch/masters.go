@@ -0,0 +1,194 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+)
+
+// WaitingForMasterReason is the reason of the events emitted while the next
+// pod's node is still the elected master.
+const WaitingForMasterReason = "WaitingForMasterElection"
+
+type ESNodesInfo struct {
+	Nodes map[string]ESNodeInfo `json:"nodes"`
+}
+
+type ESNodeInfo struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+type ESMaster struct {
+	ID   string `json:"id"`
+	Node string `json:"node"`
+}
+
+type ESVotingExclusion struct {
+	NodeID   string `json:"node_id"`
+	NodeName string `json:"node_name"`
+}
+
+type ESCoordination struct {
+	Metadata struct {
+		ClusterCoordination struct {
+			LastCommittedConfig    []string            `json:"last_committed_config"`
+			VotingConfigExclusions []ESVotingExclusion `json:"voting_config_exclusions"`
+		} `json:"cluster_coordination"`
+	} `json:"metadata"`
+}
+
+// hasVotingConfig is true for versions with voting configurations (7.0 and
+// later, and all OpenSearch versions).
+func (v version) hasVotingConfig() bool {
+	return v.isOpenSearch() || v.major >= 7
+}
+
+// findMasterEligible returns the id of the named node, if it's master-eligible
+// (a "cluster_manager" node, in OpenSearch 2.x terms).
+func findMasterEligible(n nodes, name string) (string, bool, error) {
+	m := ESNodesInfo{}
+	if err := get(n, "/_nodes?filter_path=nodes.*.name,nodes.*.roles", &m); err != nil {
+		return "", false, err
+	}
+
+	for id, node := range m.Nodes {
+		if node.Name != name {
+			continue
+		}
+		for _, role := range node.Roles {
+			if role == "master" || role == "cluster_manager" {
+				return id, true, nil
+			}
+		}
+	}
+
+	return "", false, nil
+}
+
+func getCoordination(n nodes) (*ESCoordination, error) {
+	m := &ESCoordination{}
+	err := get(n, "/_cluster/state/metadata?filter_path=metadata.cluster_coordination", m)
+	return m, err
+}
+
+func (c *ESCoordination) excludes(name string) bool {
+	for _, e := range c.Metadata.ClusterCoordination.VotingConfigExclusions {
+		if e.NodeName == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ESCoordination) votes(id string) bool {
+	for _, voter := range c.Metadata.ClusterCoordination.LastCommittedConfig {
+		if voter == id {
+			return true
+		}
+	}
+	return false
+}
+
+func electedMaster(n nodes) (string, error) {
+	var m []ESMaster
+	if err := get(n, "/_cat/master?format=json", &m); err != nil {
+		return "", err
+	}
+
+	if len(m) == 0 {
+		return "", fmt.Errorf("no elected master")
+	}
+
+	return m[0].Node, nil
+}
+
+// addVotingExclusion excludes the node from the voting configuration.
+func addVotingExclusion(n nodes, v version, name string) error {
+	path := "/_cluster/voting_config_exclusions?node_names=" + url.QueryEscape(name)
+	if !v.isOpenSearch() && v.major == 7 && v.minor < 8 {
+		path = "/_cluster/voting_config_exclusions/" + url.PathEscape(name)
+	}
+
+	return send(n, http.MethodPost, path)
+}
+
+// clearVotingExclusions removes all the voting configuration exclusions. There's no
+// API to remove a single exclusion.
+func clearVotingExclusions(n nodes) error {
+	return send(n, http.MethodDelete, "/_cluster/voting_config_exclusions?wait_for_removal=false")
+}
+
+// excludeMaster takes a master-eligible node out of the voting configuration
+// before it restarts, and waits for it to leave the configuration and to not
+// be the elected master anymore.
+func (h *ESHook) excludeMaster(es nodes, v version, pod *v1.Pod) error {
+	name, err := h.settings.nodeName(pod)
+	if err != nil {
+		return errors.Wrap(err, "failed to render the es node name")
+	}
+
+	id, eligible, err := findMasterEligible(es, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the nodes roles")
+	}
+	if !eligible {
+		return nil
+	}
+
+	coord, err := getCoordination(es)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the voting configuration")
+	}
+
+	if !coord.excludes(name) {
+		if err := addVotingExclusion(es, v, name); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to exclude %s from the voting configuration", name))
+		}
+		if coord, err = getCoordination(es); err != nil {
+			return errors.Wrap(err, "failed to get the voting configuration")
+		}
+	}
+
+	if coord.votes(id) {
+		return fmt.Errorf("master-eligible node %s hasn't left the voting configuration yet", name)
+	}
+
+	master, err := electedMaster(es)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the elected master")
+	}
+	if master == name {
+		return hooks.Wait(WaitingForMasterReason,
+			fmt.Errorf("node %s is the elected master, waiting for another master to be elected", name))
+	}
+
+	return nil
+}
+
+// includeMaster clears the voting configuration exclusion of a node that rejoined the cluster.
+func (h *ESHook) includeMaster(es nodes, pod *v1.Pod) error {
+	name, err := h.settings.nodeName(pod)
+	if err != nil {
+		return errors.Wrap(err, "failed to render the es node name")
+	}
+
+	coord, err := getCoordination(es)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the voting configuration")
+	}
+
+	if !coord.excludes(name) {
+		return nil
+	}
+
+	if err := clearVotingExclusions(es); err != nil {
+		return errors.Wrap(err, "failed to clear the voting configuration exclusions")
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	resty "gopkg.in/resty.v1"
+)
+
+type ESNode struct {
+	Name string `json:"name"`
+}
+
+type ESClusterHealth struct {
+	Status             string `json:"status"`
+	RelocatingShards   int    `json:"relocating_shards"`
+	InitializingShards int    `json:"initializing_shards"`
+	UnassignedShards   int    `json:"unassigned_shards"`
+}
+
+type ESRecovery struct {
+	Index      string `json:"index"`
+	Shard      string `json:"shard"`
+	Stage      string `json:"stage"`
+	SourceNode string `json:"source_node"`
+	TargetNode string `json:"target_node"`
+}
+
+// get fetches path, and decodes the json response into v.
+func get(n nodes, path string, v interface{}) error {
+	resp, e, err := n.do(func(e *endpoint) (*resty.Response, error) {
+		return e.request().
+			Get(e.url(path))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("%s http status code was %d for %s",
+			strings.SplitN(path, "?", 2)[0], resp.StatusCode(), e.base)
+	}
+
+	return json.Unmarshal(resp.Body(), v)
+}
+
+// send sends a body-less request to path, and checks it succeeded.
+func send(n nodes, method, path string) error {
+	resp, e, err := n.do(func(e *endpoint) (*resty.Response, error) {
+		return e.request().
+			Execute(method, e.url(path))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("%s %s http status code was %d for %s",
+			method, strings.SplitN(path, "?", 2)[0], resp.StatusCode(), e.base)
+	}
+
+	return nil
+}
+
+// hasJoined checks that the node is listed in _cat/nodes.
+func hasJoined(n nodes, name string) error {
+	var m []ESNode
+	if err := get(n, "/_cat/nodes?format=json&h=name", &m); err != nil {
+		return err
+	}
+
+	for _, node := range m {
+		if node.Name == name {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("node %s hasn't rejoined the cluster yet", name)
+}
+
+// isRecovered checks that all the shards are assigned and started.
+func isRecovered(n nodes) error {
+	m := ESClusterHealth{}
+	if err := get(n, "/_cluster/health", &m); err != nil {
+		return err
+	}
+
+	var pending []string
+	if m.UnassignedShards > 0 {
+		pending = append(pending, fmt.Sprintf("%d unassigned shards", m.UnassignedShards))
+	}
+	if m.InitializingShards > 0 {
+		pending = append(pending, fmt.Sprintf("%d initializing shards", m.InitializingShards))
+	}
+	if m.RelocatingShards > 0 {
+		pending = append(pending, fmt.Sprintf("%d relocating shards", m.RelocatingShards))
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("cluster is %s, with %s", m.Status, strings.Join(pending, ", "))
+	}
+
+	if m.Status != "green" {
+		return fmt.Errorf("cluster is %s", m.Status)
+	}
+
+	return nil
+}
+
+// noRecoveries checks that no shard recovery is in flight.
+func noRecoveries(n nodes) error {
+	var m []ESRecovery
+	if err := get(n, "/_cat/recovery?format=json&active_only=true&h=index,shard,stage,source_node,target_node", &m); err != nil {
+		return err
+	}
+
+	if len(m) == 0 {
+		return nil
+	}
+
+	var recoveries []string
+	for _, r := range m {
+		recoveries = append(recoveries, fmt.Sprintf("%s[%s] %s to %s (%s)",
+			r.Index, r.Shard, r.SourceNode, r.TargetNode, r.Stage))
+	}
+
+	return fmt.Errorf("%d shard recoveries in flight: %s", len(m), hooks.List(recoveries, ", "))
+}
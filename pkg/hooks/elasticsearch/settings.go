@@ -0,0 +1,333 @@
+package elasticsearch
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// SchemeAnnotation is the scheme used to reach the es nodes: http (the default) or https.
+	SchemeAnnotation = hooks.AnnotationPrefix + "es-scheme"
+
+	// CredentialsSecretAnnotation names a Secret holding either "username" and
+	// "password" keys, or an "api-key" key (the base64 encoded "id:api_key").
+	CredentialsSecretAnnotation = hooks.AnnotationPrefix + "es-credentials-secret"
+
+	// CASecretAnnotation names a Secret holding the "ca.crt" bundle used to
+	// verify the nodes certificates.
+	CASecretAnnotation = hooks.AnnotationPrefix + "es-ca-secret"
+
+	// ClientCertSecretAnnotation names a "kubernetes.io/tls" Secret holding the
+	// client certificate presented to the nodes.
+	ClientCertSecretAnnotation = hooks.AnnotationPrefix + "es-client-cert-secret"
+
+	// PortAnnotation is the nodes http port (defaults to 9200).
+	PortAnnotation = hooks.AnnotationPrefix + "es-port"
+
+	// DiscoveryAnnotation tells how nodes are reached: on their pod ip (the
+	// default) or on their headless service DNS name.
+	DiscoveryAnnotation = hooks.AnnotationPrefix + "es-discovery"
+
+	// ServiceAnnotation names a Service in front of the cluster, used for
+	// the cluster level calls (health, settings, ...) rather than the pods.
+	ServiceAnnotation = hooks.AnnotationPrefix + "es-service"
+
+	// TimeoutAnnotation is the es requests timeout (a duration, defaults to 60s).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "es-timeout"
+
+	// RetriesAnnotation is the number of retries of failed es requests (defaults to 3).
+	RetriesAnnotation = hooks.AnnotationPrefix + "es-retries"
+
+	// RetryWaitAnnotation and RetryMaxWaitAnnotation bound the exponential
+	// backoff between retries (durations, defaulting to 100ms and 2s).
+	RetryWaitAnnotation    = hooks.AnnotationPrefix + "es-retry-wait"
+	RetryMaxWaitAnnotation = hooks.AnnotationPrefix + "es-retry-max-wait"
+
+	// URLAnnotation is an explicit url used for the cluster level calls.
+	// It takes precedence over ServiceAnnotation.
+	URLAnnotation = hooks.AnnotationPrefix + "es-url"
+
+	// StrategyAnnotation selects how nodes are prepared for their restart:
+	// "allocation" (the default) disables shards allocation during the restart,
+	// "drain" moves the node's shards to other nodes before the restart.
+	StrategyAnnotation = hooks.AnnotationPrefix + "es-strategy"
+
+	// AllocationScopeAnnotation tells if the rollout changes the allocation
+	// setting as a persistent (the default) or transient setting.
+	AllocationScopeAnnotation = hooks.AnnotationPrefix + "es-allocation-scope"
+
+	// SnapshotRepositoryAnnotation names a registered snapshot repository. When
+	// set, major version upgrades start with a snapshot of the cluster.
+	SnapshotRepositoryAnnotation = hooks.AnnotationPrefix + "es-snapshot-repository"
+
+	// ContainerAnnotation names the es container, whose image tag tells the
+	// version the statefulset is upgraded to. Defaults to "elasticsearch" (or
+	// "opensearch" for the opensearch hook), or else the first container.
+	ContainerAnnotation = hooks.AnnotationPrefix + "es-container"
+
+	// SavedAllocationAnnotation holds the allocation setting found before the
+	// rollout, to be restored once it ends. It's maintained by the hook.
+	SavedAllocationAnnotation = hooks.AnnotationPrefix + "es-saved-allocation"
+
+	// NodeNameAnnotation is the es node name of a pod. It's a template receiving
+	// the hooks.TemplateVars, and defaults to the pod name.
+	NodeNameAnnotation = hooks.AnnotationPrefix + "es-node-name"
+
+	// ServerNameAnnotation is the name the nodes certificates are verified
+	// against. It's a template receiving the hooks.TemplateVars, and defaults
+	// to the pod's headless service DNS name.
+	ServerNameAnnotation = hooks.AnnotationPrefix + "es-tls-server-name"
+)
+
+// Rollout strategies
+const (
+	StrategyAllocation = "allocation"
+	StrategyDrain      = "drain"
+)
+
+// Cluster settings scopes
+const (
+	ScopePersistent = "persistent"
+	ScopeTransient  = "transient"
+)
+
+var defaultPort = 9200
+
+// Requests defaults
+const (
+	defaultTimeout      = 60 * time.Second
+	defaultRetries      = 3
+	defaultRetryWait    = 100 * time.Millisecond
+	defaultRetryMaxWait = 2 * time.Second
+)
+
+// Secrets keys
+const (
+	usernameKey = "username"
+	passwordKey = "password"
+	apiKeyKey   = "api-key"
+	caKey       = "ca.crt"
+)
+
+// settings holds how we reach and authenticate to a statefulset's es nodes.
+type settings struct {
+	scheme          string
+	port            int
+	discovery       string
+	clusterURL      string
+	strategy        string
+	allocationScope string
+
+	timeout      time.Duration
+	retries      int
+	retryWait    time.Duration
+	retryMaxWait time.Duration
+
+	snapshotRepository string
+	container          string
+
+	// host returns the host reaching the pod
+	host func(pod *v1.Pod) (string, error)
+
+	// nodeName returns the pod's es node name
+	nodeName func(pod *v1.Pod) (string, error)
+
+	username string
+	password string
+	apiKey   string
+	tls      *tls.Config
+
+	// serverName returns the name pod certificates are verified against
+	serverName func(pod *v1.Pod) (string, error)
+
+	// clientKey identifies the settings the http clients are built with
+	clientKey string
+}
+
+func loadSettings(c client.Client, sts *appsv1.StatefulSet) (*settings, error) {
+	annotations := sts.GetAnnotations()
+
+	s := &settings{scheme: "http", port: defaultPort, discovery: hooks.DiscoveryIP,
+		strategy: StrategyAllocation, allocationScope: ScopePersistent,
+		timeout: defaultTimeout, retries: defaultRetries,
+		retryWait: defaultRetryWait, retryMaxWait: defaultRetryMaxWait}
+	if val, ok := annotations[SchemeAnnotation]; ok {
+		if val != "http" && val != "https" {
+			return nil, fmt.Errorf("invalid %s annotation: %q", SchemeAnnotation, val)
+		}
+		s.scheme = val
+	}
+
+	if val, ok := annotations[PortAnnotation]; ok {
+		port, err := strconv.Atoi(val)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", PortAnnotation, val)
+		}
+		s.port = port
+	}
+
+	for key, d := range map[string]*time.Duration{
+		TimeoutAnnotation:      &s.timeout,
+		RetryWaitAnnotation:    &s.retryWait,
+		RetryMaxWaitAnnotation: &s.retryMaxWait,
+	} {
+		if val, ok := annotations[key]; ok {
+			duration, err := time.ParseDuration(val)
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("invalid %s annotation: %q", key, val)
+			}
+			*d = duration
+		}
+	}
+
+	if val, ok := annotations[RetriesAnnotation]; ok {
+		retries, err := strconv.Atoi(val)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", RetriesAnnotation, val)
+		}
+		s.retries = retries
+	}
+
+	if val, ok := annotations[DiscoveryAnnotation]; ok {
+		if val != hooks.DiscoveryIP && val != hooks.DiscoveryDNS {
+			return nil, fmt.Errorf("invalid %s annotation: %q", DiscoveryAnnotation, val)
+		}
+		s.discovery = val
+	}
+
+	s.host = func(pod *v1.Pod) (string, error) {
+		return hooks.PodHost(sts, pod, s.discovery)
+	}
+
+	if val, ok := annotations[StrategyAnnotation]; ok {
+		if val != StrategyAllocation && val != StrategyDrain {
+			return nil, fmt.Errorf("invalid %s annotation: %q", StrategyAnnotation, val)
+		}
+		s.strategy = val
+	}
+
+	if val, ok := annotations[AllocationScopeAnnotation]; ok {
+		if val != ScopePersistent && val != ScopeTransient {
+			return nil, fmt.Errorf("invalid %s annotation: %q", AllocationScopeAnnotation, val)
+		}
+		s.allocationScope = val
+	}
+
+	s.snapshotRepository = annotations[SnapshotRepositoryAnnotation]
+	s.container = annotations[ContainerAnnotation]
+
+	nodeName, err := hooks.ParseTemplate(annotations, NodeNameAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	s.nodeName = func(pod *v1.Pod) (string, error) {
+		if nodeName != nil {
+			return hooks.Render(nodeName, pod)
+		}
+		return pod.GetName(), nil
+	}
+
+	if val, ok := annotations[ServiceAnnotation]; ok {
+		host := fmt.Sprintf("%s.%s.svc", val, sts.GetNamespace())
+		s.clusterURL = fmt.Sprintf("%s://%s", s.scheme, net.JoinHostPort(host, strconv.Itoa(s.port)))
+	}
+
+	if val, ok := annotations[URLAnnotation]; ok {
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid %s annotation: %q", URLAnnotation, val)
+		}
+		s.clusterURL = strings.TrimSuffix(val, "/")
+	}
+
+	if name, ok := annotations[CredentialsSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		if key, ok := secret.Data[apiKeyKey]; ok {
+			s.apiKey = string(key)
+		} else {
+			s.username, s.password = string(secret.Data[usernameKey]), string(secret.Data[passwordKey])
+			if s.username == "" {
+				return nil, fmt.Errorf("secret %s has neither %s nor %s key", name, apiKeyKey, usernameKey)
+			}
+		}
+	}
+
+	if s.scheme != "https" && !strings.HasPrefix(s.clusterURL, "https:") {
+		s.clientKey = clientKey(s)
+		return s, nil
+	}
+
+	s.tls = &tls.Config{}
+	var tlsData [][]byte
+
+	if name, ok := annotations[CASecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsData = append(tlsData, secret.Data[caKey])
+		s.tls.RootCAs = x509.NewCertPool()
+		if !s.tls.RootCAs.AppendCertsFromPEM(secret.Data[caKey]) {
+			return nil, fmt.Errorf("secret %s has no valid %s certificate", name, caKey)
+		}
+	}
+
+	if name, ok := annotations[ClientCertSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, fmt.Errorf("secret %s has no valid client certificate: %v", name, err)
+		}
+		s.tls.Certificates = []tls.Certificate{cert}
+		tlsData = append(tlsData, secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	}
+
+	tmpl, err := hooks.ParseTemplate(annotations, ServerNameAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	s.serverName = func(pod *v1.Pod) (string, error) {
+		if tmpl != nil {
+			return hooks.Render(tmpl, pod)
+		}
+		return hooks.PodHost(sts, pod, hooks.DiscoveryDNS)
+	}
+
+	s.clientKey = clientKey(s, tlsData...)
+	return s, nil
+}
+
+// clientKey hashes the settings the http clients are built with, and the tls secrets data.
+func clientKey(s *settings, tlsData ...[]byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v|%d|%v|%v|%q|%q|%q|%t", s.timeout, s.retries, s.retryWait, s.retryMaxWait,
+		s.username, s.password, s.apiKey, s.tls != nil)
+	for _, data := range tlsData {
+		fmt.Fprintf(h, "|%x", data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,285 @@
+package elasticsearch
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+func secret(name string, data map[string][]byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Data:       data,
+	}
+}
+
+func esPod() *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "es-0", Namespace: "default"},
+		Status:     v1.PodStatus{PodIP: "127.0.0.1"},
+	}
+}
+
+// newTLSServer starts a fake es answering green health to authorized requests,
+// and points the default port to it.
+func newTLSServer(t *testing.T, authorized func(r *http.Request) bool, clientCAs *x509.CertPool) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[{"cluster": "es", "status": "green"}]`))
+	}))
+
+	if clientCAs != nil {
+		srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	}
+	srv.StartTLS()
+
+	u, _ := url.Parse(srv.URL)
+	_, p, _ := net.SplitHostPort(u.Host)
+	defaultPort, _ = strconv.Atoi(p)
+
+	return srv
+}
+
+func caPEM(srv *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+}
+
+// newClientCert returns a CA pool, and a client certificate and key signed by that CA.
+func newClientCert(t *testing.T) (*x509.CertPool, []byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "statefulset-pilot"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return pool,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestSecuredCluster(t *testing.T) {
+	basicAuth := func(r *http.Request) bool {
+		user, pass, ok := r.BasicAuth()
+		return ok && user == "elastic" && pass == "changeme"
+	}
+	apiKey := func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "ApiKey aWQ6a2V5"
+	}
+	anyone := func(r *http.Request) bool { return true }
+
+	clientCAs, clientCert, clientKey := newClientCert(t)
+
+	tests := []struct {
+		title       string
+		authorized  func(r *http.Request) bool
+		clientCAs   *x509.CertPool
+		annotations map[string]string
+		secrets     func(srv *httptest.Server) []runtime.Object
+		wantErr     bool
+	}{
+		{
+			title:      "basic auth, with a server name",
+			authorized: basicAuth,
+			annotations: map[string]string{
+				SchemeAnnotation:            "https",
+				CredentialsSecretAnnotation: "creds",
+				CASecretAnnotation:          "ca",
+				ServerNameAnnotation:        "example.com",
+			},
+			secrets: func(srv *httptest.Server) []runtime.Object {
+				return []runtime.Object{
+					secret("creds", map[string][]byte{usernameKey: []byte("elastic"), passwordKey: []byte("changeme")}),
+					secret("ca", map[string][]byte{caKey: caPEM(srv)}),
+				}
+			},
+		},
+		{
+			title:      "wrong credentials",
+			authorized: basicAuth,
+			annotations: map[string]string{
+				SchemeAnnotation:            "https",
+				CredentialsSecretAnnotation: "creds",
+				CASecretAnnotation:          "ca",
+				ServerNameAnnotation:        "example.com",
+			},
+			secrets: func(srv *httptest.Server) []runtime.Object {
+				return []runtime.Object{
+					secret("creds", map[string][]byte{usernameKey: []byte("elastic"), passwordKey: []byte("nope")}),
+					secret("ca", map[string][]byte{caKey: caPEM(srv)}),
+				}
+			},
+			wantErr: true,
+		},
+		{
+			title:      "api key",
+			authorized: apiKey,
+			annotations: map[string]string{
+				SchemeAnnotation:            "https",
+				CredentialsSecretAnnotation: "creds",
+				CASecretAnnotation:          "ca",
+				ServerNameAnnotation:        "example.com",
+			},
+			secrets: func(srv *httptest.Server) []runtime.Object {
+				return []runtime.Object{
+					secret("creds", map[string][]byte{apiKeyKey: []byte("aWQ6a2V5")}),
+					secret("ca", map[string][]byte{caKey: caPEM(srv)}),
+				}
+			},
+		},
+		{
+			title:      "certificate not matching the pod dns name",
+			authorized: anyone,
+			annotations: map[string]string{
+				SchemeAnnotation:   "https",
+				CASecretAnnotation: "ca",
+			},
+			secrets: func(srv *httptest.Server) []runtime.Object {
+				return []runtime.Object{secret("ca", map[string][]byte{caKey: caPEM(srv)})}
+			},
+			wantErr: true,
+		},
+		{
+			title:      "unknown certificate authority",
+			authorized: anyone,
+			annotations: map[string]string{
+				SchemeAnnotation:     "https",
+				ServerNameAnnotation: "example.com",
+			},
+			secrets: func(srv *httptest.Server) []runtime.Object { return nil },
+			wantErr: true,
+		},
+		{
+			title:      "client certificate",
+			authorized: anyone,
+			clientCAs:  clientCAs,
+			annotations: map[string]string{
+				SchemeAnnotation:           "https",
+				CASecretAnnotation:         "ca",
+				ClientCertSecretAnnotation: "client",
+				ServerNameAnnotation:       "example.com",
+			},
+			secrets: func(srv *httptest.Server) []runtime.Object {
+				return []runtime.Object{
+					secret("ca", map[string][]byte{caKey: caPEM(srv)}),
+					secret("client", map[string][]byte{v1.TLSCertKey: clientCert, v1.TLSPrivateKeyKey: clientKey}),
+				}
+			},
+		},
+		{
+			title:      "missing client certificate",
+			authorized: anyone,
+			clientCAs:  clientCAs,
+			annotations: map[string]string{
+				SchemeAnnotation:     "https",
+				CASecretAnnotation:   "ca",
+				ServerNameAnnotation: "example.com",
+			},
+			secrets: func(srv *httptest.Server) []runtime.Object {
+				return []runtime.Object{secret("ca", map[string][]byte{caKey: caPEM(srv)})}
+			},
+			wantErr: true,
+		},
+	}
+
+	defer func(p int) { defaultPort = p }(defaultPort)
+
+	for _, tt := range tests {
+		srv := newTLSServer(t, tt.authorized, tt.clientCAs)
+
+		sts := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "es", Namespace: "default", Annotations: tt.annotations},
+			Spec:       appsv1.StatefulSetSpec{ServiceName: "es-headless"},
+		}
+
+		s, err := loadSettings(fake.NewFakeClient(tt.secrets(srv)...), sts)
+		if err != nil {
+			t.Fatalf("%s: failed to load settings: %v", tt.title, err)
+		}
+
+		e, err := newEndpoint(newESClient(s, logf.Log), esPod())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.title, err)
+		}
+
+		err = isGreen(nodes{e})
+		srv.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: isGreen() error = %v, wantErr %v", tt.title, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	tests := []struct {
+		title       string
+		annotations map[string]string
+		secrets     []runtime.Object
+		wantErr     bool
+	}{
+		{"defaults to plain http", nil, nil, false},
+		{"invalid scheme", map[string]string{SchemeAnnotation: "ftp"}, nil, true},
+		{"missing secret", map[string]string{CredentialsSecretAnnotation: "creds"}, nil, true},
+		{
+			"secret without credentials",
+			map[string]string{CredentialsSecretAnnotation: "creds"},
+			[]runtime.Object{secret("creds", map[string][]byte{"token": []byte("x")})},
+			true,
+		},
+		{
+			"invalid ca bundle",
+			map[string]string{SchemeAnnotation: "https", CASecretAnnotation: "ca"},
+			[]runtime.Object{secret("ca", map[string][]byte{caKey: []byte("nope")})},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		sts := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "es", Namespace: "default", Annotations: tt.annotations},
+		}
+
+		_, err := loadSettings(fake.NewFakeClient(tt.secrets...), sts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: loadSettings() error = %v, wantErr %v", tt.title, err, tt.wantErr)
+		}
+	}
+}
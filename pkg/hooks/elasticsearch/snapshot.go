@@ -0,0 +1,99 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	resty "gopkg.in/resty.v1"
+)
+
+// WaitingForSnapshotReason is the reason of the events emitted while the
+// pre-upgrade snapshot is running.
+const WaitingForSnapshotReason = "WaitingForSnapshot"
+
+type ESSnapshots struct {
+	Snapshots []ESSnapshot `json:"snapshots"`
+}
+
+type ESSnapshot struct {
+	Snapshot string `json:"snapshot"`
+	State    string `json:"state"`
+	Reason   string `json:"reason"`
+}
+
+// snapshotName is unique per statefulset and target revision, so retries find
+// the snapshot started by a previous call.
+func (h *ESHook) snapshotName() string {
+	return strings.ToLower(fmt.Sprintf("statefulset-pilot-%s-%s", h.sts.GetName(), h.sts.Status.UpdateRevision))
+}
+
+// getSnapshot returns the named snapshot, or nil when it doesn't exist.
+func getSnapshot(n nodes, path string) (*ESSnapshot, error) {
+	resp, e, err := n.do(func(e *endpoint) (*resty.Response, error) {
+		return e.request().
+			Get(e.url(path))
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("%s http status code was %d for %s", path, resp.StatusCode(), e.base)
+	}
+
+	m := ESSnapshots{}
+	if err := json.Unmarshal(resp.Body(), &m); err != nil {
+		return nil, err
+	}
+
+	if len(m.Snapshots) == 0 {
+		return nil, nil
+	}
+
+	return &m.Snapshots[0], nil
+}
+
+// snapshot starts a snapshot of the cluster in the configured repository, and
+// waits for it to succeed. A failed snapshot aborts the rollout.
+func (h *ESHook) snapshot(es nodes) error {
+	repo, name := h.settings.snapshotRepository, h.snapshotName()
+	path := fmt.Sprintf("/_snapshot/%s/%s", url.PathEscape(repo), url.PathEscape(name))
+
+	snap, err := getSnapshot(es, path)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the snapshot status")
+	}
+
+	if snap == nil {
+		if err := send(es, http.MethodPut, path); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to start snapshot %s", name))
+		}
+		return hooks.Wait(WaitingForSnapshotReason,
+			fmt.Errorf("started snapshot %s in repository %s", name, repo))
+	}
+
+	switch snap.State {
+	case "SUCCESS":
+		return nil
+	case "IN_PROGRESS", "STARTED":
+		return hooks.Wait(WaitingForSnapshotReason,
+			fmt.Errorf("snapshot %s in repository %s is in progress", name, repo))
+	}
+
+	reason := ""
+	if snap.Reason != "" {
+		reason = ": " + snap.Reason
+	}
+	return hooks.Abort(fmt.Errorf("snapshot %s in repository %s ended in state %s%s",
+		name, repo, snap.State, reason))
+}
@@ -0,0 +1,143 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	resty "gopkg.in/resty.v1"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// Distributions, as reported by GET / (Elasticsearch doesn't report its distribution).
+// They're also the default container names of the official charts.
+const (
+	DistributionElasticsearch = "elasticsearch"
+	DistributionOpenSearch    = "opensearch"
+)
+
+type ESInfo struct {
+	Version ESVersion `json:"version"`
+}
+
+type ESVersion struct {
+	Number       string `json:"number"`
+	Distribution string `json:"distribution"`
+}
+
+// version is an es version, as reported by GET /.
+type version struct {
+	distribution string
+	number       string
+	major        int
+	minor        int
+}
+
+func parseVersion(number string) (version, error) {
+	v := version{distribution: DistributionElasticsearch, number: number}
+
+	parts := strings.SplitN(number, ".", 3)
+	if len(parts) < 2 {
+		return v, fmt.Errorf("invalid es version %q", number)
+	}
+
+	var err error
+	if v.major, err = strconv.Atoi(parts[0]); err != nil {
+		return v, fmt.Errorf("invalid es version %q", number)
+	}
+	if v.minor, err = strconv.Atoi(parts[1]); err != nil {
+		return v, fmt.Errorf("invalid es version %q", number)
+	}
+
+	return v, nil
+}
+
+func (v version) String() string {
+	if v.distribution == DistributionOpenSearch {
+		return "opensearch " + v.number
+	}
+	return v.number
+}
+
+func (v version) isOpenSearch() bool {
+	return v.distribution == DistributionOpenSearch
+}
+
+// esMajor is the Elasticsearch major version matching v: OpenSearch 1.x was
+// forked from Elasticsearch 7.10, and reads the same indices.
+func (v version) esMajor() int {
+	if v.isOpenSearch() {
+		return v.major + 6
+	}
+	return v.major
+}
+
+// hasSyncedFlush is true for versions still providing synced flush:
+// it was deprecated in 7.6 (where a plain flush does the same), and removed in 8.0.
+// OpenSearch deprecated it from the start, and removed it in 2.0.
+func (v version) hasSyncedFlush() bool {
+	return !v.isOpenSearch() && (v.major < 7 || (v.major == 7 && v.minor < 6))
+}
+
+func getVersion(n nodes) (version, error) {
+	resp, e, err := n.do(func(e *endpoint) (*resty.Response, error) {
+		return e.request().
+			Get(e.url("/"))
+	})
+
+	if err != nil {
+		return version{}, err
+	}
+
+	if resp.StatusCode() != 200 {
+		return version{}, fmt.Errorf("/ http status code was %d for %s",
+			resp.StatusCode(), e.base)
+	}
+
+	m := ESInfo{}
+	if err := json.Unmarshal(resp.Body(), &m); err != nil {
+		return version{}, err
+	}
+
+	v, err := parseVersion(m.Version.Number)
+	if m.Version.Distribution == DistributionOpenSearch {
+		v.distribution = DistributionOpenSearch
+	}
+
+	return v, err
+}
+
+// imageVersion returns the distribution's version the statefulset's template runs,
+// from the es container image tag (ie. "docker.elastic.co/elasticsearch/elasticsearch:8.11.1").
+// The container defaults to the one named after the distribution, or else the first one.
+func imageVersion(sts *appsv1.StatefulSet, distribution, container string) (version, error) {
+	containers := sts.Spec.Template.Spec.Containers
+	if len(containers) == 0 {
+		return version{}, fmt.Errorf("statefulset %s has no container", sts.GetName())
+	}
+
+	image := ""
+	for _, c := range containers {
+		if c.Name == container || (container == "" && c.Name == distribution) {
+			image = c.Image
+		}
+	}
+	if image == "" {
+		if container != "" {
+			return version{}, fmt.Errorf("statefulset %s has no %s container", sts.GetName(), container)
+		}
+		image = containers[0].Image
+	}
+
+	image = strings.SplitN(image, "@", 2)[0]
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return version{}, fmt.Errorf("image %s has no version tag", image)
+	}
+
+	v, err := parseVersion(strings.TrimPrefix(image[i+1:], "v"))
+	v.distribution = distribution
+
+	return v, err
+}
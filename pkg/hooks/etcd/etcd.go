@@ -0,0 +1,309 @@
+package etcd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// PortAnnotation is the members client port (defaults to 2379).
+	PortAnnotation = hooks.AnnotationPrefix + "etcd-port"
+
+	// DiscoveryAnnotation tells how members are reached: on their pod ip (the
+	// default), or on their headless service DNS name.
+	DiscoveryAnnotation = hooks.AnnotationPrefix + "etcd-discovery"
+
+	// TLSSecretAnnotation names a Secret holding the "ca.crt" bundle the members
+	// certificates are verified against, and optionally a "tls.crt" and "tls.key"
+	// client certificate. Members are reached over https when it's set.
+	TLSSecretAnnotation = hooks.AnnotationPrefix + "etcd-tls-secret"
+
+	// CredentialsSecretAnnotation names a Secret holding the "username" and
+	// "password" of an etcd user, when authentication is enabled.
+	CredentialsSecretAnnotation = hooks.AnnotationPrefix + "etcd-credentials-secret"
+
+	// MaxRaftLagAnnotation is the number of raft entries a restarted member can be
+	// behind the leader while being considered caught up (defaults to 100).
+	MaxRaftLagAnnotation = hooks.AnnotationPrefix + "etcd-max-raft-lag"
+
+	// TimeoutAnnotation is the members requests timeout (a duration, defaults to 10s).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "etcd-timeout"
+
+	defaultPort       = 2379
+	defaultMaxRaftLag = uint64(100)
+	defaultTimeout    = 10 * time.Second
+)
+
+const (
+	// LeadershipMovedReason is the retry reason after the leadership was moved
+	// away from the next pod.
+	LeadershipMovedReason = "LeadershipMoved"
+
+	caKey       = "ca.crt"
+	usernameKey = "username"
+	passwordKey = "password"
+)
+
+// Hook restarts etcd members one at a time: a member is only restarted when
+// all the other members are healthy, and when it isn't the leader (leadership
+// is moved to another member first). The next member waits until the restarted
+// one is healthy again, with a raft index caught up with the leader's one.
+// Members are identified by their name, which must be their pod name.
+type Hook struct {
+	client     client.Client
+	sts        *appsv1.StatefulSet
+	port       int
+	discovery  string
+	tls        *tls.Config
+	username   string
+	password   string
+	maxRaftLag uint64
+	timeout    time.Duration
+
+	// addr returns the host:port reaching a pod's member
+	addr func(pod *v1.Pod) (string, error)
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		client:     c,
+		sts:        sts,
+		port:       defaultPort,
+		discovery:  hooks.DiscoveryIP,
+		maxRaftLag: defaultMaxRaftLag,
+		timeout:    defaultTimeout,
+	}
+
+	if val, ok := annotations[PortAnnotation]; ok {
+		port, err := strconv.Atoi(val)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", PortAnnotation, val)
+		}
+		h.port = port
+	}
+
+	if val, ok := annotations[DiscoveryAnnotation]; ok {
+		if val != hooks.DiscoveryIP && val != hooks.DiscoveryDNS {
+			return nil, fmt.Errorf("invalid %s annotation: %q", DiscoveryAnnotation, val)
+		}
+		h.discovery = val
+	}
+
+	if val, ok := annotations[MaxRaftLagAnnotation]; ok {
+		lag, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %q", MaxRaftLagAnnotation, val)
+		}
+		h.maxRaftLag = lag
+	}
+
+	if val, ok := annotations[TimeoutAnnotation]; ok {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", TimeoutAnnotation, val)
+		}
+		h.timeout = timeout
+	}
+
+	if name, ok := annotations[CredentialsSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		h.username, h.password = string(secret.Data[usernameKey]), string(secret.Data[passwordKey])
+		if h.username == "" {
+			return nil, fmt.Errorf("secret %s has no %s key", name, usernameKey)
+		}
+	}
+
+	if name, ok := annotations[TLSSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		h.tls = &tls.Config{RootCAs: x509.NewCertPool()}
+		if !h.tls.RootCAs.AppendCertsFromPEM(secret.Data[caKey]) {
+			return nil, fmt.Errorf("secret %s has no valid %s certificate", name, caKey)
+		}
+
+		if _, ok := secret.Data[v1.TLSCertKey]; ok {
+			cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+			if err != nil {
+				return nil, fmt.Errorf("secret %s has no valid client certificate: %v", name, err)
+			}
+			h.tls.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	h.addr = func(pod *v1.Pod) (string, error) {
+		return hooks.PodAddr(h.sts, pod, h.discovery, h.port)
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "etcd"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil {
+		if err := h.afterUpdate(prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil {
+		if err := h.beforeUpdate(next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+func (h *Hook) beforeUpdate(next *v1.Pod) error {
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return err
+	}
+
+	statuses := make(map[string]memberStatus)
+	var endpoints []string
+	for i := range pods {
+		s := h.status(&pods[i])
+		statuses[pods[i].GetName()] = s
+		if s.err == nil {
+			endpoints = append(endpoints, s.endpoint)
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no healthy member")
+	}
+
+	cli, err := h.dial(endpoints...)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	members, err := h.members(cli)
+	if err != nil {
+		return err
+	}
+
+	target, ok := members.byName(next.GetName())
+	if !ok {
+		return fmt.Errorf("no %s member in the cluster", next.GetName())
+	}
+
+	if err := h.noAlarms(cli, members); err != nil {
+		return err
+	}
+
+	// All the other members must be healthy, and keep the quorum
+	var unhealthy []string
+	healthy := 0
+	for _, m := range members {
+		if m.ID == target.ID {
+			continue
+		}
+		s, ok := statuses[m.Name]
+		switch {
+		case !ok:
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (not in statefulset %s)", m.Name, h.sts.GetName()))
+		case s.err != nil:
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (%v)", m.Name, s.err))
+		default:
+			healthy++
+		}
+	}
+
+	if len(unhealthy) > 0 && healthy <= len(members)/2 {
+		return fmt.Errorf("the cluster would lose quorum without %s: %d of %d members would remain healthy, unhealthy: %s",
+			next.GetName(), healthy, len(members), hooks.List(unhealthy, ", "))
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("%d members aren't healthy: %s", len(unhealthy), hooks.List(unhealthy, ", "))
+	}
+
+	// The status of any healthy member tells who's the leader
+	leader := uint64(0)
+	for _, s := range statuses {
+		if s.err == nil && s.leader != 0 {
+			leader = s.leader
+			break
+		}
+	}
+
+	if leader == target.ID {
+		return h.moveLeader(statuses[next.GetName()], statuses, members)
+	}
+
+	return nil
+}
+
+func (h *Hook) afterUpdate(prev *v1.Pod) error {
+	s := h.status(prev)
+	if s.err != nil {
+		return errors.Wrap(s.err, "member isn't healthy yet")
+	}
+
+	cli, err := h.dial(s.endpoint)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	members, err := h.members(cli)
+	if err != nil {
+		return err
+	}
+
+	m, ok := members.byName(prev.GetName())
+	if !ok {
+		return fmt.Errorf("no %s member in the cluster", prev.GetName())
+	}
+	if m.ID != s.id {
+		return fmt.Errorf("member %s id is %x, but its pod answers as member %x", m.Name, m.ID, s.id)
+	}
+
+	switch s.leader {
+	case 0:
+		return fmt.Errorf("member has no leader yet")
+	case s.id:
+		return nil
+	}
+
+	leader, ok := members.byID(s.leader)
+	if !ok {
+		return fmt.Errorf("leader %x isn't a cluster member", s.leader)
+	}
+
+	index, err := h.raftIndex(cli, leader)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to get the leader %s status", leader.Name))
+	}
+
+	if index > s.raftIndex && index-s.raftIndex > h.maxRaftLag {
+		return fmt.Errorf("raft index %d is %d entries behind the leader %s raft index %d",
+			s.raftIndex, index-s.raftIndex, leader.Name, index)
+	}
+
+	return nil
+}
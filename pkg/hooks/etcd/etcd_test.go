@@ -0,0 +1,204 @@
+package etcd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	"github.com/coreos/etcd/embed"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var etcdStatefulSet = hookstest.StatefulSet("etcd", nil)
+
+// testCluster is an embedded etcd cluster, whose members are named like the
+// etcd-0 to etcd-n-1 pods, and listen on 127.0.0.1.
+type testCluster struct {
+	dir     string
+	addrs   hookstest.Addrs
+	members []*embed.Etcd
+	pods    []runtime.Object
+}
+
+func startCluster(t *testing.T, n int) *testCluster {
+	dir, err := ioutil.TempDir("", "etcd-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &testCluster{dir: dir, addrs: hookstest.Addrs{}}
+	peers := hookstest.Addrs{}
+
+	var initial []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("etcd-%d", i)
+		tc.addrs.Reserve(t, name)
+		initial = append(initial, fmt.Sprintf("%s=http://%s", name, peers.Reserve(t, name)))
+	}
+
+	for i := 0; i < n; i++ {
+		cfg := embed.NewConfig()
+		cfg.Name = fmt.Sprintf("etcd-%d", i)
+		cfg.Dir = fmt.Sprintf("%s/%s", dir, cfg.Name)
+		clientURL := url.URL{Scheme: "http", Host: tc.addrs[cfg.Name]}
+		peerURL := url.URL{Scheme: "http", Host: peers[cfg.Name]}
+		cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+		cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+		cfg.InitialCluster = strings.Join(initial, ",")
+		cfg.InitialClusterToken = "statefulset-pilot"
+
+		e, err := embed.StartEtcd(cfg)
+		if err != nil {
+			tc.stop()
+			t.Fatal(err)
+		}
+		tc.members = append(tc.members, e)
+		tc.pods = append(tc.pods, pod(i))
+	}
+
+	for _, e := range tc.members {
+		select {
+		case <-e.Server.ReadyNotify():
+		case <-time.After(30 * time.Second):
+			tc.stop()
+			t.Fatal("etcd cluster didn't start")
+		}
+	}
+
+	return tc
+}
+
+func (tc *testCluster) stop() {
+	for _, e := range tc.members {
+		e.Close()
+	}
+	os.RemoveAll(tc.dir)
+}
+
+// leader returns the ordinal of the current leader.
+func (tc *testCluster) leader(t *testing.T) int {
+	for i, e := range tc.members {
+		if e.Server.Leader() == e.Server.ID() {
+			return i
+		}
+	}
+	t.Fatal("no leader")
+	return -1
+}
+
+func (tc *testCluster) hook(t *testing.T) *Hook {
+	sts := hookstest.StatefulSet("etcd", map[string]string{TimeoutAnnotation: "2s"})
+	h, err := New(hookstest.NewFakeClient(tc.pods...), sts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.(*Hook).addr = tc.addrs.Addr
+
+	return h.(*Hook)
+}
+
+func pod(ordinal int) *v1.Pod {
+	return hookstest.Pod(etcdStatefulSet, ordinal, fmt.Sprintf("10.0.0.%d", ordinal+1))
+}
+
+func TestRollout(t *testing.T) {
+	tc := startCluster(t, 3)
+	defer tc.stop()
+	h := tc.hook(t)
+
+	leader := tc.leader(t)
+	follower := (leader + 1) % 3
+
+	// Followers are restarted right away
+	if err := h.PodUpdateTransition(nil, pod(follower)); err != nil {
+		t.Errorf("unexpected error before restarting a follower: %v", err)
+	}
+
+	// The leader is restarted once it's not the leader anymore
+	err := h.PodUpdateTransition(pod(follower), pod(leader))
+	if hooks.WaitReason(err) != LeadershipMovedReason {
+		t.Fatalf("expected the leadership to move, got: %v", err)
+	}
+	if tc.leader(t) == leader {
+		t.Errorf("etcd-%d is still the leader", leader)
+	}
+	if err := h.PodUpdateTransition(pod(follower), pod(leader)); err != nil {
+		t.Errorf("unexpected error once the leadership moved: %v", err)
+	}
+
+	if err := h.PodUpdateTransition(pod(leader), nil); err != nil {
+		t.Errorf("unexpected error after restarting a member: %v", err)
+	}
+}
+
+func TestUnhealthyMember(t *testing.T) {
+	tc := startCluster(t, 3)
+	defer tc.stop()
+	h := tc.hook(t)
+
+	// Stop a follower, so the cluster keeps its leader
+	leader := tc.leader(t)
+	stopped, next := (leader+1)%3, (leader+2)%3
+	tc.members[stopped].Close()
+
+	// Only the leader would remain
+	err := h.PodUpdateTransition(nil, pod(next))
+	want := fmt.Sprintf("the cluster would lose quorum without etcd-%d: 1 of 3 members would remain healthy, unhealthy: etcd-%d",
+		next, stopped)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected a quorum loss error, got: %v", err)
+	}
+
+	err = h.PodUpdateTransition(pod(stopped), nil)
+	if err == nil || !strings.Contains(err.Error(), "member isn't healthy yet") {
+		t.Errorf("expected the stopped member to be unhealthy, got: %v", err)
+	}
+
+	// The stopped member can be restarted: the other members are healthy
+	if err := h.PodUpdateTransition(nil, pod(stopped)); err != nil {
+		t.Errorf("unexpected error before restarting the unhealthy member: %v", err)
+	}
+}
+
+func TestUnknownMember(t *testing.T) {
+	tc := startCluster(t, 1)
+	defer tc.stop()
+	h := tc.hook(t)
+
+	unknown := pod(0)
+	unknown.Name = "etcd-7"
+	err := h.PodUpdateTransition(nil, unknown)
+	if err == nil || !strings.Contains(err.Error(), "no etcd-7 member in the cluster") {
+		t.Errorf("expected an unknown member error, got: %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{DiscoveryAnnotation: hooks.DiscoveryDNS, MaxRaftLagAnnotation: "1000"}, false},
+		{map[string]string{DiscoveryAnnotation: "srv"}, true},
+		{map[string]string{PortAnnotation: "http"}, true},
+		{map[string]string{MaxRaftLagAnnotation: "-1"}, true},
+		{map[string]string{TimeoutAnnotation: "10"}, true},
+		{map[string]string{TimeoutAnnotation: "0s"}, true},
+		{map[string]string{TimeoutAnnotation: "-5s"}, true},
+		{map[string]string{TLSSecretAnnotation: "missing"}, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(hookstest.NewFakeClient(), hookstest.StatefulSet("etcd", tt.annotations)); (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error: %v, got: %v", tt.annotations, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+)
+
+// memberStatus is a pod's member status, or the error we got checking it.
+type memberStatus struct {
+	pod       *v1.Pod
+	endpoint  string
+	id        uint64
+	leader    uint64
+	raftIndex uint64
+	err       error
+}
+
+// member is a cluster member, as listed by the cluster.
+type member struct {
+	ID         uint64
+	Name       string
+	ClientURLs []string
+}
+
+type members []member
+
+func (ms members) byName(name string) (member, bool) {
+	for _, m := range ms {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return member{}, false
+}
+
+func (ms members) byID(id uint64) (member, bool) {
+	for _, m := range ms {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return member{}, false
+}
+
+func (h *Hook) endpoint(pod *v1.Pod) (string, error) {
+	addr, err := h.addr(pod)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := "http"
+	if h.tls != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, addr), nil
+}
+
+// dial returns a client for the given endpoints. It fails when none is reachable.
+func (h *Hook) dial(endpoints ...string) (*clientv3.Client, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: h.timeout,
+		TLS:         h.tls,
+		Username:    h.username,
+		Password:    h.password,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to connect to %s", strings.Join(endpoints, ", ")))
+	}
+
+	return cli, nil
+}
+
+// status checks the pod's member health, the way etcdctl endpoint health does.
+func (h *Hook) status(pod *v1.Pod) memberStatus {
+	s := memberStatus{pod: pod}
+
+	if s.endpoint, s.err = h.endpoint(pod); s.err != nil {
+		return s
+	}
+
+	cli, err := h.dial(s.endpoint)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	resp, err := cli.Status(ctx, s.endpoint)
+	if err != nil {
+		s.err = errors.Wrap(err, "failed to get status")
+		return s
+	}
+	s.id, s.leader, s.raftIndex = resp.Header.MemberId, resp.Leader, resp.RaftIndex
+
+	// A linearizable read needs a working raft quorum. When authentication is
+	// enabled, a permission denied still tells the member served the request.
+	if _, err := cli.Get(ctx, "health"); err != nil && err != rpctypes.ErrPermissionDenied {
+		s.err = errors.Wrap(err, "health check failed")
+	}
+
+	return s
+}
+
+func (h *Hook) members(cli *clientv3.Client) (members, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	resp, err := cli.MemberList(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list members")
+	}
+
+	var res members
+	for _, m := range resp.Members {
+		res = append(res, member{ID: m.ID, Name: m.Name, ClientURLs: m.ClientURLs})
+	}
+
+	return res, nil
+}
+
+// noAlarms checks no member raised an alarm (eg. NOSPACE, when its db reached its quota).
+func (h *Hook) noAlarms(cli *clientv3.Client, ms members) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	resp, err := cli.AlarmList(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list alarms")
+	}
+
+	var alarms []string
+	for _, a := range resp.Alarms {
+		name := fmt.Sprintf("%x", a.MemberID)
+		if m, ok := ms.byID(a.MemberID); ok {
+			name = m.Name
+		}
+		alarms = append(alarms, fmt.Sprintf("%s on %s", a.Alarm, name))
+	}
+
+	if len(alarms) > 0 {
+		return fmt.Errorf("%d active alarms: %s", len(alarms), hooks.List(alarms, ", "))
+	}
+
+	return nil
+}
+
+// raftIndex returns a member's raft index, asked on its pod when it's part of
+// the statefulset, or else on its advertised client urls.
+func (h *Hook) raftIndex(cli *clientv3.Client, m member) (uint64, error) {
+	endpoints := m.ClientURLs
+
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return 0, err
+	}
+	for i := range pods {
+		if pods[i].GetName() == m.Name {
+			ep, err := h.endpoint(&pods[i])
+			if err != nil {
+				return 0, err
+			}
+			endpoints = []string{ep}
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return 0, fmt.Errorf("member %s has no client url", m.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	resp, err := cli.Status(ctx, endpoints[0])
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.RaftIndex, nil
+}
+
+// moveLeader moves the leadership from the next pod's member to the healthy
+// member having the most recent raft index. The request must be sent to the leader.
+func (h *Hook) moveLeader(leader memberStatus, statuses map[string]memberStatus, ms members) error {
+	var transferee *memberStatus
+	for name := range statuses {
+		s := statuses[name]
+		if s.err != nil || s.id == leader.id {
+			continue
+		}
+		if _, ok := ms.byID(s.id); !ok {
+			continue
+		}
+		if transferee == nil || s.raftIndex > transferee.raftIndex {
+			transferee = &s
+		}
+	}
+
+	if transferee == nil {
+		return fmt.Errorf("no healthy member to move the leadership to")
+	}
+
+	cli, err := h.dial(leader.endpoint)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	if _, err := cli.MoveLeader(ctx, transferee.id); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to move the leadership to %s", transferee.pod.GetName()))
+	}
+
+	return hooks.Wait(LeadershipMovedReason, fmt.Errorf("moved the leadership from %s to %s before restarting it",
+		leader.pod.GetName(), transferee.pod.GetName()))
+}
@@ -0,0 +1,138 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// BeforeAnnotation is the shell command run in a pod before it's updated.
+	BeforeAnnotation = hooks.AnnotationPrefix + "exec-before"
+
+	// AfterAnnotation is the shell command run in a pod once it was updated.
+	AfterAnnotation = hooks.AnnotationPrefix + "exec-after"
+
+	// ContainerAnnotation is the container running the commands (defaults to the first one).
+	ContainerAnnotation = hooks.AnnotationPrefix + "exec-container"
+
+	// newExecutor opens the exec subresource's streams (a variable, so tests can fake it)
+	newExecutor = remotecommand.NewSPDYExecutor
+)
+
+// Hook runs shell commands in the pods, through the exec subresource. A command
+// exiting with a non-zero status postpones the update. Commands are templates
+// receiving the hooks.TemplateVars.
+type Hook struct {
+	config    *rest.Config
+	container string
+	before    *template.Template
+	after     *template.Template
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	cfg, err := hooks.RestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Hook{
+		config:    cfg,
+		container: annotations[ContainerAnnotation],
+	}
+
+	if h.before, err = hooks.ParseTemplate(annotations, BeforeAnnotation); err != nil {
+		return nil, err
+	}
+	if h.after, err = hooks.ParseTemplate(annotations, AfterAnnotation); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "exec"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil && h.after != nil {
+		if err := h.run(h.after, prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil && h.before != nil {
+		if err := h.run(h.before, next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+func (h *Hook) run(tmpl *template.Template, pod *v1.Pod) error {
+	cmd, err := hooks.Render(tmpl, pod)
+	if err != nil {
+		return err
+	}
+
+	_, err = Run(h.config, pod, h.container, []string{"/bin/sh", "-c", cmd})
+	return err
+}
+
+// Run runs command in a pod's container (or its first container when empty)
+// through the exec subresource, and returns the command's stdout.
+func Run(cfg *rest.Config, pod *v1.Pod, container string, command []string) (string, error) {
+	if container == "" && len(pod.Spec.Containers) > 0 {
+		container = pod.Spec.Containers[0].Name
+	}
+
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.GetNamespace()).
+		Name(pod.GetName()).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := newExecutor(cfg, "POST", req.URL())
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return stdout.String(), fmt.Errorf("%s failed: %v: %s", strings.Join(command, " "),
+			err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
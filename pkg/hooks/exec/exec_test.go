@@ -0,0 +1,140 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// fakeExecutor plays the API server's side of the exec subresource, recording
+// the commands it's asked to run.
+type fakeExecutor struct {
+	runs []string
+
+	// fail makes the commands containing this string exit with an error
+	fail string
+}
+
+func newFakeExecutor() (*fakeExecutor, func()) {
+	f := &fakeExecutor{}
+	orig := newExecutor
+	newExecutor = func(cfg *rest.Config, method string, u *url.URL) (remotecommand.Executor, error) {
+		return &fakeStream{f: f, url: u}, nil
+	}
+	return f, func() { newExecutor = orig }
+}
+
+type fakeStream struct {
+	f   *fakeExecutor
+	url *url.URL
+}
+
+func (s *fakeStream) Stream(opts remotecommand.StreamOptions) error {
+	query := s.url.Query()
+	pod := path.Base(path.Dir(s.url.Path))
+	command := strings.Join(query["command"], " ")
+	s.f.runs = append(s.f.runs, fmt.Sprintf("%s/%s: %s", pod, query.Get("container"), command))
+
+	if s.f.fail != "" && strings.Contains(command, s.f.fail) {
+		io.WriteString(opts.Stderr, "command failed\n")
+		return errors.New("command terminated with exit code 1")
+	}
+
+	_, err := io.WriteString(opts.Stdout, "ok")
+	return err
+}
+
+var config = &rest.Config{Host: "http://127.0.0.1:1"}
+
+func pod(ordinal int) *v1.Pod {
+	p := hookstest.Pod(hookstest.StatefulSet("db", nil), ordinal, "")
+	p.Spec.Containers = []v1.Container{{Name: "db"}, {Name: "sidecar"}}
+	return p
+}
+
+func TestRun(t *testing.T) {
+	f, restore := newFakeExecutor()
+	defer restore()
+
+	// The first container is used by default
+	out, err := Run(config, pod(0), "", []string{"/bin/true"})
+	if err != nil || out != "ok" {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+
+	if _, err := Run(config, pod(1), "sidecar", []string{"/bin/true"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := []string{"db-0/db: /bin/true", "db-1/sidecar: /bin/true"}
+	if strings.Join(f.runs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected runs %v, got %v", expected, f.runs)
+	}
+
+	f.fail = "false"
+	_, err = Run(config, pod(0), "", []string{"/bin/false"})
+	if err == nil || err.Error() != "/bin/false failed: command terminated with exit code 1: command failed" {
+		t.Errorf("expected a command failure, got: %v", err)
+	}
+}
+
+func TestHook(t *testing.T) {
+	f, restore := newFakeExecutor()
+	defer restore()
+
+	sts := hookstest.StatefulSet("db", map[string]string{
+		BeforeAnnotation:    "drain {{ .Pod }}",
+		AfterAnnotation:     "undrain {{ .Ordinal }}",
+		ContainerAnnotation: "sidecar",
+	})
+
+	hooks.SetRestConfig(nil)
+	if _, err := New(nil, sts); err == nil {
+		t.Error("expected an error without api server config")
+	}
+
+	hooks.SetRestConfig(config)
+	defer hooks.SetRestConfig(nil)
+
+	h, err := New(nil, sts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.PodUpdateTransition(pod(2), pod(1)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := []string{
+		"db-2/sidecar: /bin/sh -c undrain 2",
+		"db-1/sidecar: /bin/sh -c drain db-1",
+	}
+	if strings.Join(f.runs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected runs %v, got %v", expected, f.runs)
+	}
+
+	// A failing command postpones the update
+	f.fail = "drain db-0"
+	err = h.PodUpdateTransition(pod(1), pod(0))
+	if err == nil || !strings.HasPrefix(err.Error(), "before update, pod: db-0: ") {
+		t.Errorf("expected a before update error, got: %v", err)
+	}
+
+	// Nothing to run after the last pod update when there's no after command
+	f.runs = nil
+	delete(sts.Annotations, AfterAnnotation)
+	if h, err = New(nil, sts); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.PodUpdateTransition(pod(0), nil); err != nil || len(f.runs) != 0 {
+		t.Errorf("unexpected runs %v, error: %v", f.runs, err)
+	}
+}
@@ -1,38 +1,185 @@
 package factory
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	pilotv1beta1 "github.com/bpineau/statefulset-pilot/pkg/apis/pilot/v1beta1"
 	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/approval"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/canary"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/cassandra"
 	"github.com/bpineau/statefulset-pilot/pkg/hooks/elasticsearch"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/etcd"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/exec"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/job"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/kafka"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/mongodb"
 	"github.com/bpineau/statefulset-pilot/pkg/hooks/noop"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/patroni"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/probe"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/prometheus"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/rabbitmq"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/redis"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/remote"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/script"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/sql"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/zookeeper"
 )
 
-type HookFactory func() (hooks.STSRolloutHooks, error)
+// HookFactory builds a hook for the given statefulset. Hooks can read
+// their settings from the statefulset's annotations, and use the client
+// to look at the statefulset's pods.
+type HookFactory func(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error)
 
-var registry = make(map[string]HookFactory)
+var (
+	registry = make(map[string]HookFactory)
+
+	// pilotHookTypes back the PilotHooks running their own commands and requests. They're
+	// only available through PilotHooks, so statefulsets can't have the pilot run
+	// arbitrary commands with its own permissions.
+	pilotHookTypes = make(map[string]HookFactory)
+
+	// releasers free what the hooks keep for a statefulset between reconciliations
+	releasers []func(namespace, name string)
+)
 
 func Register(name string, factory HookFactory) {
 	registry[name] = factory
 }
 
-func Get(sts *appsv1.StatefulSet, key string) (hooks.STSRolloutHooks, error) {
+func registerType(name string, factory HookFactory) {
+	pilotHookTypes[name] = factory
+}
+
+func registerReleaser(release func(namespace, name string)) {
+	releasers = append(releasers, release)
+}
+
+// Release frees what the hooks keep for a statefulset between reconciliations,
+// once the statefulset was deleted or unsubscribed from the pilot.
+func Release(namespace, name string) {
+	for _, release := range releasers {
+		release(namespace, name)
+	}
+}
+
+// Get returns the hook named by the statefulset's key label. The name is
+// resolved through the PilotHook objects first, then through the builtin hooks.
+func Get(c client.Client, sts *appsv1.StatefulSet, key string) (hooks.STSRolloutHooks, error) {
 	label, ok := sts.GetLabels()[key]
 	if !ok {
 		return nil, fmt.Errorf("missing %s label", key)
 	}
 
+	return GetByName(c, sts, label)
+}
+
+// GetByName returns the hook named label for the statefulset, resolved like Get does.
+func GetByName(c client.Client, sts *appsv1.StatefulSet, label string) (hooks.STSRolloutHooks, error) {
+	ph := &pilotv1beta1.PilotHook{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: label}, ph)
+	if err == nil {
+		return fromPilotHook(c, sts, ph)
+	}
+
+	// Fall back to builtins when there's no such PilotHook
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get %s pilothook: %v", label, err)
+	}
+
 	h, ok := registry[label]
 	if !ok {
 		return nil, fmt.Errorf("unsupported hook manager: %s", label)
 	}
 
-	return h()
+	return h(c, sts)
+}
+
+// Resolve returns the factory backing a PilotHook.
+func Resolve(ph *pilotv1beta1.PilotHook) (HookFactory, error) {
+	if ph.Spec.Type != pilotv1beta1.TypeBuiltin {
+		h, ok := pilotHookTypes[ph.Spec.Type]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hook type: %s", ph.Spec.Type)
+		}
+		return h, nil
+	}
+
+	if ph.Spec.Builtin == "" {
+		return nil, fmt.Errorf("missing builtin hook name")
+	}
+
+	h, ok := registry[ph.Spec.Builtin]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hook manager: %s", ph.Spec.Builtin)
+	}
+
+	return h, nil
+}
+
+// fromPilotHook builds a PilotHook's hook, with the PilotHook config as
+// default values for the statefulset's annotations. The hooks of the other
+// types than builtin only get the PilotHook config.
+func fromPilotHook(c client.Client, sts *appsv1.StatefulSet, ph *pilotv1beta1.PilotHook) (hooks.STSRolloutHooks, error) {
+	if !ph.AllowsNamespace(sts.GetNamespace()) {
+		return nil, fmt.Errorf("pilothook %s isn't allowed in namespace %s", ph.GetName(), sts.GetNamespace())
+	}
+
+	h, err := Resolve(ph)
+	if err != nil {
+		return nil, fmt.Errorf("pilothook %s: %v", ph.GetName(), err)
+	}
+
+	sts = sts.DeepCopy()
+	if sts.Annotations == nil {
+		sts.Annotations = make(map[string]string)
+	}
+	if ph.Spec.Type != pilotv1beta1.TypeBuiltin {
+		for key := range sts.Annotations {
+			if strings.HasPrefix(key, hooks.AnnotationPrefix) {
+				delete(sts.Annotations, key)
+			}
+		}
+	}
+	for key, val := range ph.Spec.Config {
+		if _, ok := sts.Annotations[hooks.AnnotationPrefix+key]; !ok {
+			sts.Annotations[hooks.AnnotationPrefix+key] = val
+		}
+	}
+
+	return h(c, sts)
 }
 
 func init() {
+	Register("approval", approval.New)
+	Register("canary", canary.New)
+	Register("cassandra", cassandra.New)
 	Register("elasticsearch", elasticsearch.New)
+	Register("etcd", etcd.New)
+	Register("kafka", kafka.New)
+	Register("mongodb", mongodb.New)
 	Register("noop", noop.New)
+	Register("opensearch", elasticsearch.NewOpenSearch)
+	Register("patroni", patroni.New)
+	Register("probe", probe.New)
+	Register("prometheus", prometheus.New)
+	Register("rabbitmq", rabbitmq.New)
+	Register("redis", redis.New)
+	Register("sql", sql.New)
+	Register("zookeeper", zookeeper.New)
+
+	registerType(pilotv1beta1.TypeHTTP, remote.NewHTTP)
+	registerType(pilotv1beta1.TypeGRPC, remote.NewGRPC)
+	registerType(pilotv1beta1.TypeExec, exec.New)
+	registerType(pilotv1beta1.TypeJob, job.New)
+	registerType(pilotv1beta1.TypeScript, script.New)
+
+	registerReleaser(elasticsearch.ReleaseClients)
 }
@@ -0,0 +1,147 @@
+package factory
+
+import (
+	"testing"
+
+	pilotv1beta1 "github.com/bpineau/statefulset-pilot/pkg/apis/pilot/v1beta1"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/prometheus"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/script"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const labelKey = "dd-statefulset-pilot"
+
+func init() {
+	pilotv1beta1.SchemeBuilder.AddToScheme(scheme.Scheme)
+}
+
+func statefulset(namespace, hook string, annotations map[string]string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   namespace,
+			Labels:      map[string]string{labelKey: hook},
+			Annotations: annotations,
+		},
+	}
+}
+
+func pilotHook(name string, spec pilotv1beta1.PilotHookSpec) *pilotv1beta1.PilotHook {
+	return &pilotv1beta1.PilotHook{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       spec,
+	}
+}
+
+func TestGet(t *testing.T) {
+	c := fake.NewFakeClient(
+		pilotHook("kafka-lag", pilotv1beta1.PilotHookSpec{
+			Type:       pilotv1beta1.TypeBuiltin,
+			Builtin:    "prometheus",
+			Namespaces: []string{"kafka"},
+			Config: map[string]string{
+				"prometheus-url":    "http://prometheus:9090",
+				"prometheus-before": "default",
+			},
+		}),
+		pilotHook("noop", pilotv1beta1.PilotHookSpec{Type: pilotv1beta1.TypeScript}),
+		pilotHook("broken", pilotv1beta1.PilotHookSpec{Type: pilotv1beta1.TypeBuiltin, Builtin: "nope"}),
+	)
+
+	tests := []struct {
+		name     string
+		sts      *appsv1.StatefulSet
+		wantHook string
+		wantErr  bool
+	}{
+		{"builtin", statefulset("default", "elasticsearch", nil), "elasticsearch", false},
+		{"builtin variant", statefulset("default", "opensearch", nil), "opensearch", false},
+		{"unknown", statefulset("default", "unknown", nil), "", true},
+		{"pilothook", statefulset("kafka", "kafka-lag", nil), "prometheus", false},
+		{"pilothook in forbidden namespace", statefulset("default", "kafka-lag", nil), "", true},
+		{"pilothook shadowing a builtin", statefulset("default", "noop", nil), "script", false},
+		{"unresolvable pilothook", statefulset("default", "broken", nil), "", true},
+		{"missing label", &appsv1.StatefulSet{}, "", true},
+	}
+
+	for _, tt := range tests {
+		h, err := Get(c, tt.sts, labelKey)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Get() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && h.Name() != tt.wantHook {
+			t.Errorf("%s: Get() = %s, want %s", tt.name, h.Name(), tt.wantHook)
+		}
+	}
+}
+
+func TestPilotHookConfig(t *testing.T) {
+	c := fake.NewFakeClient(pilotHook("kafka-lag", pilotv1beta1.PilotHookSpec{
+		Type:    pilotv1beta1.TypeBuiltin,
+		Builtin: "prometheus",
+		Config: map[string]string{
+			"prometheus-url":    "http://prometheus:9090",
+			"prometheus-before": "{{.Invalid",
+		},
+	}))
+
+	// The statefulset annotations take precedence over the PilotHook config
+	sts := statefulset("kafka", "kafka-lag", map[string]string{
+		prometheus.BeforeAnnotation: "up",
+	})
+	if _, err := Get(c, sts, labelKey); err != nil {
+		t.Errorf("Get() failed: %v", err)
+	}
+
+	if _, ok := sts.GetAnnotations()[prometheus.URLAnnotation]; ok {
+		t.Error("Get() shouldn't modify the statefulset")
+	}
+
+	if _, err := Get(c, statefulset("kafka", "kafka-lag", nil), labelKey); err == nil {
+		t.Error("Get() should use the PilotHook config by default")
+	}
+}
+
+func TestTypesNeedPilotHook(t *testing.T) {
+	c := fake.NewFakeClient()
+
+	for _, typ := range []string{pilotv1beta1.TypeHTTP, pilotv1beta1.TypeGRPC, pilotv1beta1.TypeExec,
+		pilotv1beta1.TypeJob, pilotv1beta1.TypeScript} {
+		if h, err := Get(c, statefulset("default", typ, nil), labelKey); err == nil {
+			t.Errorf("Get() should reject the %s label without a PilotHook, got a %s hook", typ, h.Name())
+		}
+	}
+
+	// Those hooks only get the PilotHook config
+	c = fake.NewFakeClient(pilotHook("gate", pilotv1beta1.PilotHookSpec{
+		Type:   pilotv1beta1.TypeScript,
+		Config: map[string]string{"script-before": "true"},
+	}))
+	sts := statefulset("default", "gate", map[string]string{script.TimeoutAnnotation: "never"})
+	if _, err := Get(c, sts, labelKey); err != nil {
+		t.Errorf("Get() should ignore the statefulset annotations, got: %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	for _, spec := range []pilotv1beta1.PilotHookSpec{
+		{Type: pilotv1beta1.TypeBuiltin},
+		{Type: pilotv1beta1.TypeBuiltin, Builtin: "nope"},
+		{Type: "lambda"},
+	} {
+		if _, err := Resolve(pilotHook("test", spec)); err == nil {
+			t.Errorf("Resolve() should fail for %v", spec)
+		}
+	}
+
+	for _, typ := range []string{pilotv1beta1.TypeHTTP, pilotv1beta1.TypeGRPC, pilotv1beta1.TypeExec,
+		pilotv1beta1.TypeJob, pilotv1beta1.TypeScript} {
+		if _, err := Resolve(pilotHook("test", pilotv1beta1.PilotHookSpec{Type: typ})); err != nil {
+			t.Errorf("Resolve() failed for type %s: %v", typ, err)
+		}
+	}
+}
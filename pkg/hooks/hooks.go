@@ -1,9 +1,33 @@
 package hooks
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// AnnotationPrefix prefixes the statefulset annotations hooks read their settings from.
+const AnnotationPrefix = "statefulset-pilot/"
+
+// Discovery modes, telling how hooks reach the pods: on their ip, or on their
+// headless service DNS name.
+const (
+	DiscoveryIP  = "ip"
+	DiscoveryDNS = "dns"
+)
+
+// maxListed caps the number of items listed in errors messages
+const maxListed = 5
+
 // STSRolloutHooks is called between statefulset pods updates.
 // If the hook returns an error, it will be called again later
 // until it returns nil; then the next pod is updated.
@@ -16,6 +40,243 @@ type STSRolloutHooks interface {
 	// next is the pod we're about to update (or nil after we updated the last pod).
 	// If PodUpdateTransition returns an error, the controller will postpone the update,
 	// and will call PodUpdateTransition again later, until it succeed.
+	// If PodUpdateTransition returns an error built with Abort, the controller will
+	// stop the rollout until the statefulset is updated to a new revision.
+	// If PodUpdateTransition returns an error built with Wait, the controller will
+	// also emit an event with the given reason (a Warning event when built with Warn).
 	// If PodUpdateTransition returns nil, the controller will proceed updating the next pod.
 	PodUpdateTransition(prev, next *v1.Pod) error
 }
+
+// RolloutCanceler is implemented by hooks that must undo their changes when the
+// controller stops piloting a rollout midway: when a hook aborted the rollout, or
+// when the statefulset was unsubscribed from the pilot before the rollout ended.
+type RolloutCanceler interface {
+	RolloutCanceled() error
+}
+
+type abortError struct {
+	error
+}
+
+// Abort wraps err to tell the controller it should abort the rollout, rather than retry.
+func Abort(err error) error {
+	return &abortError{err}
+}
+
+// IsAbort returns true if err, or any error it wraps, was built with Abort.
+func IsAbort(err error) bool {
+	return find(err, func(e error) bool {
+		_, ok := e.(*abortError)
+		return ok
+	}) != nil
+}
+
+type waitError struct {
+	error
+	reason  string
+	warning bool
+}
+
+// Wait wraps err to tell the controller it should retry later, and to report
+// the wait with an event having the given reason (eg. "WaitingForApproval").
+func Wait(reason string, err error) error {
+	return &waitError{err, reason, false}
+}
+
+// Warn is like Wait, but the wait is reported with a Warning event, for
+// issues needing the operator's attention.
+func Warn(reason string, err error) error {
+	return &waitError{err, reason, true}
+}
+
+// WaitReason returns the reason given to Wait, if err or any error it wraps
+// was built with Wait. It returns an empty string otherwise.
+func WaitReason(err error) string {
+	w, ok := find(err, func(e error) bool {
+		_, ok := e.(*waitError)
+		return ok
+	}).(*waitError)
+	if !ok {
+		return ""
+	}
+	return w.reason
+}
+
+// IsWarning returns true if err, or any error it wraps, was built with Warn.
+func IsWarning(err error) bool {
+	w, ok := find(err, func(e error) bool {
+		_, ok := e.(*waitError)
+		return ok
+	}).(*waitError)
+	return ok && w.warning
+}
+
+// find walks the pkg/errors causes chain, and returns the first error matching.
+func find(err error, match func(error) bool) error {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		if match(err) {
+			return err
+		}
+		cause, ok := err.(causer)
+		if !ok {
+			return nil
+		}
+		err = cause.Cause()
+	}
+
+	return nil
+}
+
+// TemplateVars describes a pod to the hooks settings templates,
+// eg. `up{pod="{{.Pod}}", namespace="{{.Namespace}}"}`.
+type TemplateVars struct {
+	Pod         string
+	Namespace   string
+	Ordinal     int
+	StatefulSet string
+}
+
+// NewTemplateVars returns the templates variables describing pod.
+func NewTemplateVars(pod *v1.Pod) (TemplateVars, error) {
+	ordinal, err := Ordinal(pod)
+	if err != nil {
+		return TemplateVars{}, err
+	}
+
+	return TemplateVars{
+		Pod:         pod.GetName(),
+		Namespace:   pod.GetNamespace(),
+		Ordinal:     ordinal,
+		StatefulSet: strings.TrimSuffix(pod.GetName(), fmt.Sprintf("-%d", ordinal)),
+	}, nil
+}
+
+// ParseTemplate parses the template held by an annotation, with the given
+// functions. It returns a nil template when the annotation is missing or empty.
+func ParseTemplate(annotations map[string]string, key string, funcs ...template.FuncMap) (*template.Template, error) {
+	text, ok := annotations[key]
+	if !ok || strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+
+	tmpl := template.New(key).Option("missingkey=error")
+	for _, f := range funcs {
+		tmpl = tmpl.Funcs(f)
+	}
+
+	tmpl, err := tmpl.Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", key, err)
+	}
+
+	return tmpl, nil
+}
+
+// Render executes tmpl with the TemplateVars describing pod.
+func Render(tmpl *template.Template, pod *v1.Pod) (string, error) {
+	vars, err := NewTemplateVars(pod)
+	if err != nil {
+		return "", err
+	}
+
+	return Execute(tmpl, vars)
+}
+
+// Execute executes tmpl with vars, for hooks extending the TemplateVars.
+func Execute(tmpl *template.Template, vars interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// Ordinal returns the statefulset ordinal of a pod, taken from its name suffix.
+func Ordinal(pod *v1.Pod) (int, error) {
+	name := pod.GetName()
+	idx := strings.LastIndex(name, "-")
+	if idx < 0 {
+		return 0, fmt.Errorf("can't find ordinal in pod name %s", name)
+	}
+
+	ordinal, err := strconv.Atoi(name[idx+1:])
+	if err != nil {
+		return 0, fmt.Errorf("can't find ordinal in pod name %s", name)
+	}
+
+	return ordinal, nil
+}
+
+// PodHost returns the host reaching the statefulset's pod, with the given discovery mode.
+func PodHost(sts *appsv1.StatefulSet, pod *v1.Pod, discovery string) (string, error) {
+	if discovery == DiscoveryDNS {
+		return fmt.Sprintf("%s.%s.%s.svc", pod.GetName(), sts.Spec.ServiceName, pod.GetNamespace()), nil
+	}
+
+	if pod.Status.PodIP == "" {
+		return "", fmt.Errorf("pod has no ip address yet")
+	}
+
+	return pod.Status.PodIP, nil
+}
+
+// PodAddr returns the host:port reaching the statefulset's pod, like PodHost.
+func PodAddr(sts *appsv1.StatefulSet, pod *v1.Pod, discovery string, port int) (string, error) {
+	host, err := PodHost(sts, pod, discovery)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// List joins items with sep for errors messages, listing at most 5 of them.
+func List(items []string, sep string) string {
+	if len(items) > maxListed {
+		items = append(items[:maxListed:maxListed], "...")
+	}
+	return strings.Join(items, sep)
+}
+
+// PodReady tells if the pod's Ready condition is true.
+func PodReady(pod *v1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// ListPods returns the statefulset's pods.
+func ListPods(c client.Client, sts *appsv1.StatefulSet) ([]v1.Pod, error) {
+	if sts.Spec.Selector == nil {
+		return nil, fmt.Errorf("statefulset %s has no selector", sts.GetName())
+	}
+
+	pods := &v1.PodList{}
+	opts := client.InNamespace(sts.GetNamespace()).MatchingLabels(sts.Spec.Selector.MatchLabels)
+	if err := c.List(context.TODO(), opts, pods); err != nil {
+		return nil, fmt.Errorf("failed to list statefulset pods: %v", err)
+	}
+
+	return pods.Items, nil
+}
+
+// GetSecret returns a Secret from the statefulset's namespace, for hooks
+// reading their credentials or certificates from Secrets.
+func GetSecret(c client.Client, namespace, name string) (*v1.Secret, error) {
+	secret := &v1.Secret{}
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	if err := c.Get(context.TODO(), key, secret); err != nil {
+		return nil, fmt.Errorf("failed to get secret %s: %v", name, err)
+	}
+
+	return secret, nil
+}
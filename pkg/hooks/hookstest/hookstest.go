@@ -0,0 +1,181 @@
+// Package hookstest holds the fixtures shared by the hooks tests.
+package hookstest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// NewFakeClient returns a fake client holding objs. Unlike the controller-runtime
+// fake client, its List doesn't need the raw list options, and honours label selectors.
+func NewFakeClient(objs ...runtime.Object) client.Client {
+	return &fakeClient{fake.NewFakeClient(objs...)}
+}
+
+type fakeClient struct {
+	client.Client
+}
+
+func (c *fakeClient) List(ctx context.Context, opts *client.ListOptions, list runtime.Object) error {
+	gvk, err := apiutil.GVKForObject(list, scheme.Scheme)
+	if err != nil {
+		return err
+	}
+
+	// The fake client finds the listed kind in the raw options
+	raw := &client.ListOptions{Raw: &metav1.ListOptions{TypeMeta: metav1.TypeMeta{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       strings.TrimSuffix(gvk.Kind, "List"),
+	}}}
+	if opts != nil {
+		raw.Namespace = opts.Namespace
+	}
+	if err := c.Client.List(ctx, raw, list); err != nil {
+		return err
+	}
+
+	if opts == nil || opts.LabelSelector == nil {
+		return nil
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	var selected []runtime.Object
+	for _, item := range items {
+		obj, err := meta.Accessor(item)
+		if err != nil {
+			return err
+		}
+		if opts.LabelSelector.Matches(labels.Set(obj.GetLabels())) {
+			selected = append(selected, item)
+		}
+	}
+
+	return meta.SetList(list, selected)
+}
+
+// NewFakeClientset returns a fake clientset holding objs, and makes it the
+// clientset hooks patch the statefulsets with. Unlike the client-go fake
+// clientset, its patches remove the fields set to null.
+func NewFakeClientset(objs ...runtime.Object) kubernetes.Interface {
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, obj := range objs {
+		if err := tracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+
+	cs := k8sfake.NewSimpleClientset()
+	cs.PrependReactor("*", "*", k8stesting.ObjectReaction(tracker))
+	cs.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		gvr, ns := patch.GetResource(), patch.GetNamespace()
+		obj, err := tracker.Get(gvr, ns, patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+
+		old, err := json.Marshal(obj)
+		if err != nil {
+			return true, nil, err
+		}
+		merged, err := strategicpatch.StrategicMergePatch(old, patch.GetPatch(), obj)
+		if err != nil {
+			return true, nil, err
+		}
+
+		// Decoding into a new object, so the removed fields don't linger
+		patched := reflect.New(reflect.TypeOf(obj).Elem()).Interface().(runtime.Object)
+		if err := json.Unmarshal(merged, patched); err != nil {
+			return true, nil, err
+		}
+
+		return true, patched, tracker.Update(gvr, patched, ns)
+	})
+
+	hooks.SetClientset(cs)
+	return cs
+}
+
+// StatefulSet returns the name statefulset of the default namespace, whose pods
+// have the "app: name" label, behind the name headless service.
+func StatefulSet(name string, annotations map[string]string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: name,
+			Selector:    &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+		},
+	}
+}
+
+// Pod returns the statefulset's running and ready pod with the given ordinal and ip.
+func Pod(sts *appsv1.StatefulSet, ordinal int, ip string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", sts.GetName(), ordinal),
+			Namespace: sts.GetNamespace(),
+			Labels:    map[string]string{"app": sts.GetName()},
+		},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			PodIP:      ip,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
+// Addrs maps the pods names to their fake servers addresses. The fake servers
+// all listen on 127.0.0.1, each on its own port.
+type Addrs map[string]string
+
+// Listen returns a listener for the pod's fake server, on a new 127.0.0.1 port.
+func (a Addrs) Listen(t *testing.T, pod string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a[pod] = l.Addr().String()
+	return l
+}
+
+// Reserve records a free 127.0.0.1 address for the pod, and returns it. Nothing
+// listens there until a fake server is started on it, so it refuses connections.
+func (a Addrs) Reserve(t *testing.T, pod string) string {
+	l := a.Listen(t, pod)
+	l.Close()
+	return a[pod]
+}
+
+// Addr returns the pod's fake server address. It replaces the hooks pods address
+// resolution in the tests.
+func (a Addrs) Addr(pod *v1.Pod) (string, error) {
+	addr, ok := a[pod.GetName()]
+	if !ok {
+		return "", fmt.Errorf("pod %s has no fake server", pod.GetName())
+	}
+	return addr, nil
+}
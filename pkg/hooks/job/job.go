@@ -0,0 +1,161 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// TemplateAnnotation holds the jobs pod spec, as YAML or JSON.
+	TemplateAnnotation = hooks.AnnotationPrefix + "job-template"
+
+	// StatefulSetLabel is set on jobs, and names the statefulset they belong to.
+	StatefulSetLabel = hooks.AnnotationPrefix + "statefulset"
+)
+
+// Hook runs a Kubernetes Job for each pods transition, and proceeds once it succeeded.
+// Failed jobs are deleted, and started again on the next call. The jobs containers
+// are given the PILOT_PREV_POD, PILOT_NEXT_POD (empty when nil), PILOT_NAMESPACE,
+// PILOT_STATEFULSET and PILOT_UPDATE_REVISION environment variables.
+type Hook struct {
+	client client.Client
+	sts    *appsv1.StatefulSet
+	spec   v1.PodSpec
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	tmpl, ok := sts.GetAnnotations()[TemplateAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("missing %s annotation", TemplateAnnotation)
+	}
+
+	h := &Hook{
+		client: c,
+		sts:    sts,
+	}
+
+	decoder := yaml.NewYAMLOrJSONDecoder(strings.NewReader(tmpl), len(tmpl))
+	if err := decoder.Decode(&h.spec); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", TemplateAnnotation))
+	}
+
+	if len(h.spec.Containers) == 0 {
+		return nil, fmt.Errorf("invalid %s annotation: no containers", TemplateAnnotation)
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "job"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	job := h.build(prev, next)
+	key := types.NamespacedName{Namespace: job.GetNamespace(), Name: job.GetName()}
+
+	existing := &batchv1.Job{}
+	err := h.client.Get(context.TODO(), key, existing)
+	if apierrors.IsNotFound(err) {
+		if err := h.client.Create(context.TODO(), job); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to create job %s", key.Name))
+		}
+		return fmt.Errorf("started job %s", key.Name)
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to get job %s", key.Name))
+	}
+
+	switch {
+	case existing.Status.Succeeded > 0:
+		if err := h.delete(existing); err != nil {
+			return err
+		}
+		return nil
+
+	case existing.Status.Failed > 0:
+		if err := h.delete(existing); err != nil {
+			return err
+		}
+		return fmt.Errorf("job %s failed, will start it again", key.Name)
+	}
+
+	return fmt.Errorf("waiting for job %s to complete", key.Name)
+}
+
+func (h *Hook) delete(job *batchv1.Job) error {
+	err := h.client.Delete(context.TODO(), job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, fmt.Sprintf("failed to delete job %s", job.GetName()))
+	}
+	return nil
+}
+
+func (h *Hook) build(prev, next *v1.Pod) *batchv1.Job {
+	var prevName, nextName string
+	if prev != nil {
+		prevName = prev.GetName()
+	}
+	if next != nil {
+		nextName = next.GetName()
+	}
+
+	env := []v1.EnvVar{
+		{Name: "PILOT_PREV_POD", Value: prevName},
+		{Name: "PILOT_NEXT_POD", Value: nextName},
+		{Name: "PILOT_NAMESPACE", Value: h.sts.GetNamespace()},
+		{Name: "PILOT_STATEFULSET", Value: h.sts.GetName()},
+		{Name: "PILOT_UPDATE_REVISION", Value: h.sts.Status.UpdateRevision},
+	}
+
+	spec := h.spec.DeepCopy()
+	if spec.RestartPolicy == "" {
+		spec.RestartPolicy = v1.RestartPolicyNever
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].Env = append(spec.Containers[i].Env, env...)
+	}
+
+	// One job per transition and revision
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%s/%s/%s", h.sts.Status.UpdateRevision, prevName, nextName)
+
+	name := h.sts.GetName()
+	if len(name) > 40 {
+		name = name[:40]
+	}
+
+	labels := map[string]string{StatefulSetLabel: h.sts.GetName()}
+	backoffLimit := int32(0)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-pilot-%08x", name, hash.Sum32()),
+			Namespace: h.sts.GetNamespace(),
+			Labels:    labels,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(h.sts, appsv1.SchemeGroupVersion.WithKind("StatefulSet")),
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       *spec,
+			},
+		},
+	}
+}
@@ -0,0 +1,119 @@
+package job
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const podSpec = `
+containers:
+- name: check
+  image: busybox
+  command: ["sh", "-c", "test $PILOT_NEXT_POD != db-0"]
+`
+
+func pod(name string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+}
+
+func newHook(t *testing.T, c client.Client) *Hook {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "default",
+			Annotations: map[string]string{TemplateAnnotation: podSpec},
+		},
+		Status: appsv1.StatefulSetStatus{UpdateRevision: "db-2"},
+	}
+
+	h, err := New(c, sts)
+	if err != nil {
+		t.Fatalf("failed to create hook: %v", err)
+	}
+
+	return h.(*Hook)
+}
+
+// setStatus plays the job controller part.
+func setStatus(t *testing.T, c client.Client, name string, succeeded, failed int32) {
+	job := &batchv1.Job{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: name}, job); err != nil {
+		t.Fatalf("job %s wasn't created: %v", name, err)
+	}
+
+	job.Status.Succeeded = succeeded
+	job.Status.Failed = failed
+	if err := c.Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPodUpdateTransition(t *testing.T) {
+	c := fake.NewFakeClient()
+	h := newHook(t, c)
+	prev, next := pod("db-2"), pod("db-1")
+	name := h.build(prev, next).GetName()
+
+	if err := h.PodUpdateTransition(prev, next); err == nil {
+		t.Fatal("PodUpdateTransition() should wait for the job it started")
+	}
+
+	job := &batchv1.Job{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: name}, job); err != nil {
+		t.Fatalf("job wasn't created: %v", err)
+	}
+
+	env := map[string]string{}
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if env["PILOT_PREV_POD"] != "db-2" || env["PILOT_NEXT_POD"] != "db-1" || env["PILOT_UPDATE_REVISION"] != "db-2" {
+		t.Errorf("unexpected job environment: %v", env)
+	}
+	if job.Spec.Template.Spec.RestartPolicy != v1.RestartPolicyNever {
+		t.Errorf("unexpected job restart policy: %s", job.Spec.Template.Spec.RestartPolicy)
+	}
+
+	if err := h.PodUpdateTransition(prev, next); err == nil {
+		t.Error("PodUpdateTransition() should wait for the running job")
+	}
+
+	setStatus(t, c, name, 0, 1)
+	if err := h.PodUpdateTransition(prev, next); err == nil {
+		t.Error("PodUpdateTransition() should fail when the job failed")
+	}
+
+	err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: name}, job)
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("failed job should be deleted, got: %v", err)
+	}
+
+	h.PodUpdateTransition(prev, next)
+	setStatus(t, c, name, 1, 0)
+	if err := h.PodUpdateTransition(prev, next); err != nil {
+		t.Errorf("PodUpdateTransition() should succeed once the job succeeded, got: %v", err)
+	}
+
+	if h.build(prev, nil).GetName() == name {
+		t.Error("jobs names should differ between transitions")
+	}
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db"}}
+	for _, tmpl := range []string{"containers: 3", "restartPolicy: Never"} {
+		sts.Annotations = map[string]string{TemplateAnnotation: tmpl}
+		if _, err := New(nil, sts); err == nil {
+			t.Errorf("New() should fail for %q", tmpl)
+		}
+	}
+}
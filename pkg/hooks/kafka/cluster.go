@@ -0,0 +1,170 @@
+package kafka
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+const minInsyncSetting = "min.insync.replicas"
+
+type partition struct {
+	topic    string
+	id       int32
+	replicas []int32
+	isr      []int32
+	// leader is -1 when the partition has no leader
+	leader int32
+}
+
+func (p partition) String() string {
+	return fmt.Sprintf("%s[%d]", p.topic, p.id)
+}
+
+type partitions []partition
+
+// inSync returns the partitions having broker in their ISR.
+func (ps partitions) inSync(broker int32) partitions {
+	var res partitions
+	for _, p := range ps {
+		if contains(p.isr, broker) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func (ps partitions) topics() []string {
+	seen := make(map[string]bool)
+	var topics []string
+	for _, p := range ps {
+		if !seen[p.topic] {
+			seen[p.topic] = true
+			topics = append(topics, p.topic)
+		}
+	}
+	return topics
+}
+
+// notLedBy returns the partitions whose preferred leader is broker, but that
+// are led by another broker.
+func (ps partitions) notLedBy(broker int32) partitions {
+	var res partitions
+	for _, p := range ps {
+		if len(p.replicas) > 0 && p.replicas[0] == broker && p.leader != broker {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// getPartitions returns all the topics partitions, from fresh metadata.
+func getPartitions(c sarama.Client) (partitions, error) {
+	if err := c.RefreshMetadata(); err != nil {
+		return nil, errors.Wrap(err, "failed to get the cluster metadata")
+	}
+
+	topics, err := c.Topics()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(topics)
+
+	var res partitions
+	for _, topic := range topics {
+		ids, err := c.Partitions(topic)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to get topic %s partitions", topic))
+		}
+
+		for _, id := range ids {
+			// Replicas are still listed when some of them aren't available
+			replicas, err := c.Replicas(topic, id)
+			if err != nil && err != sarama.ErrReplicaNotAvailable {
+				return nil, errors.Wrap(err, fmt.Sprintf("failed to get partition %s[%d] replicas", topic, id))
+			}
+			isr, err := c.InSyncReplicas(topic, id)
+			if err != nil && err != sarama.ErrReplicaNotAvailable {
+				return nil, errors.Wrap(err, fmt.Sprintf("failed to get partition %s[%d] isr", topic, id))
+			}
+			leader := int32(-1)
+			if b, err := c.Leader(topic, id); err == nil {
+				leader = b.ID()
+			}
+			res = append(res, partition{topic: topic, id: id, replicas: replicas, isr: isr, leader: leader})
+		}
+	}
+
+	return res, nil
+}
+
+// minInsyncReplicas returns the topics effective min.insync.replicas, as
+// described by the controller.
+func minInsyncReplicas(c sarama.Client, topics []string) (map[string]int, error) {
+	res := make(map[string]int)
+	if len(topics) == 0 {
+		return res, nil
+	}
+
+	controller, err := c.Controller()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the controller")
+	}
+
+	req := &sarama.DescribeConfigsRequest{}
+	for _, topic := range topics {
+		req.Resources = append(req.Resources, &sarama.ConfigResource{
+			Type:        sarama.TopicResource,
+			Name:        topic,
+			ConfigNames: []string{minInsyncSetting},
+		})
+	}
+
+	resp, err := controller.DescribeConfigs(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to describe the topics configs")
+	}
+
+	for _, r := range resp.Resources {
+		if r.ErrorCode != 0 {
+			return nil, fmt.Errorf("failed to describe topic %s config: %s", r.Name, sarama.KError(r.ErrorCode))
+		}
+
+		// Kafka's default
+		res[r.Name] = 1
+		for _, entry := range r.Configs {
+			if entry.Name != minInsyncSetting {
+				continue
+			}
+			min, err := strconv.Atoi(entry.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid topic %s %s: %q", r.Name, minInsyncSetting, entry.Value)
+			}
+			res[r.Name] = min
+		}
+	}
+
+	return res, nil
+}
+
+// registered tells if the broker is part of the cluster metadata.
+func registered(c sarama.Client, id int32) bool {
+	for _, b := range c.Brokers() {
+		if b.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(ids []int32, id int32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,306 @@
+package kafka
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/exec"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// BootstrapAnnotation is a comma separated list of brokers host:port. It
+	// defaults to the statefulset pods headless service DNS names.
+	BootstrapAnnotation = hooks.AnnotationPrefix + "kafka-bootstrap"
+
+	// PortAnnotation is the brokers port (defaults to 9092).
+	PortAnnotation = hooks.AnnotationPrefix + "kafka-port"
+
+	// BrokerIDOffsetAnnotation is added to the pods ordinals to get their broker
+	// ids (defaults to 0, ie. broker.id is the pod ordinal).
+	BrokerIDOffsetAnnotation = hooks.AnnotationPrefix + "kafka-broker-id-offset"
+
+	// LeaderElectionAnnotation, when "true", triggers a preferred leader election
+	// once a restarted broker is back in sync, unless it already leads the
+	// partitions it's the preferred leader of.
+	LeaderElectionAnnotation = hooks.AnnotationPrefix + "kafka-preferred-leader-election"
+
+	// LeaderElectionCommandAnnotation is the shell command triggering the preferred
+	// leader election, run in the restarted broker pod. It's a template receiving
+	// the hooks.TemplateVars.
+	LeaderElectionCommandAnnotation = hooks.AnnotationPrefix + "kafka-leader-election-command"
+
+	// ContainerAnnotation is the container running the leader election command
+	// (defaults to the first one).
+	ContainerAnnotation = hooks.AnnotationPrefix + "kafka-container"
+
+	defaultPort            = 9092
+	defaultElectionCommand = "kafka-leader-election.sh --bootstrap-server localhost:9092 " +
+		"--election-type preferred --all-topic-partitions"
+
+	timeout = time.Duration(30 * time.Second)
+)
+
+// Hook restarts brokers one at a time without losing partitions availability:
+// a broker is only restarted when no partition is under-replicated, and when
+// its partitions keep min.insync.replicas without it. The next broker waits
+// until the restarted one is back in the ISR of all its partitions.
+type Hook struct {
+	client    client.Client
+	sts       *appsv1.StatefulSet
+	bootstrap []string
+	port      int
+	idOffset  int
+	config    *sarama.Config
+
+	// election is the leader election command, nil when disabled
+	election  *template.Template
+	container string
+
+	// elect runs the leader election command in a broker pod
+	elect func(pod *v1.Pod, command string) error
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		client:    c,
+		sts:       sts,
+		port:      defaultPort,
+		container: annotations[ContainerAnnotation],
+	}
+
+	if val, ok := annotations[BootstrapAnnotation]; ok {
+		for _, addr := range strings.Split(val, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				h.bootstrap = append(h.bootstrap, addr)
+			}
+		}
+	}
+
+	if val, ok := annotations[PortAnnotation]; ok {
+		port, err := strconv.Atoi(val)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", PortAnnotation, val)
+		}
+		h.port = port
+	}
+
+	if val, ok := annotations[BrokerIDOffsetAnnotation]; ok {
+		offset, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %q", BrokerIDOffsetAnnotation, val)
+		}
+		h.idOffset = offset
+	}
+
+	if annotations[LeaderElectionAnnotation] == "true" {
+		command := map[string]string{LeaderElectionCommandAnnotation: defaultElectionCommand}
+		if val, ok := annotations[LeaderElectionCommandAnnotation]; ok {
+			command[LeaderElectionCommandAnnotation] = val
+		}
+
+		var err error
+		if h.election, err = hooks.ParseTemplate(command, LeaderElectionCommandAnnotation); err != nil {
+			return nil, err
+		}
+	}
+
+	h.elect = h.execCommand
+
+	h.config = sarama.NewConfig()
+	h.config.ClientID = "statefulset-pilot"
+	h.config.Version = sarama.V1_0_0_0
+	h.config.Net.DialTimeout = timeout
+	h.config.Net.ReadTimeout = timeout
+	h.config.Net.WriteTimeout = timeout
+	h.config.Metadata.Retry.Max = 1
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "kafka"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil {
+		if err := h.afterUpdate(prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil {
+		if err := h.beforeUpdate(next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+// brokerID returns the pod's broker id, mapped from its ordinal.
+func (h *Hook) brokerID(pod *v1.Pod) (int32, error) {
+	ordinal, err := hooks.Ordinal(pod)
+	if err != nil {
+		return 0, err
+	}
+	return int32(ordinal + h.idOffset), nil
+}
+
+// addrs returns the bootstrap brokers: the configured ones, or else the running pods.
+func (h *Hook) addrs() ([]string, error) {
+	if len(h.bootstrap) > 0 {
+		return h.bootstrap, nil
+	}
+
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, pod := range pods {
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		addrs = append(addrs, fmt.Sprintf("%s.%s.%s.svc:%d",
+			pod.GetName(), h.sts.Spec.ServiceName, pod.GetNamespace(), h.port))
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no running broker")
+	}
+
+	return addrs, nil
+}
+
+func (h *Hook) connect() (sarama.Client, error) {
+	addrs, err := h.addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := sarama.NewClient(addrs, h.config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to kafka")
+	}
+
+	return c, nil
+}
+
+func (h *Hook) beforeUpdate(pod *v1.Pod) error {
+	id, err := h.brokerID(pod)
+	if err != nil {
+		return err
+	}
+
+	c, err := h.connect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	partitions, err := getPartitions(c)
+	if err != nil {
+		return err
+	}
+
+	var urp []string
+	for _, p := range partitions {
+		if len(p.isr) < len(p.replicas) {
+			urp = append(urp, p.String())
+		}
+	}
+	if len(urp) > 0 {
+		return fmt.Errorf("%d under-replicated partitions: %s", len(urp), hooks.List(urp, ", "))
+	}
+
+	hosted := partitions.inSync(id)
+	minISR, err := minInsyncReplicas(c, hosted.topics())
+	if err != nil {
+		return err
+	}
+
+	var atRisk []string
+	for _, p := range hosted {
+		if min := minISR[p.topic]; len(p.isr)-1 < min {
+			atRisk = append(atRisk, fmt.Sprintf("%s (%d in sync, min.insync.replicas=%d)", p, len(p.isr), min))
+		}
+	}
+	if len(atRisk) > 0 {
+		return fmt.Errorf("%d partitions would go below min.insync.replicas without broker %d: %s",
+			len(atRisk), id, hooks.List(atRisk, ", "))
+	}
+
+	return nil
+}
+
+func (h *Hook) afterUpdate(pod *v1.Pod) error {
+	id, err := h.brokerID(pod)
+	if err != nil {
+		return err
+	}
+
+	c, err := h.connect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	partitions, err := getPartitions(c)
+	if err != nil {
+		return err
+	}
+
+	if !registered(c, id) {
+		return fmt.Errorf("broker %d hasn't rejoined the cluster yet", id)
+	}
+
+	var lagging []string
+	for _, p := range partitions {
+		if contains(p.replicas, id) && !contains(p.isr, id) {
+			lagging = append(lagging, p.String())
+		}
+	}
+	if len(lagging) > 0 {
+		return fmt.Errorf("broker %d isn't in sync yet for %d partitions: %s", id, len(lagging), hooks.List(lagging, ", "))
+	}
+
+	// The election runs once: the broker then leads its preferred partitions
+	if h.election == nil || len(partitions.notLedBy(id)) == 0 {
+		return nil
+	}
+
+	cmd, err := hooks.Render(h.election, pod)
+	if err != nil {
+		return err
+	}
+
+	if err := h.elect(pod, cmd); err != nil {
+		return errors.Wrap(err, "preferred leader election failed")
+	}
+
+	return nil
+}
+
+// execCommand runs a shell command in the pod, through the exec subresource.
+func (h *Hook) execCommand(pod *v1.Pod, command string) error {
+	cfg, err := hooks.RestConfig()
+	if err != nil {
+		return err
+	}
+
+	_, err = exec.Run(cfg, pod, h.container, []string{"/bin/sh", "-c", command})
+	return err
+}
@@ -0,0 +1,214 @@
+package kafka
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// mockCluster is a 3 brokers cluster served by a single mock broker, with a
+// "logs" topic whose partition 0 is replicated on all brokers.
+type mockCluster struct {
+	broker   *sarama.MockBroker
+	brokers  []int32
+	replicas []int32
+	isr      []int32
+	leader   int32
+	minISR   string
+	metadata *sarama.MetadataResponse
+}
+
+func newMockCluster(t *testing.T) *mockCluster {
+	return &mockCluster{
+		broker:   sarama.NewMockBroker(t, 0),
+		brokers:  []int32{0, 1, 2},
+		replicas: []int32{0, 1, 2},
+		isr:      []int32{0, 1, 2},
+		minISR:   "2",
+	}
+}
+
+// serve (re)sets the mock broker responses from the cluster state.
+func (m *mockCluster) serve() {
+	md := &sarama.MetadataResponse{Version: 1, ControllerID: 0}
+	for _, id := range m.brokers {
+		md.AddBroker(m.broker.Addr(), id)
+	}
+	md.AddTopicPartition("logs", 0, m.leader, m.replicas, m.isr, sarama.ErrNoError)
+
+	configs := &sarama.DescribeConfigsResponse{
+		Resources: []*sarama.ResourceResponse{{
+			Type:    sarama.TopicResource,
+			Name:    "logs",
+			Configs: []*sarama.ConfigEntry{{Name: minInsyncSetting, Value: m.minISR}},
+		}},
+	}
+
+	m.broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest":        sarama.NewMockWrapper(md),
+		"DescribeConfigsRequest": sarama.NewMockWrapper(configs),
+	})
+}
+
+func newHook(t *testing.T, m *mockCluster, annotations map[string]string) *Hook {
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[BootstrapAnnotation] = m.broker.Addr()
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "kafka", Namespace: "default", Annotations: annotations},
+	}
+
+	h, err := New(nil, sts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h.(*Hook)
+}
+
+func broker(ordinal string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "kafka-" + ordinal, Namespace: "default"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+func TestBeforeUpdate(t *testing.T) {
+	tests := []struct {
+		title   string
+		isr     []int32
+		minISR  string
+		wantErr string
+	}{
+		{title: "all in sync", isr: []int32{0, 1, 2}, minISR: "2"},
+		{
+			title:   "under-replicated partition",
+			isr:     []int32{0, 1},
+			minISR:  "1",
+			wantErr: "1 under-replicated partitions: logs[0]",
+		},
+		{
+			title:   "below min.insync.replicas",
+			isr:     []int32{0, 1, 2},
+			minISR:  "3",
+			wantErr: "1 partitions would go below min.insync.replicas without broker 2: logs[0] (3 in sync, min.insync.replicas=3)",
+		},
+	}
+
+	for _, tt := range tests {
+		m := newMockCluster(t)
+		m.isr, m.minISR = tt.isr, tt.minISR
+		m.serve()
+
+		err := newHook(t, m, nil).PodUpdateTransition(nil, broker("2"))
+		m.broker.Close()
+
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.title, err)
+		case tt.wantErr != "" && (err == nil || !strings.HasSuffix(err.Error(), tt.wantErr)):
+			t.Errorf("%s: expected %q error, got: %v", tt.title, tt.wantErr, err)
+		}
+	}
+}
+
+func TestAfterUpdate(t *testing.T) {
+	tests := []struct {
+		title   string
+		brokers []int32
+		isr     []int32
+		wantErr string
+	}{
+		{title: "back in sync", brokers: []int32{0, 1, 2}, isr: []int32{0, 1, 2}},
+		{title: "not registered", brokers: []int32{0, 1}, isr: []int32{0, 1}, wantErr: "broker 2 hasn't rejoined the cluster yet"},
+		{
+			title:   "not in sync",
+			brokers: []int32{0, 1, 2},
+			isr:     []int32{0, 1},
+			wantErr: "broker 2 isn't in sync yet for 1 partitions: logs[0]",
+		},
+	}
+
+	for _, tt := range tests {
+		m := newMockCluster(t)
+		m.brokers, m.isr = tt.brokers, tt.isr
+		m.serve()
+
+		err := newHook(t, m, nil).PodUpdateTransition(broker("2"), nil)
+		m.broker.Close()
+
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.title, err)
+		case tt.wantErr != "" && (err == nil || !strings.HasSuffix(err.Error(), tt.wantErr)):
+			t.Errorf("%s: expected %q error, got: %v", tt.title, tt.wantErr, err)
+		}
+	}
+}
+
+func TestPreferredLeaderElection(t *testing.T) {
+	// kafka-2 is the preferred leader, but lost the leadership during its restart
+	m := newMockCluster(t)
+	defer m.broker.Close()
+	m.replicas = []int32{2, 0, 1}
+	m.serve()
+
+	h := newHook(t, m, map[string]string{
+		LeaderElectionAnnotation:        "true",
+		LeaderElectionCommandAnnotation: "elect --broker {{.Ordinal}}",
+	})
+
+	var got []string
+	h.elect = func(pod *v1.Pod, command string) error {
+		got = append(got, pod.GetName()+": "+command)
+		return nil
+	}
+
+	if err := h.PodUpdateTransition(broker("2"), broker("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0] != "kafka-2: elect --broker 2" {
+		t.Errorf("expected an election on kafka-2, got %v", got)
+	}
+
+	// Once kafka-2 leads its partitions again, later reconciliations don't elect again
+	m.leader = 2
+	m.serve()
+	if err := h.PodUpdateTransition(broker("2"), broker("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("expected a single election, got %v", got)
+	}
+
+	// The election waits for the broker to be in sync
+	m.isr = []int32{0, 1}
+	m.serve()
+	if err := h.PodUpdateTransition(broker("2"), nil); err == nil {
+		t.Error("expected to wait for the broker to be in sync")
+	}
+	if len(got) != 1 {
+		t.Errorf("unexpected election before the broker is in sync: %v", got)
+	}
+}
+
+func TestBrokerID(t *testing.T) {
+	m := newMockCluster(t)
+	defer m.broker.Close()
+
+	h := newHook(t, m, map[string]string{BrokerIDOffsetAnnotation: "1000"})
+	id, err := h.brokerID(broker("2"))
+	if err != nil || id != 1002 {
+		t.Errorf("expected broker id 1002, got %d (%v)", id, err)
+	}
+
+	if _, err := newHook(t, m, nil).brokerID(&v1.Pod{}); err == nil {
+		t.Error("expected an error for a pod without ordinal")
+	}
+}
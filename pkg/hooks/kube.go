@@ -0,0 +1,106 @@
+package hooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	kubeMu     sync.Mutex
+	restConfig *rest.Config
+	clientset  kubernetes.Interface
+)
+
+// SetRestConfig sets the API server config hooks use for the requests the
+// controller-runtime client can't make (eg. pods execs). The controller sets
+// it once, from the manager's config.
+func SetRestConfig(cfg *rest.Config) {
+	kubeMu.Lock()
+	defer kubeMu.Unlock()
+	restConfig, clientset = cfg, nil
+}
+
+// RestConfig returns the API server config set with SetRestConfig.
+func RestConfig() (*rest.Config, error) {
+	kubeMu.Lock()
+	defer kubeMu.Unlock()
+
+	if restConfig == nil {
+		return nil, errors.New("no api server config set")
+	}
+
+	return restConfig, nil
+}
+
+// SetClientset replaces the clientset built from the API server config (tests
+// set a fake one).
+func SetClientset(cs kubernetes.Interface) {
+	kubeMu.Lock()
+	defer kubeMu.Unlock()
+	clientset = cs
+}
+
+// Clientset returns a clientset for the API server config set with SetRestConfig.
+func Clientset() (kubernetes.Interface, error) {
+	kubeMu.Lock()
+	defer kubeMu.Unlock()
+
+	if clientset != nil {
+		return clientset, nil
+	}
+
+	if restConfig == nil {
+		return nil, errors.New("no api server config set")
+	}
+
+	cs, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	clientset = cs
+
+	return clientset, nil
+}
+
+// PatchAnnotations sets the statefulset annotations (removing those set to nil)
+// with a merge patch, so hooks saving their state neither conflict with nor
+// overwrite the other writes to the statefulset. The changes are mirrored on sts.
+func PatchAnnotations(sts *appsv1.StatefulSet, annotations map[string]*string) error {
+	cs, err := Clientset()
+	if err != nil {
+		return err
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	_, err = cs.AppsV1().StatefulSets(sts.GetNamespace()).Patch(sts.GetName(), types.MergePatchType, data)
+	if err != nil {
+		return fmt.Errorf("failed to patch statefulset %s annotations: %v", sts.GetName(), err)
+	}
+
+	if sts.Annotations == nil {
+		sts.Annotations = make(map[string]string)
+	}
+	for key, val := range annotations {
+		if val == nil {
+			delete(sts.Annotations, key)
+		} else {
+			sts.Annotations[key] = *val
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,356 @@
+package mongodb
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// PortAnnotation is the mongod port (defaults to 27017).
+	PortAnnotation = hooks.AnnotationPrefix + "mongodb-port"
+
+	// DiscoveryAnnotation tells how members are reached: on their pod ip (the
+	// default), or on their headless service DNS name.
+	DiscoveryAnnotation = hooks.AnnotationPrefix + "mongodb-discovery"
+
+	// CredentialsSecretAnnotation names a Secret holding the "username" and
+	// "password" of a user authenticating against the admin database, and
+	// allowed to run the replica set commands (eg. with the clusterManager role).
+	CredentialsSecretAnnotation = hooks.AnnotationPrefix + "mongodb-credentials-secret"
+
+	// MaxOptimeLagAnnotation is how far behind the primary's optime a secondary
+	// can be while being considered in sync (a duration, defaults to 10s).
+	MaxOptimeLagAnnotation = hooks.AnnotationPrefix + "mongodb-max-optime-lag"
+
+	// TimeoutAnnotation is the members queries timeout (a duration, defaults to 10s).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "mongodb-timeout"
+
+	defaultPort         = 27017
+	defaultMaxOptimeLag = 10 * time.Second
+	defaultTimeout      = 10 * time.Second
+)
+
+const (
+	// ElectionReason is the retry reason while the next pod is stepping down
+	// from primary, and until a new primary is elected.
+	ElectionReason = "PrimaryElection"
+
+	// stepDownSeconds is how long a stepped down primary won't seek re-election
+	stepDownSeconds = 60
+
+	usernameKey = "username"
+	passwordKey = "password"
+)
+
+// Hook restarts replica set members one at a time, keeping the majority of the
+// voting members healthy: a member is only restarted when a majority would remain
+// healthy without it. The primary steps down before its restart, which is held
+// back until a new primary is elected. The next member waits until the restarted
+// one is secondary again, with an optime close enough to the primary's.
+type Hook struct {
+	client       client.Client
+	sts          *appsv1.StatefulSet
+	port         int
+	discovery    string
+	username     string
+	password     string
+	maxOptimeLag time.Duration
+	timeout      time.Duration
+	dial         func(addr string) (session, error)
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		client:       c,
+		sts:          sts,
+		port:         defaultPort,
+		discovery:    hooks.DiscoveryIP,
+		maxOptimeLag: defaultMaxOptimeLag,
+		timeout:      defaultTimeout,
+	}
+	h.dial = h.connect
+
+	if val, ok := annotations[PortAnnotation]; ok {
+		port, err := strconv.Atoi(val)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", PortAnnotation, val)
+		}
+		h.port = port
+	}
+
+	if val, ok := annotations[DiscoveryAnnotation]; ok {
+		if val != hooks.DiscoveryIP && val != hooks.DiscoveryDNS {
+			return nil, fmt.Errorf("invalid %s annotation: %q", DiscoveryAnnotation, val)
+		}
+		h.discovery = val
+	}
+
+	if name, ok := annotations[CredentialsSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		h.username, h.password = string(secret.Data[usernameKey]), string(secret.Data[passwordKey])
+		if h.username == "" {
+			return nil, fmt.Errorf("secret %s has no %s key", name, usernameKey)
+		}
+	}
+
+	if val, ok := annotations[MaxOptimeLagAnnotation]; ok {
+		lag, err := time.ParseDuration(val)
+		if err != nil || lag < 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", MaxOptimeLagAnnotation, val)
+		}
+		h.maxOptimeLag = lag
+	}
+
+	if val, ok := annotations[TimeoutAnnotation]; ok {
+		var err error
+		if h.timeout, err = time.ParseDuration(val); err != nil || h.timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", TimeoutAnnotation, val)
+		}
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "mongodb"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil {
+		if err := h.afterUpdate(prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil {
+		if err := h.beforeUpdate(next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+// beforeUpdate checks a majority of the voting members would remain healthy
+// without next, and has next step down when it's the primary.
+func (h *Hook) beforeUpdate(next *v1.Pod) error {
+	status, config, err := h.replicaSet(next)
+	if err != nil {
+		return err
+	}
+
+	member := findMember(status, next)
+	if member == nil {
+		return fmt.Errorf("no %s member in the %s replica set", next.GetName(), status.Set)
+	}
+
+	var voters, healthy int
+	var unhealthy []string
+	for _, m := range config.Members {
+		if m.Votes == 0 {
+			continue
+		}
+		voters++
+
+		if m.Host == member.Name {
+			continue
+		}
+
+		if s := findStatus(status, m.Host); s != nil && isHealthy(s) {
+			healthy++
+		} else {
+			unhealthy = append(unhealthy, m.Host)
+		}
+	}
+
+	if majority := voters/2 + 1; healthy < majority {
+		return fmt.Errorf("the replica set would lose its majority without %s: %d of %d voting members would remain healthy, unhealthy: %s",
+			member.Name, healthy, voters, hooks.List(unhealthy, ", "))
+	}
+
+	if member.State == statePrimary {
+		if err := h.stepDown(next); err != nil {
+			return errors.Wrap(err, "step down failed")
+		}
+		return hooks.Wait(ElectionReason, fmt.Errorf("member stepped down from primary: waiting for a new primary"))
+	}
+
+	if findPrimary(status) == nil {
+		return hooks.Wait(ElectionReason, fmt.Errorf("replica set has no primary: waiting for a new primary"))
+	}
+
+	return nil
+}
+
+// afterUpdate waits until prev is secondary again, and caught up with the primary.
+func (h *Hook) afterUpdate(prev *v1.Pod) error {
+	addr, err := h.addr(prev)
+	if err != nil {
+		return err
+	}
+
+	s, err := h.dial(addr)
+	if err != nil {
+		return errors.Wrap(err, "member isn't ready yet")
+	}
+	defer s.close()
+
+	status, err := s.status()
+	if err != nil {
+		return errors.Wrap(err, "member isn't ready yet")
+	}
+
+	var self *memberStatus
+	for i := range status.Members {
+		if status.Members[i].Self {
+			self = &status.Members[i]
+		}
+	}
+	if self == nil {
+		return fmt.Errorf("member isn't part of the %s replica set yet", status.Set)
+	}
+
+	switch self.State {
+	case statePrimary, stateArbiter:
+		return nil
+	case stateSecondary:
+	default:
+		return fmt.Errorf("member is %s", self.StateStr)
+	}
+
+	primary := findPrimary(status)
+	if primary == nil {
+		return fmt.Errorf("replica set has no primary yet")
+	}
+
+	if lag := primary.OptimeDate.Sub(self.OptimeDate); lag > h.maxOptimeLag {
+		return fmt.Errorf("member optime is %s behind primary %s", lag, primary.Name)
+	}
+
+	return nil
+}
+
+// replicaSet returns the replica set status and configuration, as seen by the
+// first member answering (trying the given pod first).
+func (h *Hook) replicaSet(first *v1.Pod) (*replSetStatus, *replSetConfig, error) {
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candidates := []*v1.Pod{first}
+	for i := range pods {
+		if pods[i].GetName() != first.GetName() {
+			candidates = append(candidates, &pods[i])
+		}
+	}
+
+	for _, pod := range candidates {
+		var status *replSetStatus
+		var config *replSetConfig
+		if status, config, err = h.query(pod); err == nil {
+			return status, config, nil
+		}
+	}
+
+	return nil, nil, errors.Wrap(err, "failed to query the replica set")
+}
+
+func (h *Hook) query(pod *v1.Pod) (*replSetStatus, *replSetConfig, error) {
+	addr, err := h.addr(pod)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, err := h.dial(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.close()
+
+	status, err := s.status()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err := s.config()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return status, config, nil
+}
+
+func (h *Hook) stepDown(pod *v1.Pod) error {
+	addr, err := h.addr(pod)
+	if err != nil {
+		return err
+	}
+
+	s, err := h.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	return s.stepDown(stepDownSeconds)
+}
+
+func (h *Hook) addr(pod *v1.Pod) (string, error) {
+	return hooks.PodAddr(h.sts, pod, h.discovery, h.port)
+}
+
+// findMember returns the pod's member, whose configured host can be the pod's
+// ip address, its name, or a DNS name starting with it.
+func findMember(status *replSetStatus, pod *v1.Pod) *memberStatus {
+	for i, m := range status.Members {
+		host, _, err := net.SplitHostPort(m.Name)
+		if err != nil {
+			host = m.Name
+		}
+
+		if (pod.Status.PodIP != "" && host == pod.Status.PodIP) ||
+			host == pod.GetName() || strings.HasPrefix(host, pod.GetName()+".") {
+			return &status.Members[i]
+		}
+	}
+	return nil
+}
+
+func findStatus(status *replSetStatus, host string) *memberStatus {
+	for i, m := range status.Members {
+		if m.Name == host {
+			return &status.Members[i]
+		}
+	}
+	return nil
+}
+
+func findPrimary(status *replSetStatus) *memberStatus {
+	for i, m := range status.Members {
+		if m.State == statePrimary {
+			return &status.Members[i]
+		}
+	}
+	return nil
+}
+
+func isHealthy(m *memberStatus) bool {
+	return m.Health == 1 && (m.State == statePrimary || m.State == stateSecondary || m.State == stateArbiter)
+}
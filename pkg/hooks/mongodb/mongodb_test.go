@@ -0,0 +1,268 @@
+package mongodb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var mongodbStatefulSet = hookstest.StatefulSet("mongodb", nil)
+
+// fakeReplicaSet holds the members of a replica set, reached at 10.0.0.1 to
+// 10.0.0.n, and configured with their DNS names.
+type fakeReplicaSet struct {
+	members []memberStatus
+	votes   []int
+	// elect elects a new primary when the primary steps down
+	elect     bool
+	stepDowns int
+}
+
+// fakeSession is a connection to one of the members.
+type fakeSession struct {
+	rs   *fakeReplicaSet
+	self int
+}
+
+func newFakeReplicaSet(n int) *fakeReplicaSet {
+	rs := &fakeReplicaSet{elect: true}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		state, stateStr := stateSecondary, "SECONDARY"
+		if i == 0 {
+			state, stateStr = statePrimary, "PRIMARY"
+		}
+		rs.members = append(rs.members, memberStatus{
+			Name:       fmt.Sprintf("mongodb-%d.mongodb.default.svc.cluster.local:27017", i),
+			Health:     1,
+			State:      state,
+			StateStr:   stateStr,
+			OptimeDate: now,
+		})
+		rs.votes = append(rs.votes, 1)
+	}
+	return rs
+}
+
+func (rs *fakeReplicaSet) dial(addr string) (session, error) {
+	for i := range rs.members {
+		if addr == fmt.Sprintf("10.0.0.%d:27017", i+1) {
+			if rs.members[i].Health == 0 {
+				return nil, fmt.Errorf("connection refused")
+			}
+			return &fakeSession{rs: rs, self: i}, nil
+		}
+	}
+	return nil, fmt.Errorf("no reachable servers")
+}
+
+func (rs *fakeReplicaSet) set(i, state int, stateStr string) {
+	rs.members[i].State, rs.members[i].StateStr = state, stateStr
+}
+
+func (s *fakeSession) status() (*replSetStatus, error) {
+	status := &replSetStatus{Set: "rs0"}
+	for i, m := range s.rs.members {
+		m.Self = i == s.self
+		status.Members = append(status.Members, m)
+	}
+	return status, nil
+}
+
+func (s *fakeSession) config() (*replSetConfig, error) {
+	config := &replSetConfig{ID: "rs0"}
+	for i, m := range s.rs.members {
+		config.Members = append(config.Members, memberConfig{Host: m.Name, Votes: s.rs.votes[i]})
+	}
+	return config, nil
+}
+
+func (s *fakeSession) stepDown(seconds int) error {
+	if s.rs.members[s.self].State != statePrimary {
+		return fmt.Errorf("(NotWritablePrimary) not primary so can't step down")
+	}
+
+	s.rs.stepDowns++
+	s.rs.set(s.self, stateSecondary, "SECONDARY")
+	if s.rs.elect {
+		s.rs.set((s.self+1)%len(s.rs.members), statePrimary, "PRIMARY")
+	}
+
+	return nil
+}
+
+func (s *fakeSession) close() {}
+
+func pod(ordinal int) *v1.Pod {
+	return hookstest.Pod(mongodbStatefulSet, ordinal, fmt.Sprintf("10.0.0.%d", ordinal+1))
+}
+
+func newHook(t *testing.T, rs *fakeReplicaSet) *Hook {
+	var objs []runtime.Object
+	for i := range rs.members {
+		objs = append(objs, pod(i))
+	}
+
+	h, err := New(hookstest.NewFakeClient(objs...), mongodbStatefulSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.(*Hook).dial = rs.dial
+	return h.(*Hook)
+}
+
+func TestRollout(t *testing.T) {
+	rs := newFakeReplicaSet(3)
+	rs.elect = false
+	h := newHook(t, rs)
+
+	// Secondaries are restarted right away
+	if err := h.PodUpdateTransition(nil, pod(1)); err != nil {
+		t.Errorf("unexpected error before restarting a secondary: %v", err)
+	}
+
+	// The primary steps down, and is restarted once a new primary is elected
+	err := h.PodUpdateTransition(nil, pod(0))
+	if hooks.WaitReason(err) != ElectionReason || rs.stepDowns != 1 {
+		t.Fatalf("expected the primary to step down, got: %v", err)
+	}
+
+	err = h.PodUpdateTransition(nil, pod(0))
+	if hooks.WaitReason(err) != ElectionReason || !strings.HasSuffix(err.Error(), "replica set has no primary: waiting for a new primary") {
+		t.Errorf("expected to wait for an election, got: %v", err)
+	}
+	if rs.stepDowns != 1 {
+		t.Errorf("expected a single step down, got: %d", rs.stepDowns)
+	}
+
+	rs.set(2, statePrimary, "PRIMARY")
+	if err := h.PodUpdateTransition(pod(1), pod(0)); err != nil {
+		t.Errorf("unexpected error once a primary is elected: %v", err)
+	}
+
+	// mongodb-0 restarts
+	rs.set(0, stateRecovering, "RECOVERING")
+	err = h.PodUpdateTransition(pod(0), nil)
+	if err == nil || !strings.HasSuffix(err.Error(), "member is RECOVERING") {
+		t.Errorf("expected a recovering member error, got: %v", err)
+	}
+
+	rs.set(0, stateSecondary, "SECONDARY")
+	rs.members[0].OptimeDate = rs.members[2].OptimeDate.Add(-time.Minute)
+	err = h.PodUpdateTransition(pod(0), nil)
+	want := "member optime is 1m0s behind primary mongodb-2.mongodb.default.svc.cluster.local:27017"
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+
+	rs.members[0].OptimeDate = rs.members[2].OptimeDate.Add(-time.Second)
+	if err := h.PodUpdateTransition(pod(0), nil); err != nil {
+		t.Errorf("unexpected error once caught up: %v", err)
+	}
+}
+
+func TestMajority(t *testing.T) {
+	rs := newFakeReplicaSet(4)
+	// A non voting member's health doesn't matter
+	rs.votes[3] = 0
+	rs.members[3].Health, rs.members[3].State, rs.members[3].StateStr = 0, 8, "(not reachable/healthy)"
+	h := newHook(t, rs)
+
+	if err := h.PodUpdateTransition(nil, pod(1)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	rs.members[2].Health, rs.members[2].State, rs.members[2].StateStr = 0, 8, "(not reachable/healthy)"
+	err := h.PodUpdateTransition(nil, pod(1))
+	want := "the replica set would lose its majority without mongodb-1.mongodb.default.svc.cluster.local:27017: " +
+		"1 of 3 voting members would remain healthy, unhealthy: mongodb-2.mongodb.default.svc.cluster.local:27017"
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+
+	// The unhealthy member can be restarted: the other members are healthy
+	if err := h.PodUpdateTransition(nil, pod(2)); err != nil {
+		t.Errorf("unexpected error before restarting the unhealthy member: %v", err)
+	}
+
+	err = h.PodUpdateTransition(pod(2), nil)
+	if err == nil || !strings.Contains(err.Error(), "member isn't ready yet: connection refused") {
+		t.Errorf("expected the unhealthy member not to be ready, got: %v", err)
+	}
+}
+
+func TestUnknownMember(t *testing.T) {
+	rs := newFakeReplicaSet(1)
+	h := newHook(t, rs)
+
+	unknown := pod(0)
+	unknown.Name = "mongodb-7"
+	unknown.Status.PodIP = "10.0.0.8"
+	err := h.PodUpdateTransition(nil, unknown)
+	if err == nil || !strings.Contains(err.Error(), "no mongodb-7 member in the rs0 replica set") {
+		t.Errorf("expected an unknown member error, got: %v", err)
+	}
+}
+
+func TestFindMember(t *testing.T) {
+	status := &replSetStatus{Members: []memberStatus{{Name: "10.0.0.1:27017"}, {Name: "mongodb-1:27017"}, {Name: "mongodb-10.mongodb:27017"}}}
+
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		{"mongodb-0", "10.0.0.1", "10.0.0.1:27017"},
+		{"mongodb-1", "10.0.0.2", "mongodb-1:27017"},
+		{"mongodb-10", "", "mongodb-10.mongodb:27017"},
+		{"mongodb-2", "", ""},
+	}
+
+	for _, tt := range tests {
+		p := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: tt.name}, Status: v1.PodStatus{PodIP: tt.ip}}
+		got := ""
+		if m := findMember(status, p); m != nil {
+			got = m.Name
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %q member, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "mongodb", Namespace: "default"},
+		Data:       map[string][]byte{passwordKey: []byte("secret")},
+	}
+
+	tests := []struct {
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{DiscoveryAnnotation: hooks.DiscoveryDNS, MaxOptimeLagAnnotation: "1m"}, false},
+		{map[string]string{DiscoveryAnnotation: "srv"}, true},
+		{map[string]string{PortAnnotation: "mongodb"}, true},
+		{map[string]string{MaxOptimeLagAnnotation: "10"}, true},
+		{map[string]string{TimeoutAnnotation: "10"}, true},
+		{map[string]string{TimeoutAnnotation: "0s"}, true},
+		{map[string]string{TimeoutAnnotation: "-5s"}, true},
+		{map[string]string{CredentialsSecretAnnotation: "missing"}, true},
+		{map[string]string{CredentialsSecretAnnotation: "mongodb"}, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(hookstest.NewFakeClient(secret), hookstest.StatefulSet("mongodb", tt.annotations)); (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error: %v, got: %v", tt.annotations, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Member states, as reported by replSetGetStatus.
+const (
+	statePrimary    = 1
+	stateSecondary  = 2
+	stateRecovering = 3
+	stateArbiter    = 7
+)
+
+// memberStatus is a replica set member, as seen by the queried member.
+type memberStatus struct {
+	Name       string    `bson:"name"`
+	Health     float64   `bson:"health"`
+	State      int       `bson:"state"`
+	StateStr   string    `bson:"stateStr"`
+	OptimeDate time.Time `bson:"optimeDate"`
+	Self       bool      `bson:"self"`
+}
+
+type replSetStatus struct {
+	Set     string         `bson:"set"`
+	Members []memberStatus `bson:"members"`
+}
+
+// memberConfig is a replica set member's configuration.
+type memberConfig struct {
+	Host        string `bson:"host"`
+	ArbiterOnly bool   `bson:"arbiterOnly"`
+	Votes       int    `bson:"votes"`
+}
+
+type replSetConfig struct {
+	ID      string         `bson:"_id"`
+	Members []memberConfig `bson:"members"`
+}
+
+// session runs the replica set commands on a member.
+type session interface {
+	status() (*replSetStatus, error)
+	config() (*replSetConfig, error)
+	stepDown(seconds int) error
+	close()
+}
+
+// driverSession runs the commands with the mongo driver, connected to a single member.
+type driverSession struct {
+	client  *mongo.Client
+	timeout time.Duration
+}
+
+func (h *Hook) connect(addr string) (session, error) {
+	opts := options.Client().
+		ApplyURI(fmt.Sprintf("mongodb://%s/?connect=direct", addr)).
+		SetConnectTimeout(h.timeout).
+		SetServerSelectionTimeout(h.timeout)
+
+	if h.username != "" {
+		opts.SetAuth(options.Credential{Username: h.username, Password: h.password})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &driverSession{client: client, timeout: h.timeout}, nil
+}
+
+// run runs an admin command, and decodes its result into v (when not nil).
+func (s *driverSession) run(cmd bson.D, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	res := s.client.Database("admin").RunCommand(ctx, cmd)
+	if v == nil {
+		return res.Err()
+	}
+
+	return res.Decode(v)
+}
+
+func (s *driverSession) status() (*replSetStatus, error) {
+	status := &replSetStatus{}
+	if err := s.run(bson.D{{Key: "replSetGetStatus", Value: 1}}, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (s *driverSession) config() (*replSetConfig, error) {
+	res := struct {
+		Config replSetConfig `bson:"config"`
+	}{}
+	if err := s.run(bson.D{{Key: "replSetGetConfig", Value: 1}}, &res); err != nil {
+		return nil, err
+	}
+	return &res.Config, nil
+}
+
+func (s *driverSession) stepDown(seconds int) error {
+	return s.run(bson.D{{Key: "replSetStepDown", Value: seconds}}, nil)
+}
+
+func (s *driverSession) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	s.client.Disconnect(ctx)
+}
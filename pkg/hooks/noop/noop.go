@@ -2,12 +2,14 @@ package noop
 
 import (
 	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Hook struct{}
 
-func New() (hooks.STSRolloutHooks, error) {
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
 	return &Hook{}, nil
 }
 
@@ -0,0 +1,138 @@
+package patroni
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// Member roles and states, as reported by the /cluster endpoint. Patroni
+// versions before 2.0 named the leader's role "master".
+const (
+	RoleLeader        = "leader"
+	RoleMaster        = "master"
+	RoleStandbyLeader = "standby_leader"
+
+	StateRunning   = "running"
+	StateStreaming = "streaming"
+)
+
+// Lag is a replica's replication lag in bytes, or -1 when Patroni reports it as unknown.
+type Lag int64
+
+func (l *Lag) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*l = Lag(n)
+		return nil
+	}
+
+	// The lag is "unknown" while a replica isn't replicating
+	*l = -1
+	return nil
+}
+
+func (l Lag) String() string {
+	if l < 0 {
+		return "unknown"
+	}
+	return strconv.FormatInt(int64(l), 10)
+}
+
+type Member struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	State string `json:"state"`
+	Host  string `json:"host"`
+	Lag   Lag    `json:"lag"`
+}
+
+// isLeader tells whether the member is the (standby) cluster's leader.
+func (m *Member) isLeader() bool {
+	return m.Role == RoleLeader || m.Role == RoleMaster || m.Role == RoleStandbyLeader
+}
+
+// isReplicating tells whether the member is running, and replicates from the leader
+// with a lag of at most maxLag bytes.
+func (m *Member) isReplicating(maxLag int64) bool {
+	return (m.State == StateRunning || m.State == StateStreaming) && m.Lag >= 0 && int64(m.Lag) <= maxLag
+}
+
+func (m *Member) String() string {
+	if m.isLeader() {
+		return fmt.Sprintf("%s (%s, %s)", m.Name, m.Role, m.State)
+	}
+	return fmt.Sprintf("%s (%s, lag %s)", m.Name, m.State, m.Lag)
+}
+
+type Cluster struct {
+	Members []Member `json:"members"`
+}
+
+func (c *Cluster) member(name string) *Member {
+	for i := range c.Members {
+		if c.Members[i].Name == name {
+			return &c.Members[i]
+		}
+	}
+	return nil
+}
+
+type Switchover struct {
+	Leader string `json:"leader"`
+}
+
+func (h *Hook) url(pod *v1.Pod, path string) (string, error) {
+	addr, err := h.addr(pod)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s://%s%s", h.scheme, addr, path), nil
+}
+
+// cluster returns the cluster's members, as seen by the pod's Patroni.
+func (h *Hook) cluster(pod *v1.Pod) (*Cluster, error) {
+	url, err := h.url(pod, "/cluster")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.api.R().Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("/cluster http status code was %d for %s", resp.StatusCode(), pod.GetName())
+	}
+
+	cluster := &Cluster{}
+	if err := json.Unmarshal(resp.Body(), cluster); err != nil {
+		return nil, err
+	}
+
+	return cluster, nil
+}
+
+// switchover asks the pod's Patroni to move the leadership to a replica
+// (picked by Patroni), and returns once it's done.
+func (h *Hook) switchover(pod *v1.Pod) error {
+	url, err := h.url(pod, "/switchover")
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.api.R().SetBody(Switchover{Leader: pod.GetName()}).Post(url)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("/switchover http status code was %d: %s", resp.StatusCode(), strings.TrimSpace(resp.String()))
+	}
+
+	return nil
+}
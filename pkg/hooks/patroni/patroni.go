@@ -0,0 +1,248 @@
+package patroni
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	resty "gopkg.in/resty.v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// PortAnnotation is the Patroni REST api port (defaults to 8008).
+	PortAnnotation = hooks.AnnotationPrefix + "patroni-port"
+
+	// SchemeAnnotation is the Patroni REST api scheme: http (the default) or https.
+	SchemeAnnotation = hooks.AnnotationPrefix + "patroni-scheme"
+
+	// CredentialsSecretAnnotation names a Secret holding the "username" and
+	// "password" of the Patroni REST api basic auth (restapi.authentication),
+	// required by the switchovers.
+	CredentialsSecretAnnotation = hooks.AnnotationPrefix + "patroni-credentials-secret"
+
+	// MaxLagAnnotation is the number of bytes a replica can be behind the leader
+	// while being considered in sync (defaults to 1048576, like Patroni's
+	// maximum_lag_on_failover).
+	MaxLagAnnotation = hooks.AnnotationPrefix + "patroni-max-lag"
+
+	// TimeoutAnnotation is the Patroni REST api requests timeout, switchovers
+	// included (a duration, defaults to 30s).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "patroni-timeout"
+
+	defaultPort    = 8008
+	defaultMaxLag  = int64(1 << 20)
+	defaultTimeout = 30 * time.Second
+)
+
+const (
+	// SwitchoverReason is the retry reason once the next pod's leadership was
+	// moved to a replica.
+	SwitchoverReason = "Switchover"
+
+	usernameKey = "username"
+	passwordKey = "password"
+)
+
+// Hook restarts Patroni members one at a time: a member is only restarted when
+// the leader is running, and all the other replicas are in sync with it. When
+// the next member is the leader, its leadership is switched over to a replica
+// first. The next member waits until the restarted one is running or streaming
+// again, in sync with the leader.
+type Hook struct {
+	client client.Client
+	sts    *appsv1.StatefulSet
+	api    *resty.Client
+	scheme string
+	port   int
+	maxLag int64
+
+	// addr returns the host:port reaching a pod's Patroni
+	addr func(pod *v1.Pod) (string, error)
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		client: c,
+		sts:    sts,
+		scheme: "http",
+		port:   defaultPort,
+		maxLag: defaultMaxLag,
+	}
+
+	if val, ok := annotations[PortAnnotation]; ok {
+		port, err := strconv.Atoi(val)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", PortAnnotation, val)
+		}
+		h.port = port
+	}
+
+	h.addr = func(pod *v1.Pod) (string, error) {
+		return hooks.PodAddr(h.sts, pod, hooks.DiscoveryIP, h.port)
+	}
+
+	if val, ok := annotations[SchemeAnnotation]; ok {
+		if val != "http" && val != "https" {
+			return nil, fmt.Errorf("invalid %s annotation: %q", SchemeAnnotation, val)
+		}
+		h.scheme = val
+	}
+
+	if val, ok := annotations[MaxLagAnnotation]; ok {
+		lag, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || lag < 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", MaxLagAnnotation, val)
+		}
+		h.maxLag = lag
+	}
+
+	timeout := defaultTimeout
+	if val, ok := annotations[TimeoutAnnotation]; ok {
+		var err error
+		if timeout, err = time.ParseDuration(val); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", TimeoutAnnotation, val)
+		}
+	}
+
+	h.api = resty.New().SetTimeout(timeout)
+
+	if name, ok := annotations[CredentialsSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		username := string(secret.Data[usernameKey])
+		if username == "" {
+			return nil, fmt.Errorf("secret %s has no %s key", name, usernameKey)
+		}
+		h.api.SetBasicAuth(username, string(secret.Data[passwordKey]))
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "patroni"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil {
+		if err := h.afterUpdate(prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil {
+		if err := h.beforeUpdate(next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+// beforeUpdate checks the other members are in sync, and switches next's
+// leadership over to a replica when it's the leader.
+func (h *Hook) beforeUpdate(next *v1.Pod) error {
+	cluster, err := h.anyCluster(next)
+	if err != nil {
+		return err
+	}
+
+	member := cluster.member(next.GetName())
+	if member == nil {
+		return fmt.Errorf("no %s member in the patroni cluster", next.GetName())
+	}
+
+	var leader *Member
+	var issues []string
+	for i := range cluster.Members {
+		m := &cluster.Members[i]
+		switch {
+		case m.isLeader():
+			leader = m
+			if m.State != StateRunning {
+				issues = append(issues, m.String())
+			}
+		case m.Name != next.GetName() && !m.isReplicating(h.maxLag):
+			issues = append(issues, m.String())
+		}
+	}
+
+	if leader == nil {
+		return fmt.Errorf("the patroni cluster has no leader")
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("members aren't all in sync: %s", hooks.List(issues, ", "))
+	}
+
+	if member.isLeader() {
+		if err := h.switchover(next); err != nil {
+			return errors.Wrap(err, "switchover failed")
+		}
+		return hooks.Wait(SwitchoverReason, fmt.Errorf("member was the leader: waiting for the switchover"))
+	}
+
+	return nil
+}
+
+// afterUpdate waits until prev is running again, and in sync with the leader.
+func (h *Hook) afterUpdate(prev *v1.Pod) error {
+	cluster, err := h.cluster(prev)
+	if err != nil {
+		return errors.Wrap(err, "member isn't ready yet")
+	}
+
+	m := cluster.member(prev.GetName())
+	if m == nil {
+		return fmt.Errorf("member isn't part of the patroni cluster yet")
+	}
+
+	if m.isLeader() {
+		if m.State != StateRunning {
+			return fmt.Errorf("member isn't running yet: %s", m)
+		}
+		return nil
+	}
+
+	if !m.isReplicating(h.maxLag) {
+		return fmt.Errorf("member isn't in sync yet: %s", m)
+	}
+
+	return nil
+}
+
+// anyCluster returns the cluster's members, as seen by the first Patroni
+// answering (trying the given pod first).
+func (h *Hook) anyCluster(first *v1.Pod) (*Cluster, error) {
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []*v1.Pod{first}
+	for i := range pods {
+		if pods[i].GetName() != first.GetName() {
+			candidates = append(candidates, &pods[i])
+		}
+	}
+
+	for _, pod := range candidates {
+		var cluster *Cluster
+		if cluster, err = h.cluster(pod); err == nil {
+			return cluster, nil
+		}
+	}
+
+	return nil, errors.Wrap(err, "failed to query the patroni cluster")
+}
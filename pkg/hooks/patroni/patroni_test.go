@@ -0,0 +1,262 @@
+package patroni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var postgresStatefulSet = hookstest.StatefulSet("postgres", nil)
+
+// fakePatroni serves the Patroni REST api of the postgres-0 to postgres-n-1
+// members (whose ips are 10.0.0.1 to 10.0.0.n), each on its own 127.0.0.1 port.
+type fakePatroni struct {
+	addrs   hookstest.Addrs
+	servers []*httptest.Server
+
+	mu       sync.Mutex
+	members  []Member
+	down     map[string]bool
+	password string
+}
+
+func newFakePatroni(t *testing.T, n int) *fakePatroni {
+	f := &fakePatroni{addrs: hookstest.Addrs{}, down: make(map[string]bool), password: "secret"}
+
+	for i := 0; i < n; i++ {
+		p := pod(i)
+		host := p.Status.PodIP
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f.serve(host, w, r)
+		}))
+		srv.Listener.Close()
+		srv.Listener = f.addrs.Listen(t, p.GetName())
+		srv.Start()
+		f.servers = append(f.servers, srv)
+
+		m := Member{Name: p.GetName(), Role: "replica", State: StateStreaming, Host: host}
+		if i == 0 {
+			m.Role, m.State = RoleLeader, StateRunning
+		}
+		f.members = append(f.members, m)
+	}
+
+	return f
+}
+
+func (f *fakePatroni) close() {
+	for _, srv := range f.servers {
+		srv.Close()
+	}
+}
+
+func (f *fakePatroni) member(name string) *Member {
+	for i := range f.members {
+		if f.members[i].Name == name {
+			return &f.members[i]
+		}
+	}
+	return nil
+}
+
+func (f *fakePatroni) serve(host string, w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down[host] {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/cluster":
+		json.NewEncoder(w).Encode(map[string]interface{}{"members": f.members, "scope": "postgres"})
+
+	case r.Method == "POST" && r.URL.Path == "/switchover":
+		if _, password, _ := r.BasicAuth(); password != f.password {
+			http.Error(w, "no auth header received", http.StatusUnauthorized)
+			return
+		}
+
+		req := Switchover{}
+		json.NewDecoder(r.Body).Decode(&req)
+		leader := f.member(req.Leader)
+		if leader == nil || leader.Role != RoleLeader {
+			http.Error(w, "leader name does not match", http.StatusPreconditionFailed)
+			return
+		}
+
+		var candidate *Member
+		for i := range f.members {
+			m := &f.members[i]
+			if m.Role == "replica" && m.State == StateStreaming && (candidate == nil || m.Lag < candidate.Lag) {
+				candidate = m
+			}
+		}
+		if candidate == nil {
+			http.Error(w, "switchover is not possible: no good candidates have been found", http.StatusPreconditionFailed)
+			return
+		}
+
+		leader.Role, leader.State = "replica", StateStreaming
+		candidate.Role, candidate.State, candidate.Lag = RoleLeader, StateRunning, 0
+		fmt.Fprintf(w, "Successfully switched over to %q", candidate.Name)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func pod(ordinal int) *v1.Pod {
+	return hookstest.Pod(postgresStatefulSet, ordinal, fmt.Sprintf("10.0.0.%d", ordinal+1))
+}
+
+func newHook(t *testing.T, f *fakePatroni, annotations map[string]string) *Hook {
+	objs := []runtime.Object{
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "patroni", Namespace: "default"},
+			Data:       map[string][]byte{usernameKey: []byte("patroni"), passwordKey: []byte("secret")},
+		},
+	}
+	for i := range f.members {
+		objs = append(objs, pod(i))
+	}
+
+	h, err := New(hookstest.NewFakeClient(objs...), hookstest.StatefulSet("postgres", annotations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.(*Hook).addr = f.addrs.Addr
+
+	return h.(*Hook)
+}
+
+func TestRollout(t *testing.T) {
+	f := newFakePatroni(t, 3)
+	defer f.close()
+	f.members[2].Lag = 2048
+	h := newHook(t, f, map[string]string{CredentialsSecretAnnotation: "patroni"})
+
+	// Replicas are restarted right away
+	if err := h.PodUpdateTransition(nil, pod(2)); err != nil {
+		t.Errorf("unexpected error before restarting a replica: %v", err)
+	}
+
+	// postgres-2 restarts
+	f.members[2].State, f.members[2].Lag = "starting", -1
+	err := h.PodUpdateTransition(pod(2), pod(0))
+	if err == nil || !strings.HasSuffix(err.Error(), "member isn't in sync yet: postgres-2 (starting, lag unknown)") {
+		t.Errorf("expected a starting member error, got: %v", err)
+	}
+
+	f.members[2].State, f.members[2].Lag = StateStreaming, 0
+
+	// The leader is restarted once its leadership was switched over
+	err = h.PodUpdateTransition(pod(2), pod(0))
+	if hooks.WaitReason(err) != SwitchoverReason {
+		t.Fatalf("expected a switchover, got: %v", err)
+	}
+	if f.members[0].Role != "replica" || f.members[1].Role != RoleLeader {
+		t.Errorf("expected postgres-1 to be the leader, got: %v", f.members)
+	}
+
+	if err := h.PodUpdateTransition(pod(2), pod(0)); err != nil {
+		t.Errorf("unexpected error once switched over: %v", err)
+	}
+}
+
+func TestLag(t *testing.T) {
+	f := newFakePatroni(t, 3)
+	defer f.close()
+	h := newHook(t, f, map[string]string{MaxLagAnnotation: "1024"})
+
+	f.members[2].Lag = 4096
+	err := h.PodUpdateTransition(nil, pod(1))
+	want := "members aren't all in sync: postgres-2 (streaming, lag 4096)"
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+
+	// The lagging member can be restarted, but not the leader
+	if err := h.PodUpdateTransition(nil, pod(2)); err != nil {
+		t.Errorf("unexpected error before restarting the lagging member: %v", err)
+	}
+	err = h.PodUpdateTransition(nil, pod(0))
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+
+	// Members are found through any Patroni answering
+	f.members[2].Lag = 0
+	f.down["10.0.0.2"] = true
+	if err := h.PodUpdateTransition(nil, pod(1)); err != nil {
+		t.Errorf("unexpected error before restarting a down member: %v", err)
+	}
+	err = h.PodUpdateTransition(pod(1), nil)
+	if err == nil || !strings.Contains(err.Error(), "member isn't ready yet") {
+		t.Errorf("expected a down member error, got: %v", err)
+	}
+}
+
+func TestSwitchoverFailure(t *testing.T) {
+	f := newFakePatroni(t, 2)
+	defer f.close()
+
+	// Switchovers are refused without credentials
+	h := newHook(t, f, map[string]string{})
+	err := h.PodUpdateTransition(nil, pod(0))
+	if err == nil || !strings.Contains(err.Error(), "switchover failed: /switchover http status code was 401") {
+		t.Errorf("expected an unauthorized error, got: %v", err)
+	}
+
+	// Or without a replica to take over
+	h = newHook(t, f, map[string]string{CredentialsSecretAnnotation: "patroni"})
+	f.members[1].State = StateRunning
+	err = h.PodUpdateTransition(nil, pod(0))
+	if err == nil || !strings.Contains(err.Error(), "no good candidates have been found") {
+		t.Errorf("expected a switchover error, got: %v", err)
+	}
+}
+
+func TestLagUnmarshal(t *testing.T) {
+	var m Member
+	if err := json.Unmarshal([]byte(`{"name": "postgres-1", "lag": "unknown"}`), &m); err != nil || m.Lag != -1 {
+		t.Errorf("expected an unknown lag, got: %v (%v)", m.Lag, err)
+	}
+	if err := json.Unmarshal([]byte(`{"name": "postgres-1", "lag": 1024}`), &m); err != nil || m.Lag != 1024 {
+		t.Errorf("expected a 1024 lag, got: %v (%v)", m.Lag, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{SchemeAnnotation: "https", MaxLagAnnotation: "0"}, false},
+		{map[string]string{SchemeAnnotation: "ftp"}, true},
+		{map[string]string{PortAnnotation: "patroni"}, true},
+		{map[string]string{MaxLagAnnotation: "1MB"}, true},
+		{map[string]string{TimeoutAnnotation: "10"}, true},
+		{map[string]string{TimeoutAnnotation: "0s"}, true},
+		{map[string]string{TimeoutAnnotation: "-5s"}, true},
+		{map[string]string{CredentialsSecretAnnotation: "missing"}, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(hookstest.NewFakeClient(), hookstest.StatefulSet("postgres", tt.annotations)); (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error: %v, got: %v", tt.annotations, tt.wantErr, err)
+		}
+	}
+}
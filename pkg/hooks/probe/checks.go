@@ -0,0 +1,164 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	resty "gopkg.in/resty.v1"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+type jsonPathAssertion struct {
+	expr     string
+	path     *jsonpath.JSONPath
+	expected string
+}
+
+type httpProber struct {
+	client     *resty.Client
+	scheme     string
+	path       string
+	status     int
+	regex      *regexp.Regexp
+	assertions []jsonPathAssertion
+}
+
+func newHTTPProber(check Check, timeout time.Duration) (*httpProber, error) {
+	p := &httpProber{
+		client: resty.New().
+			SetTimeout(timeout).
+			SetTLSClientConfig(&tls.Config{InsecureSkipVerify: check.InsecureSkipVerify}),
+		scheme: check.Scheme,
+		path:   check.Path,
+		status: check.Status,
+	}
+
+	if p.scheme == "" {
+		p.scheme = "http"
+	}
+	if p.status == 0 {
+		p.status = 200
+	}
+	if !strings.HasPrefix(p.path, "/") {
+		p.path = "/" + p.path
+	}
+
+	if check.Regex != "" {
+		var err error
+		if p.regex, err = regexp.Compile(check.Regex); err != nil {
+			return nil, errors.Wrap(err, "invalid regex")
+		}
+	}
+
+	for expr, expected := range check.JSONPath {
+		path := jsonpath.New(expr)
+		tmpl := expr
+		if !strings.HasPrefix(tmpl, "{") {
+			tmpl = "{" + tmpl + "}"
+		}
+		if err := path.Parse(tmpl); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid jsonpath %s", expr))
+		}
+		p.assertions = append(p.assertions, jsonPathAssertion{expr, path, expected})
+	}
+
+	return p, nil
+}
+
+func (p *httpProber) probe(address, host string) error {
+	url := fmt.Sprintf("%s://%s%s", p.scheme, address, p.path)
+	resp, err := p.client.R().Get(url)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != p.status {
+		return fmt.Errorf("%s http status code was %d, expected %d", url, resp.StatusCode(), p.status)
+	}
+
+	if p.regex != nil && !p.regex.Match(resp.Body()) {
+		return fmt.Errorf("%s body doesn't match %s", url, p.regex.String())
+	}
+
+	if len(p.assertions) == 0 {
+		return nil
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(resp.Body(), &data); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("%s body isn't json", url))
+	}
+
+	for _, a := range p.assertions {
+		var buf bytes.Buffer
+		if err := a.path.Execute(&buf, data); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("%s: jsonpath %s failed", url, a.expr))
+		}
+		if buf.String() != a.expected {
+			return fmt.Errorf("%s: jsonpath %s is %q, expected %q", url, a.expr, buf.String(), a.expected)
+		}
+	}
+
+	return nil
+}
+
+type tcpProber struct {
+	timeout time.Duration
+}
+
+func (p *tcpProber) probe(address, host string) error {
+	conn, err := net.DialTimeout("tcp", address, p.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// grpcProber uses the grpc.health.v1 protocol.
+type grpcProber struct {
+	service  string
+	tls      bool
+	insecure bool
+	timeout  time.Duration
+}
+
+func (p *grpcProber) probe(address, host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	creds := grpc.WithInsecure()
+	if p.tls {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: p.insecure,
+		}))
+	}
+
+	conn, err := grpc.DialContext(ctx, address, creds, grpc.WithBlock())
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to connect to %s", address))
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: p.service})
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("health check failed on %s", address))
+	}
+
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("%s service %q status is %s", address, p.service, resp.GetStatus())
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package probe
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// ProbesAnnotation holds the list of checks, as YAML or JSON.
+	ProbesAnnotation = hooks.AnnotationPrefix + "probes"
+
+	defaultTimeout = 10 * time.Second
+)
+
+const (
+	// ScopePod checks the updated pod, once it's running the new revision.
+	ScopePod = "pod"
+
+	// ScopePeers checks all the pods but the one we're about to update.
+	ScopePeers = "peers"
+
+	// ScopeStatefulSet checks all the statefulset pods.
+	ScopeStatefulSet = "statefulset"
+)
+
+// Check describes a network probe.
+type Check struct {
+	// Type is one of http, tcp or grpc.
+	Type string `json:"type"`
+
+	// Scope is one of pod (the default), peers or statefulset.
+	Scope string `json:"scope,omitempty"`
+
+	// Target is one of ip (the default) or dns.
+	Target string `json:"target,omitempty"`
+
+	Port    int    `json:"port"`
+	Timeout string `json:"timeout,omitempty"`
+
+	// HTTP checks settings. Status defaults to 200.
+	Scheme             string            `json:"scheme,omitempty"`
+	Path               string            `json:"path,omitempty"`
+	Status             int               `json:"status,omitempty"`
+	JSONPath           map[string]string `json:"jsonPath,omitempty"`
+	Regex              string            `json:"regex,omitempty"`
+	InsecureSkipVerify bool              `json:"insecureSkipVerify,omitempty"`
+
+	// gRPC checks settings: the grpc.health.v1 service name (empty for the server).
+	Service string `json:"service,omitempty"`
+	TLS     bool   `json:"tls,omitempty"`
+}
+
+// prober runs a check against a host:port.
+type prober interface {
+	probe(address, host string) error
+}
+
+type probe struct {
+	Check
+	prober
+}
+
+// Hook checks pods network endpoints are healthy between pods updates.
+type Hook struct {
+	client client.Client
+	sts    *appsv1.StatefulSet
+	probes []probe
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	spec, ok := sts.GetAnnotations()[ProbesAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("missing %s annotation", ProbesAnnotation)
+	}
+
+	checks := make([]Check, 0)
+	decoder := yaml.NewYAMLOrJSONDecoder(strings.NewReader(spec), len(spec))
+	if err := decoder.Decode(&checks); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", ProbesAnnotation))
+	}
+
+	h := &Hook{
+		client: c,
+		sts:    sts,
+	}
+
+	for i, check := range checks {
+		p, err := newProbe(check)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid check #%d in %s annotation", i, ProbesAnnotation))
+		}
+		h.probes = append(h.probes, p)
+	}
+
+	return h, nil
+}
+
+func newProbe(check Check) (probe, error) {
+	if check.Scope == "" {
+		check.Scope = ScopePod
+	}
+	if check.Target == "" {
+		check.Target = hooks.DiscoveryIP
+	}
+
+	switch check.Scope {
+	case ScopePod, ScopePeers, ScopeStatefulSet:
+	default:
+		return probe{}, fmt.Errorf("unsupported scope: %s", check.Scope)
+	}
+
+	switch check.Target {
+	case hooks.DiscoveryIP, hooks.DiscoveryDNS:
+	default:
+		return probe{}, fmt.Errorf("unsupported target: %s", check.Target)
+	}
+
+	if check.Port <= 0 {
+		return probe{}, fmt.Errorf("missing port")
+	}
+
+	timeout := defaultTimeout
+	if check.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(check.Timeout); err != nil {
+			return probe{}, errors.Wrap(err, "invalid timeout")
+		}
+	}
+
+	var p prober
+	var err error
+	switch check.Type {
+	case "http":
+		p, err = newHTTPProber(check, timeout)
+	case "tcp":
+		p = &tcpProber{timeout: timeout}
+	case "grpc":
+		p = &grpcProber{service: check.Service, tls: check.TLS,
+			insecure: check.InsecureSkipVerify, timeout: timeout}
+	default:
+		err = fmt.Errorf("unsupported check type: %s", check.Type)
+	}
+
+	return probe{Check: check, prober: p}, err
+}
+
+func (h *Hook) Name() string {
+	return "probe"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	var pods []v1.Pod
+
+	for _, p := range h.probes {
+		var targets []*v1.Pod
+
+		switch p.Scope {
+		case ScopePod:
+			// prev may be nil when we're starting a rollout
+			if prev != nil {
+				targets = append(targets, prev)
+			}
+
+		case ScopePeers, ScopeStatefulSet:
+			if pods == nil {
+				var err error
+				if pods, err = hooks.ListPods(h.client, h.sts); err != nil {
+					return err
+				}
+			}
+			for i := range pods {
+				if p.Scope == ScopePeers && next != nil && pods[i].GetName() == next.GetName() {
+					continue
+				}
+				targets = append(targets, &pods[i])
+			}
+		}
+
+		for _, pod := range targets {
+			if err := h.run(p, pod); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("%s %s check failed, pod: %s", p.Scope, p.Type, pod.GetName()))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (h *Hook) run(p probe, pod *v1.Pod) error {
+	host, err := hooks.PodHost(h.sts, pod, p.Target)
+	if err != nil {
+		return err
+	}
+
+	return p.probe(net.JoinHostPort(host, strconv.Itoa(p.Port)), host)
+}
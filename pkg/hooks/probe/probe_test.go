@@ -0,0 +1,193 @@
+package probe
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func pod(name, ip string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{"app": "db"},
+		},
+		Status: v1.PodStatus{PodIP: ip},
+	}
+}
+
+func newHook(t *testing.T, probes string) *Hook {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "default",
+			Annotations: map[string]string{ProbesAnnotation: probes},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+		},
+	}
+
+	// db-1 has an address nothing listens on
+	c := hookstest.NewFakeClient(pod("db-0", "127.0.0.1"), pod("db-1", "127.0.0.2"))
+
+	h, err := New(c, sts)
+	if err != nil {
+		t.Fatalf("failed to create hook: %v", err)
+	}
+
+	return h.(*Hook)
+}
+
+func port(t *testing.T, addr string) string {
+	_, p, err := net.SplitHostPort(strings.TrimPrefix(addr, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHTTPCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"status":"green","nodes":{"count":3}}`)
+	}))
+	defer srv.Close()
+	p := port(t, srv.URL)
+
+	tests := []struct {
+		name    string
+		probes  string
+		wantErr bool
+	}{
+		{"status", `[{"type":"http","port":` + p + `,"path":"/health"}]`, false},
+		{"wrong status", `[{"type":"http","port":` + p + `,"path":"/nope"}]`, true},
+		{"expected status", `[{"type":"http","port":` + p + `,"path":"/nope","status":404}]`, false},
+		{"regex", `[{"type":"http","port":` + p + `,"path":"/health","regex":"\"status\":\"(green|yellow)\""}]`, false},
+		{"regex mismatch", `[{"type":"http","port":` + p + `,"path":"/health","regex":"red"}]`, true},
+		{"jsonpath", `
+- type: http
+  port: ` + p + `
+  path: /health
+  jsonPath:
+    "{.status}": green
+    ".nodes.count": "3"`, false},
+		{"jsonpath mismatch", `[{"type":"http","port":` + p + `,"path":"/health","jsonPath":{"{.nodes.count}":"2"}}]`, true},
+	}
+
+	for _, tt := range tests {
+		h := newHook(t, tt.probes)
+		err := h.PodUpdateTransition(pod("db-0", "127.0.0.1"), nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: PodUpdateTransition() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTCPCheckScopes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	p := port(t, ln.Addr().String())
+
+	tests := []struct {
+		name    string
+		scope   string
+		prev    *v1.Pod
+		next    *v1.Pod
+		wantErr bool
+	}{
+		{"updated pod", ScopePod, pod("db-0", "127.0.0.1"), nil, false},
+		{"starting rollout", ScopePod, nil, pod("db-1", "127.0.0.2"), false},
+		{"updated pod unreachable", ScopePod, pod("db-1", "127.0.0.2"), pod("db-0", "127.0.0.1"), true},
+		{"updated pod without ip yet", ScopePod, pod("db-0", ""), nil, true},
+		{"peers of the next pod", ScopePeers, nil, pod("db-1", "127.0.0.2"), false},
+		{"peers with one unreachable", ScopePeers, nil, pod("db-0", "127.0.0.1"), true},
+		{"whole statefulset", ScopeStatefulSet, pod("db-0", "127.0.0.1"), pod("db-1", "127.0.0.2"), true},
+	}
+
+	for _, tt := range tests {
+		h := newHook(t, `[{"type":"tcp","scope":"`+tt.scope+`","port":`+p+`}]`)
+		err := h.PodUpdateTransition(tt.prev, tt.next)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: PodUpdateTransition() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGRPCCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := health.NewServer()
+	hs.SetServingStatus("db.Replication", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("db.Backup", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(ln)
+	defer srv.Stop()
+	p := port(t, ln.Addr().String())
+
+	tests := []struct {
+		service string
+		wantErr bool
+	}{
+		{"", false},
+		{"db.Replication", false},
+		{"db.Backup", true},
+		{"db.Unknown", true},
+	}
+
+	for _, tt := range tests {
+		h := newHook(t, `[{"type":"grpc","port":`+p+`,"service":"`+tt.service+`","timeout":"2s"}]`)
+		err := h.PodUpdateTransition(pod("db-0", "127.0.0.1"), nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("service %q: PodUpdateTransition() error = %v, wantErr %v", tt.service, err, tt.wantErr)
+		}
+	}
+}
+
+func TestInvalidChecks(t *testing.T) {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db"}}
+	for _, probes := range []string{
+		`not a list`,
+		`[{"type":"udp","port":53}]`,
+		`[{"type":"tcp"}]`,
+		`[{"type":"tcp","port":53,"scope":"cluster"}]`,
+		`[{"type":"http","port":80,"regex":"("}]`,
+	} {
+		sts.Annotations = map[string]string{ProbesAnnotation: probes}
+		if _, err := New(nil, sts); err == nil {
+			t.Errorf("New() should fail for %s", probes)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	resty "gopkg.in/resty.v1"
+)
+
+type PromResponse struct {
+	Status string   `json:"status"`
+	Error  string   `json:"error"`
+	Data   PromData `json:"data"`
+}
+
+type PromData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+type PromSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value"`
+}
+
+// Query evaluates expr at the current time, and returns the samples values.
+// Scalar results are returned as a single value, vectors as one value per series.
+func Query(client *resty.Client, url, expr string) ([]float64, error) {
+	resp, err := client.R().
+		SetQueryParam("query", expr).
+		Get(fmt.Sprintf("%s/api/v1/query", url))
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := PromResponse{}
+	if err := json.Unmarshal(resp.Body(), &m); err != nil {
+		return nil, fmt.Errorf("can't decode /api/v1/query response (http status %d): %v",
+			resp.StatusCode(), err)
+	}
+
+	if m.Status != "success" {
+		return nil, fmt.Errorf("/api/v1/query failed (http status %d): %s",
+			resp.StatusCode(), m.Error)
+	}
+
+	switch m.Data.ResultType {
+	case "scalar":
+		var pair []interface{}
+		if err := json.Unmarshal(m.Data.Result, &pair); err != nil {
+			return nil, err
+		}
+		val, err := sampleValue(pair)
+		if err != nil {
+			return nil, err
+		}
+		return []float64{val}, nil
+
+	case "vector":
+		samples := make([]PromSample, 0)
+		if err := json.Unmarshal(m.Data.Result, &samples); err != nil {
+			return nil, err
+		}
+		values := make([]float64, 0, len(samples))
+		for _, s := range samples {
+			val, err := sampleValue(s.Value)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, val)
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("unsupported query result type: %s", m.Data.ResultType)
+}
+
+// sampleValue decodes a [<timestamp>, "<value>"] pair.
+func sampleValue(pair []interface{}) (float64, error) {
+	if len(pair) != 2 {
+		return 0, fmt.Errorf("malformed sample: %v", pair)
+	}
+
+	str, ok := pair[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("malformed sample value: %v", pair[1])
+	}
+
+	return strconv.ParseFloat(str, 64)
+}
@@ -0,0 +1,108 @@
+package prometheus
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	resty "gopkg.in/resty.v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// URLAnnotation is the Prometheus API base url (eg. http://prometheus:9090).
+	URLAnnotation = hooks.AnnotationPrefix + "prometheus-url"
+
+	// BeforeAnnotation is the PromQL expression evaluated before updating a pod.
+	BeforeAnnotation = hooks.AnnotationPrefix + "prometheus-before"
+
+	// AfterAnnotation is the PromQL expression evaluated after a pod was updated.
+	AfterAnnotation = hooks.AnnotationPrefix + "prometheus-after"
+
+	timeout = time.Duration(30 * time.Second)
+)
+
+// Hook gates pods updates on PromQL expressions. An expression returning
+// an empty result, or any zero value, postpones the update.
+type Hook struct {
+	url    string
+	before *template.Template
+	after  *template.Template
+	client *resty.Client
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	url, ok := annotations[URLAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("missing %s annotation", URLAnnotation)
+	}
+
+	h := &Hook{
+		url: strings.TrimSuffix(url, "/"),
+		client: resty.New().
+			SetRetryCount(3).
+			SetTimeout(timeout),
+	}
+
+	var err error
+	if h.before, err = hooks.ParseTemplate(annotations, BeforeAnnotation); err != nil {
+		return nil, err
+	}
+	if h.after, err = hooks.ParseTemplate(annotations, AfterAnnotation); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "prometheus"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil && h.after != nil {
+		if err := h.check(h.after, prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil && h.before != nil {
+		if err := h.check(h.before, next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+func (h *Hook) check(tmpl *template.Template, pod *v1.Pod) error {
+	expr, err := hooks.Render(tmpl, pod)
+	if err != nil {
+		return err
+	}
+
+	values, err := Query(h.client, h.url, expr)
+	if err != nil {
+		return errors.Wrap(err, "prometheus query failed")
+	}
+
+	if len(values) == 0 {
+		return fmt.Errorf("empty result for query: %s", expr)
+	}
+
+	for _, val := range values {
+		if val == 0 {
+			return fmt.Errorf("zero result for query: %s", expr)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// stubPrometheus answers /api/v1/query with canned results, indexed by query.
+func stubPrometheus(t *testing.T, results map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" {
+			http.NotFound(w, r)
+			return
+		}
+
+		q := r.URL.Query().Get("query")
+		res, ok := results[q]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status": "error",
+				"error":  "unexpected query: " + q,
+			})
+			return
+		}
+
+		resultType := "vector"
+		if _, ok := res.([]interface{}); ok {
+			resultType = "scalar"
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": resultType,
+				"result":     res,
+			},
+		})
+	}))
+}
+
+func vector(values ...string) []map[string]interface{} {
+	samples := make([]map[string]interface{}, 0)
+	for _, v := range values {
+		samples = append(samples, map[string]interface{}{
+			"metric": map[string]string{},
+			"value":  []interface{}{1535000000.0, v},
+		})
+	}
+	return samples
+}
+
+func newHook(t *testing.T, url, before, after string) *Hook {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kafka",
+			Namespace: "default",
+			Annotations: map[string]string{
+				URLAnnotation:    url,
+				BeforeAnnotation: before,
+				AfterAnnotation:  after,
+			},
+		},
+	}
+
+	h, err := New(nil, sts)
+	if err != nil {
+		t.Fatalf("failed to create hook: %v", err)
+	}
+
+	return h.(*Hook)
+}
+
+func pod(name string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+}
+
+func TestPodUpdateTransition(t *testing.T) {
+	srv := stubPrometheus(t, map[string]interface{}{
+		`lag{pod="kafka-2",namespace="default"} < 10`:  vector("3"),
+		`lag{pod="kafka-1",namespace="default"} < 10`:  vector(),
+		`up{statefulset="kafka",ordinal="1"}`:          vector("1", "1"),
+		`up{statefulset="kafka",ordinal="0"}`:          vector("1", "0"),
+		`scalar(under_replicated{pod="kafka-2"}) == 0`: []interface{}{1535000000.0, "1"},
+		`scalar(under_replicated{pod="kafka-1"}) == 0`: []interface{}{1535000000.0, "0"},
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		before  string
+		after   string
+		prev    *v1.Pod
+		next    *v1.Pod
+		wantErr bool
+	}{
+		{"starting rollout", `lag{pod="{{.Pod}}",namespace="{{.Namespace}}"} < 10`, "",
+			nil, pod("kafka-2"), false},
+		{"empty result", `lag{pod="{{.Pod}}",namespace="{{.Namespace}}"} < 10`, "",
+			nil, pod("kafka-1"), true},
+		{"after update", "", `up{statefulset="{{.StatefulSet}}",ordinal="{{.Ordinal}}"}`,
+			pod("kafka-1"), nil, false},
+		{"zero in vector", "", `up{statefulset="{{.StatefulSet}}",ordinal="{{.Ordinal}}"}`,
+			pod("kafka-0"), nil, true},
+		{"scalar", `scalar(under_replicated{pod="{{.Pod}}"}) == 0`, "",
+			nil, pod("kafka-2"), false},
+		{"zero scalar", `scalar(under_replicated{pod="{{.Pod}}"}) == 0`, "",
+			pod("kafka-2"), pod("kafka-1"), true},
+		{"query error", `nonexistent`, "",
+			nil, pod("kafka-2"), true},
+		{"no expression", "", "",
+			pod("kafka-2"), pod("kafka-1"), false},
+	}
+
+	for _, tt := range tests {
+		h := newHook(t, srv.URL, tt.before, tt.after)
+		err := h.PodUpdateTransition(tt.prev, tt.next)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: PodUpdateTransition() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "kafka"}}
+	if _, err := New(nil, sts); err == nil {
+		t.Error("New() should fail without an url annotation")
+	}
+
+	sts.Annotations = map[string]string{
+		URLAnnotation:    "http://prometheus:9090",
+		BeforeAnnotation: "up{pod=\"{{.Pod\"}",
+	}
+	if _, err := New(nil, sts); err == nil {
+		t.Error("New() should fail with an invalid template")
+	}
+}
@@ -0,0 +1,82 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// Node is a cluster node, as listed by /api/nodes. Nodes in maintenance
+// mode (RabbitMQ 3.8.8 and later) are being drained.
+type Node struct {
+	Name         string `json:"name"`
+	Running      bool   `json:"running"`
+	BeingDrained bool   `json:"being_drained"`
+}
+
+// Queue is a queue, as listed by /api/queues. Quorum queues and streams
+// have replicas: their members, and the members online.
+type Queue struct {
+	Name    string   `json:"name"`
+	VHost   string   `json:"vhost"`
+	Type    string   `json:"type"`
+	Members []string `json:"members"`
+	Online  []string `json:"online"`
+}
+
+// CriticalQueue is a queue that would lose its quorum without a node.
+type CriticalQueue struct {
+	Name        string `json:"name"`
+	VirtualHost string `json:"virtual_host"`
+	Type        string `json:"type"`
+}
+
+// HealthCheck is a /api/health/checks result, whose status is "ok" or "failed".
+type HealthCheck struct {
+	Status string          `json:"status"`
+	Reason string          `json:"reason"`
+	Queues []CriticalQueue `json:"queues"`
+}
+
+func (h *Hook) url(pod *v1.Pod, path string) (string, error) {
+	addr, err := h.addr(pod)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s://%s%s", h.scheme, addr, path), nil
+}
+
+// get queries the pod's management api, and decodes the json response into v.
+// The health checks report their failures with a 503 status code, so the status
+// code is returned, and non 200 responses are decoded too.
+func (h *Hook) get(pod *v1.Pod, path string, v interface{}) (int, error) {
+	url, err := h.url(pod, path)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := h.api.R().Get(url)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := json.Unmarshal(resp.Body(), v); err != nil && resp.StatusCode() == 200 {
+		return 0, err
+	}
+
+	return resp.StatusCode(), nil
+}
+
+// findNode returns the pod's node, whose host can be the pod name, or a DNS name starting with it
+// (eg. rabbit@rabbitmq-0.rabbitmq-nodes.default).
+func findNode(nodes []Node, pod *v1.Pod) *Node {
+	for i, n := range nodes {
+		host := n.Name[strings.Index(n.Name, "@")+1:]
+		if host == pod.GetName() || strings.HasPrefix(host, pod.GetName()+".") {
+			return &nodes[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/exec"
+	"github.com/pkg/errors"
+	resty "gopkg.in/resty.v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// PortAnnotation is the management api port (defaults to 15672).
+	PortAnnotation = hooks.AnnotationPrefix + "rabbitmq-port"
+
+	// SchemeAnnotation is the management api scheme: http (the default) or https.
+	SchemeAnnotation = hooks.AnnotationPrefix + "rabbitmq-scheme"
+
+	// CredentialsSecretAnnotation names a Secret holding the "username" and
+	// "password" of a management api user (with the monitoring tag).
+	CredentialsSecretAnnotation = hooks.AnnotationPrefix + "rabbitmq-credentials-secret"
+
+	// MaintenanceAnnotation, when "true", puts the nodes into maintenance mode
+	// before their restart, with rabbitmq-upgrade drain (RabbitMQ 3.8.8 and later).
+	MaintenanceAnnotation = hooks.AnnotationPrefix + "rabbitmq-maintenance"
+
+	// ContainerAnnotation is the container running rabbitmq-upgrade (defaults to the first one).
+	ContainerAnnotation = hooks.AnnotationPrefix + "rabbitmq-container"
+
+	// TimeoutAnnotation is the management api requests timeout (a duration, defaults to 30s).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "rabbitmq-timeout"
+
+	defaultPort    = 15672
+	defaultTimeout = 30 * time.Second
+)
+
+const (
+	usernameKey = "username"
+	passwordKey = "password"
+)
+
+// Hook restarts RabbitMQ nodes one at a time: a node is only restarted when it's not
+// quorum critical (when no quorum queue or stream would lose its quorum without it),
+// and it's optionally put into maintenance mode before its restart. The next node
+// waits until the restarted one is running, and all the quorum queues and streams
+// members are online again.
+type Hook struct {
+	api         *resty.Client
+	scheme      string
+	port        int
+	maintenance bool
+	exec        func(pod *v1.Pod, command []string) error
+
+	// addr returns the host:port reaching a pod's management api
+	addr func(pod *v1.Pod) (string, error)
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		scheme: "http",
+		port:   defaultPort,
+	}
+
+	if val, ok := annotations[PortAnnotation]; ok {
+		port, err := strconv.Atoi(val)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", PortAnnotation, val)
+		}
+		h.port = port
+	}
+
+	h.addr = func(pod *v1.Pod) (string, error) {
+		return hooks.PodAddr(sts, pod, hooks.DiscoveryIP, h.port)
+	}
+
+	if val, ok := annotations[SchemeAnnotation]; ok {
+		if val != "http" && val != "https" {
+			return nil, fmt.Errorf("invalid %s annotation: %q", SchemeAnnotation, val)
+		}
+		h.scheme = val
+	}
+
+	if val, ok := annotations[MaintenanceAnnotation]; ok {
+		var err error
+		if h.maintenance, err = strconv.ParseBool(val); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %q", MaintenanceAnnotation, val)
+		}
+	}
+
+	timeout := defaultTimeout
+	if val, ok := annotations[TimeoutAnnotation]; ok {
+		var err error
+		if timeout, err = time.ParseDuration(val); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", TimeoutAnnotation, val)
+		}
+	}
+
+	h.api = resty.New().SetTimeout(timeout)
+
+	if name, ok := annotations[CredentialsSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		username := string(secret.Data[usernameKey])
+		if username == "" {
+			return nil, fmt.Errorf("secret %s has no %s key", name, usernameKey)
+		}
+		h.api.SetBasicAuth(username, string(secret.Data[passwordKey]))
+	}
+
+	if h.maintenance {
+		cfg, err := hooks.RestConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		container := annotations[ContainerAnnotation]
+		h.exec = func(pod *v1.Pod, command []string) error {
+			_, err := exec.Run(cfg, pod, container, command)
+			return err
+		}
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "rabbitmq"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil {
+		if err := h.afterUpdate(prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil {
+		if err := h.beforeUpdate(next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+// beforeUpdate checks next isn't quorum critical, and puts it into maintenance mode.
+func (h *Hook) beforeUpdate(next *v1.Pod) error {
+	check := HealthCheck{}
+	status, err := h.get(next, "/api/health/checks/node-is-quorum-critical", &check)
+	if err != nil {
+		// A node that's down isn't part of any quorum
+		if !hooks.PodReady(next) {
+			return nil
+		}
+		return errors.Wrap(err, "quorum critical check failed")
+	}
+
+	switch {
+	case status == 200:
+	case status == 503 && check.Status == "failed":
+		var queues []string
+		for _, q := range check.Queues {
+			queues = append(queues, fmt.Sprintf("%s %s (vhost %s)", q.Type, q.Name, q.VirtualHost))
+		}
+		return fmt.Errorf("node is quorum critical for %d queues: %s", len(queues), hooks.List(queues, ", "))
+	default:
+		return fmt.Errorf("quorum critical check http status code was %d", status)
+	}
+
+	if h.maintenance {
+		if err := h.exec(next, []string{"rabbitmq-upgrade", "drain"}); err != nil {
+			return errors.Wrap(err, "drain failed")
+		}
+	}
+
+	return nil
+}
+
+// afterUpdate waits until prev is running, and all the quorum queues and streams members are online.
+func (h *Hook) afterUpdate(prev *v1.Pod) error {
+	var nodes []Node
+	status, err := h.get(prev, "/api/nodes", &nodes)
+	if err != nil {
+		return errors.Wrap(err, "node isn't ready yet")
+	}
+	if status != 200 {
+		return fmt.Errorf("/api/nodes http status code was %d", status)
+	}
+
+	node := findNode(nodes, prev)
+	if node == nil {
+		return fmt.Errorf("node isn't part of the cluster yet")
+	}
+	if !node.Running {
+		return fmt.Errorf("node %s isn't running yet", node.Name)
+	}
+
+	if node.BeingDrained {
+		if !h.maintenance {
+			return fmt.Errorf("node %s is in maintenance mode", node.Name)
+		}
+		if err := h.exec(prev, []string{"rabbitmq-upgrade", "revive"}); err != nil {
+			return errors.Wrap(err, "revive failed")
+		}
+	}
+
+	var queues []Queue
+	status, err = h.get(prev, "/api/queues?columns=name,vhost,type,members,online", &queues)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("/api/queues http status code was %d", status)
+	}
+
+	var issues []string
+	for _, q := range queues {
+		if q.Type != "quorum" && q.Type != "stream" {
+			continue
+		}
+
+		var offline []string
+		for _, m := range q.Members {
+			if !contains(q.Online, m) {
+				offline = append(offline, m)
+			}
+		}
+		if len(offline) > 0 {
+			issues = append(issues, fmt.Sprintf("%s (vhost %s, offline: %s)", q.Name, q.VHost, strings.Join(offline, ", ")))
+		}
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("queues members aren't all online: %s", hooks.List(issues, ", "))
+	}
+
+	return nil
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
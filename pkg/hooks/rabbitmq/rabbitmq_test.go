@@ -0,0 +1,269 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var rabbitmqStatefulSet = hookstest.StatefulSet("rabbitmq", nil)
+
+// fakeRabbitMQ serves the management api of the rabbitmq-0 to rabbitmq-n-1
+// nodes (whose ips are 10.0.0.1 to 10.0.0.n), each on its own 127.0.0.1 port.
+type fakeRabbitMQ struct {
+	addrs   hookstest.Addrs
+	servers []*httptest.Server
+
+	mu    sync.Mutex
+	nodes []Node
+	// critical are the queues each node is quorum critical for, by node ip
+	critical map[string][]CriticalQueue
+	queues   []Queue
+	down     map[string]bool
+	commands []string
+}
+
+func nodeName(ordinal int) string {
+	return fmt.Sprintf("rabbit@rabbitmq-%d.rabbitmq-nodes.default", ordinal)
+}
+
+func newFakeRabbitMQ(t *testing.T, n int) *fakeRabbitMQ {
+	f := &fakeRabbitMQ{addrs: hookstest.Addrs{}, critical: make(map[string][]CriticalQueue), down: make(map[string]bool)}
+
+	var members []string
+	for i := 0; i < n; i++ {
+		p := pod(i)
+		host := p.Status.PodIP
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f.serve(host, w, r)
+		}))
+		srv.Listener.Close()
+		srv.Listener = f.addrs.Listen(t, p.GetName())
+		srv.Start()
+		f.servers = append(f.servers, srv)
+
+		f.nodes = append(f.nodes, Node{Name: nodeName(i), Running: true})
+		members = append(members, nodeName(i))
+	}
+
+	f.queues = []Queue{
+		{Name: "orders", VHost: "/", Type: "quorum", Members: members, Online: members},
+		{Name: "events", VHost: "/", Type: "stream", Members: members, Online: members},
+		{Name: "notifications", VHost: "/", Type: "classic"},
+	}
+
+	return f
+}
+
+func (f *fakeRabbitMQ) close() {
+	for _, srv := range f.servers {
+		srv.Close()
+	}
+}
+
+func (f *fakeRabbitMQ) serve(host string, w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down[host] {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if user, _, _ := r.BasicAuth(); user != "pilot" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not_authorised", "reason": "Not management user"})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/health/checks/node-is-quorum-critical":
+		if queues := f.critical[host]; len(queues) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(HealthCheck{
+				Status: "failed",
+				Reason: "There are quorum queues that would lose their quorum if the target node is shut down",
+				Queues: queues,
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(HealthCheck{Status: "ok"})
+
+	case "/api/nodes":
+		json.NewEncoder(w).Encode(f.nodes)
+
+	case "/api/queues":
+		if r.URL.Query().Get("columns") != "name,vhost,type,members,online" {
+			http.Error(w, "unexpected columns", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(f.queues)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// exec runs rabbitmq-upgrade drain and revive.
+func (f *fakeRabbitMQ) exec(pod *v1.Pod, command []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cmd := strings.Join(command, " ")
+	f.commands = append(f.commands, fmt.Sprintf("%s: %s", pod.GetName(), cmd))
+
+	ordinal, _ := strconv.Atoi(strings.TrimPrefix(pod.GetName(), "rabbitmq-"))
+	switch cmd {
+	case "rabbitmq-upgrade drain":
+		f.nodes[ordinal].BeingDrained = true
+	case "rabbitmq-upgrade revive":
+		f.nodes[ordinal].BeingDrained = false
+	default:
+		return fmt.Errorf("command terminated with exit code 64")
+	}
+	return nil
+}
+
+func pod(ordinal int) *v1.Pod {
+	return hookstest.Pod(rabbitmqStatefulSet, ordinal, fmt.Sprintf("10.0.0.%d", ordinal+1))
+}
+
+func newHook(t *testing.T, f *fakeRabbitMQ, annotations map[string]string) *Hook {
+	objs := []runtime.Object{
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "rabbitmq", Namespace: "default"},
+			Data:       map[string][]byte{usernameKey: []byte("pilot"), passwordKey: []byte("secret")},
+		},
+	}
+
+	// Maintenance mode execs in the pods, so it's enabled after the hook is built
+	h, err := New(hookstest.NewFakeClient(objs...), hookstest.StatefulSet("rabbitmq", annotations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.(*Hook).addr = f.addrs.Addr
+
+	return h.(*Hook)
+}
+
+func TestRollout(t *testing.T) {
+	f := newFakeRabbitMQ(t, 3)
+	defer f.close()
+	h := newHook(t, f, map[string]string{CredentialsSecretAnnotation: "rabbitmq"})
+	h.maintenance, h.exec = true, f.exec
+
+	if err := h.PodUpdateTransition(nil, pod(1)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(f.commands) != 1 || f.commands[0] != "rabbitmq-1: rabbitmq-upgrade drain" {
+		t.Errorf("expected rabbitmq-1 to be drained, got: %v", f.commands)
+	}
+
+	// rabbitmq-1 restarts
+	f.nodes[1].Running = false
+	err := h.PodUpdateTransition(pod(1), pod(2))
+	if err == nil || !strings.HasSuffix(err.Error(), fmt.Sprintf("node %s isn't running yet", nodeName(1))) {
+		t.Errorf("expected a node not running error, got: %v", err)
+	}
+
+	f.nodes[1].Running = true
+	f.queues[0].Online = []string{nodeName(0), nodeName(2)}
+	err = h.PodUpdateTransition(pod(1), pod(2))
+	want := fmt.Sprintf("queues members aren't all online: orders (vhost /, offline: %s)", nodeName(1))
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+	if f.nodes[1].BeingDrained {
+		t.Error("expected rabbitmq-1 to be revived")
+	}
+
+	f.queues[0].Online = f.queues[0].Members
+	if err := h.PodUpdateTransition(pod(1), pod(2)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	want = "rabbitmq-1: rabbitmq-upgrade drain, rabbitmq-1: rabbitmq-upgrade revive, rabbitmq-2: rabbitmq-upgrade drain"
+	if got := strings.Join(f.commands, ", "); got != want {
+		t.Errorf("expected %q commands, got %q", want, got)
+	}
+}
+
+func TestQuorumCritical(t *testing.T) {
+	f := newFakeRabbitMQ(t, 3)
+	defer f.close()
+	h := newHook(t, f, map[string]string{CredentialsSecretAnnotation: "rabbitmq"})
+
+	f.critical["10.0.0.1"] = []CriticalQueue{
+		{Name: "orders", VirtualHost: "/", Type: "quorum"},
+		{Name: "events", VirtualHost: "prod", Type: "stream"},
+	}
+	err := h.PodUpdateTransition(nil, pod(0))
+	want := "node is quorum critical for 2 queues: quorum orders (vhost /), stream events (vhost prod)"
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+
+	// A node in maintenance mode isn't revived without the maintenance annotation
+	f.nodes[1].BeingDrained = true
+	err = h.PodUpdateTransition(pod(1), nil)
+	if err == nil || !strings.HasSuffix(err.Error(), "is in maintenance mode") {
+		t.Errorf("expected a maintenance mode error, got: %v", err)
+	}
+
+	// A node that's down can be restarted
+	f.down["10.0.0.3"] = true
+	next := pod(2)
+	if err := h.PodUpdateTransition(nil, next); err == nil || !strings.Contains(err.Error(), "quorum critical check http status code was 503") {
+		t.Errorf("expected an unavailable node error, got: %v", err)
+	}
+	f.addrs.Reserve(t, next.GetName())
+	next.Status.Conditions[0].Status = v1.ConditionFalse
+	if err := h.PodUpdateTransition(nil, next); err != nil {
+		t.Errorf("unexpected error restarting a down node: %v", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	f := newFakeRabbitMQ(t, 1)
+	defer f.close()
+
+	h := newHook(t, f, map[string]string{})
+	if err := h.PodUpdateTransition(nil, pod(0)); err == nil || !strings.Contains(err.Error(), "http status code was 401") {
+		t.Errorf("expected an unauthorized error, got: %v", err)
+	}
+	if err := h.PodUpdateTransition(pod(0), nil); err == nil || !strings.Contains(err.Error(), "/api/nodes http status code was 401") {
+		t.Errorf("expected an unauthorized error, got: %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{SchemeAnnotation: "https", MaintenanceAnnotation: "false"}, false},
+		{map[string]string{SchemeAnnotation: "amqp"}, true},
+		{map[string]string{PortAnnotation: "management"}, true},
+		{map[string]string{MaintenanceAnnotation: "drain"}, true},
+		{map[string]string{TimeoutAnnotation: "30"}, true},
+		{map[string]string{TimeoutAnnotation: "0s"}, true},
+		{map[string]string{TimeoutAnnotation: "-5s"}, true},
+		{map[string]string{CredentialsSecretAnnotation: "missing"}, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(hookstest.NewFakeClient(), hookstest.StatefulSet("rabbitmq", tt.annotations)); (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error: %v, got: %v", tt.annotations, tt.wantErr, err)
+		}
+	}
+}
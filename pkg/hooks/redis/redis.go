@@ -0,0 +1,417 @@
+package redis
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// PortAnnotation is the redis servers port (defaults to 6379).
+	PortAnnotation = hooks.AnnotationPrefix + "redis-port"
+
+	// DiscoveryAnnotation tells how servers are reached: on their pod ip (the
+	// default), or on their headless service DNS name.
+	DiscoveryAnnotation = hooks.AnnotationPrefix + "redis-discovery"
+
+	// SentinelsAnnotation is a comma separated list of sentinels addresses
+	// (host:port). When set, masters are failed over through the sentinels;
+	// otherwise, masters of a Redis Cluster are failed over to one of their replicas.
+	SentinelsAnnotation = hooks.AnnotationPrefix + "redis-sentinels"
+
+	// SentinelMasterAnnotation is the name of the master the sentinels
+	// monitor (defaults to mymaster).
+	SentinelMasterAnnotation = hooks.AnnotationPrefix + "redis-sentinel-master"
+
+	// CredentialsSecretAnnotation names a Secret holding the servers "password"
+	// (and optionally an ACL "username"), and an optional "sentinel-password".
+	CredentialsSecretAnnotation = hooks.AnnotationPrefix + "redis-credentials-secret"
+
+	// MaxOffsetLagAnnotation is the number of bytes a replica's replication offset
+	// can be behind its master's while being considered in sync (defaults to 1048576).
+	MaxOffsetLagAnnotation = hooks.AnnotationPrefix + "redis-max-offset-lag"
+
+	// TimeoutAnnotation is the servers queries timeout (a duration, defaults to 10s).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "redis-timeout"
+
+	defaultPort           = 6379
+	defaultSentinelMaster = "mymaster"
+	defaultMaxOffsetLag   = int64(1 << 20)
+	defaultTimeout        = 10 * time.Second
+)
+
+const (
+	// FailoverReason is the retry reason while the next pod is a master being
+	// failed over to one of its replicas.
+	FailoverReason = "FailingOver"
+
+	usernameKey         = "username"
+	passwordKey         = "password"
+	sentinelPasswordKey = "sentinel-password"
+)
+
+// Hook restarts redis servers one at a time, failing masters over before their
+// restart: through the sentinels when they're configured, or with a CLUSTER
+// FAILOVER sent to the most up to date replica in a Redis Cluster. The next
+// server waits until the restarted one replicates from its master again, with
+// a replication offset in sync with the master's.
+type Hook struct {
+	client           client.Client
+	sts              *appsv1.StatefulSet
+	port             int
+	discovery        string
+	sentinels        []string
+	sentinelMaster   string
+	username         string
+	password         string
+	sentinelPassword string
+	maxOffsetLag     int64
+	timeout          time.Duration
+
+	// addr returns the host:port reaching a pod's server
+	addr func(pod *v1.Pod) (string, error)
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		client:         c,
+		sts:            sts,
+		port:           defaultPort,
+		discovery:      hooks.DiscoveryIP,
+		sentinelMaster: defaultSentinelMaster,
+		maxOffsetLag:   defaultMaxOffsetLag,
+		timeout:        defaultTimeout,
+	}
+
+	if val, ok := annotations[PortAnnotation]; ok {
+		port, err := strconv.Atoi(val)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", PortAnnotation, val)
+		}
+		h.port = port
+	}
+
+	if val, ok := annotations[DiscoveryAnnotation]; ok {
+		if val != hooks.DiscoveryIP && val != hooks.DiscoveryDNS {
+			return nil, fmt.Errorf("invalid %s annotation: %q", DiscoveryAnnotation, val)
+		}
+		h.discovery = val
+	}
+
+	h.addr = func(pod *v1.Pod) (string, error) {
+		return hooks.PodAddr(h.sts, pod, h.discovery, h.port)
+	}
+
+	if val, ok := annotations[SentinelsAnnotation]; ok {
+		for _, addr := range strings.Split(val, ",") {
+			addr = strings.TrimSpace(addr)
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("invalid %s annotation: %q", SentinelsAnnotation, val)
+			}
+			h.sentinels = append(h.sentinels, addr)
+		}
+	}
+
+	if val, ok := annotations[SentinelMasterAnnotation]; ok {
+		if val == "" {
+			return nil, fmt.Errorf("invalid %s annotation: %q", SentinelMasterAnnotation, val)
+		}
+		h.sentinelMaster = val
+	}
+
+	if name, ok := annotations[CredentialsSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		h.username = string(secret.Data[usernameKey])
+		h.password = string(secret.Data[passwordKey])
+		h.sentinelPassword = string(secret.Data[sentinelPasswordKey])
+		if h.password == "" && h.sentinelPassword == "" {
+			return nil, fmt.Errorf("secret %s has no %s nor %s key", name, passwordKey, sentinelPasswordKey)
+		}
+	}
+
+	if val, ok := annotations[MaxOffsetLagAnnotation]; ok {
+		lag, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || lag < 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", MaxOffsetLagAnnotation, val)
+		}
+		h.maxOffsetLag = lag
+	}
+
+	if val, ok := annotations[TimeoutAnnotation]; ok {
+		var err error
+		if h.timeout, err = time.ParseDuration(val); err != nil || h.timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", TimeoutAnnotation, val)
+		}
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "redis"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil {
+		if err := h.afterUpdate(prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil {
+		if err := h.beforeUpdate(next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+// beforeUpdate fails next over to a replica when it's a master.
+func (h *Hook) beforeUpdate(next *v1.Pod) error {
+	// There's nothing to fail over on a server that's down
+	if !hooks.PodReady(next) {
+		return nil
+	}
+
+	var err error
+	if len(h.sentinels) > 0 {
+		err = h.sentinelFailover(next)
+	} else {
+		err = h.clusterFailover(next)
+	}
+
+	switch {
+	case err == errNoFailover:
+		return nil
+	case err != nil && !strings.HasPrefix(errors.Cause(err).Error(), "INPROG"):
+		return errors.Wrap(err, "failover failed")
+	}
+
+	return hooks.Wait(FailoverReason, fmt.Errorf("server is a master: waiting for a replica to take over"))
+}
+
+// afterUpdate waits until prev replicates from its master again, and caught up with it.
+func (h *Hook) afterUpdate(prev *v1.Pod) error {
+	addr, err := h.addr(prev)
+	if err != nil {
+		return err
+	}
+
+	repl, err := h.info(addr, "replication")
+	if err != nil {
+		return errors.Wrap(err, "server isn't ready yet")
+	}
+
+	if repl["role"] == "master" {
+		if len(h.sentinels) == 0 {
+			return nil
+		}
+
+		// Sentinels turn a former master into a replica once it's back
+		master, err := h.sentinelMasterAddr()
+		if err != nil {
+			return err
+		}
+		if !h.isPod(master, prev) {
+			return fmt.Errorf("server is a master, but the sentinels master is %s: waiting for it to become a replica", master)
+		}
+		return nil
+	}
+
+	if status := repl["master_link_status"]; status != "up" {
+		return fmt.Errorf("replica's link to its master is %s", status)
+	}
+
+	offset, err := strconv.ParseInt(repl["slave_repl_offset"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid replication offset: %q", repl["slave_repl_offset"])
+	}
+
+	master := net.JoinHostPort(repl["master_host"], repl["master_port"])
+	masterRepl, err := h.info(master, "replication")
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to query master %s", master))
+	}
+
+	masterOffset, err := strconv.ParseInt(masterRepl["master_repl_offset"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid master %s replication offset: %q", master, masterRepl["master_repl_offset"])
+	}
+
+	if lag := masterOffset - offset; lag > h.maxOffsetLag {
+		return fmt.Errorf("replica is %d bytes behind master %s (offset %d, master offset %d)",
+			lag, master, offset, masterOffset)
+	}
+
+	return nil
+}
+
+// errNoFailover tells the server needs no failover: it's a replica, a
+// standalone master, or it's down.
+var errNoFailover = fmt.Errorf("no failover")
+
+// sentinelFailover asks the first reachable sentinel to fail its master over,
+// when the sentinels master is the pod's server.
+func (h *Hook) sentinelFailover(pod *v1.Pod) error {
+	master, err := h.sentinelMasterAddr()
+	if err != nil {
+		return err
+	}
+	if !h.isPod(master, pod) {
+		return errNoFailover
+	}
+
+	for _, addr := range h.sentinels {
+		var c *conn
+		if c, err = dial(addr, h.timeout, "", h.sentinelPassword); err != nil {
+			continue
+		}
+		_, err = c.do("SENTINEL", "FAILOVER", h.sentinelMaster)
+		c.Close()
+
+		// Error replies (eg. NOGOODSLAVE) would be the same from any sentinel
+		if _, ok := err.(redisError); ok || err == nil {
+			return err
+		}
+	}
+	return err
+}
+
+// sentinelMasterAddr returns the master address (host:port) as known by the first reachable sentinel.
+func (h *Hook) sentinelMasterAddr() (string, error) {
+	var err error
+	for _, addr := range h.sentinels {
+		var c *conn
+		if c, err = dial(addr, h.timeout, "", h.sentinelPassword); err != nil {
+			continue
+		}
+		var reply interface{}
+		reply, err = c.do("SENTINEL", "GET-MASTER-ADDR-BY-NAME", h.sentinelMaster)
+		c.Close()
+		if err != nil {
+			continue
+		}
+
+		if hostPort, ok := reply.([]interface{}); ok && len(hostPort) == 2 {
+			host, _ := hostPort[0].(string)
+			port, _ := hostPort[1].(string)
+			return net.JoinHostPort(host, port), nil
+		}
+		return "", fmt.Errorf("sentinel %s doesn't know the %s master", addr, h.sentinelMaster)
+	}
+	return "", errors.Wrap(err, "failed to query the sentinels")
+}
+
+// clusterFailover sends a CLUSTER FAILOVER to the most up to date replica of the
+// pod's server, when it's a master. Masters outside of a Redis Cluster have no failover.
+func (h *Hook) clusterFailover(pod *v1.Pod) error {
+	addr, err := h.addr(pod)
+	if err != nil {
+		return err
+	}
+
+	repl, err := h.info(addr, "replication")
+	if err != nil {
+		if refused(err) {
+			return errNoFailover
+		}
+		return err
+	}
+	if repl["role"] != "master" {
+		return errNoFailover
+	}
+
+	cluster, err := h.info(addr, "cluster")
+	if err != nil {
+		return err
+	}
+	if cluster["cluster_enabled"] != "1" {
+		return errNoFailover
+	}
+
+	var best *replica
+	for _, r := range replicas(repl) {
+		if r.state == "online" && (best == nil || r.offset > best.offset) {
+			r := r
+			best = &r
+		}
+	}
+	if best == nil {
+		return fmt.Errorf("master has no online replica")
+	}
+
+	c, err := dial(best.addr, h.timeout, h.username, h.password)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = c.do("CLUSTER", "FAILOVER")
+	return errors.Wrap(err, fmt.Sprintf("replica %s", best.addr))
+}
+
+// isPod tells if a server address (host:port), as reported by the sentinels, is
+// the pod's. Sentinels know servers by their ip, or by their hostname.
+func (h *Hook) isPod(addr string, pod *v1.Pod) bool {
+	if podAddr, err := h.addr(pod); err == nil && podAddr == addr {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	dnsName, _ := hooks.PodHost(h.sts, pod, hooks.DiscoveryDNS)
+
+	return (pod.Status.PodIP != "" && host == pod.Status.PodIP) || host == dnsName
+}
+
+// refused tells if a server refused the connection: it's down, rather than slow
+// or unreachable.
+func refused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
+
+// info returns a server's INFO section fields.
+func (h *Hook) info(addr, section string) (map[string]string, error) {
+	c, err := dial(addr, h.timeout, h.username, h.password)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	reply, err := c.do("INFO", section)
+	if err != nil {
+		return nil, err
+	}
+
+	info, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid INFO %s reply from %s", section, addr)
+	}
+
+	return parseInfo(info), nil
+}
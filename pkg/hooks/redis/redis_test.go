@@ -0,0 +1,488 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// node is a fake redis server's replication state.
+type node struct {
+	role   string
+	master string
+	link   string
+	offset int64
+}
+
+var redisStatefulSet = hookstest.StatefulSet("redis", nil)
+
+// fakeRedis serves the redis-0 to redis-n-1 servers (whose ips are 10.0.0.1 to
+// 10.0.0.n), and a sentinel, each on its own 127.0.0.1 port. Servers are known
+// by their address, which they report in their replication info.
+type fakeRedis struct {
+	addrs        hookstest.Addrs
+	sentinelAddr string
+	listeners    []net.Listener
+
+	mu         sync.Mutex
+	nodes      map[string]*node
+	cluster    bool
+	password   string
+	inProgress bool
+	// monitored is the master, as known by the sentinel
+	monitored    string
+	failedOver   []string
+	clusterCalls int
+}
+
+// newFakeRedis starts n servers, the first one being the master.
+func newFakeRedis(t *testing.T, n int) *fakeRedis {
+	f := &fakeRedis{addrs: hookstest.Addrs{}, nodes: make(map[string]*node)}
+
+	for i := 0; i < n; i++ {
+		l := f.addrs.Listen(t, pod(i).GetName())
+		f.listeners = append(f.listeners, l)
+		go f.serve(l, false)
+	}
+
+	f.monitored = f.addr(0)
+	for i := 0; i < n; i++ {
+		f.nodes[f.addr(i)] = &node{role: "slave", master: f.monitored, link: "up", offset: 1000}
+	}
+	f.nodes[f.monitored] = &node{role: "master", link: "up", offset: 1000}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.sentinelAddr = l.Addr().String()
+	f.listeners = append(f.listeners, l)
+	go f.serve(l, true)
+
+	return f
+}
+
+// addr returns the address of the server having the given ordinal.
+func (f *fakeRedis) addr(ordinal int) string {
+	return f.addrs[pod(ordinal).GetName()]
+}
+
+// node returns the replication state of the server having the given ordinal.
+func (f *fakeRedis) node(ordinal int) *node {
+	return f.nodes[f.addr(ordinal)]
+}
+
+func (f *fakeRedis) close() {
+	for _, l := range f.listeners {
+		l.Close()
+	}
+}
+
+func (f *fakeRedis) serve(l net.Listener, sentinel bool) {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(nc, sentinel)
+	}
+}
+
+func (f *fakeRedis) handle(nc net.Conn, sentinel bool) {
+	defer nc.Close()
+
+	c := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	addr := nc.LocalAddr().String()
+	authenticated := sentinel || f.password == ""
+
+	for {
+		req, err := c.read()
+		if err != nil {
+			return
+		}
+
+		var args []string
+		for _, arg := range req.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+
+		var reply string
+		switch {
+		case strings.ToUpper(args[0]) == "AUTH":
+			authenticated = args[len(args)-1] == f.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case sentinel:
+			reply = f.sentinel(args)
+		default:
+			reply = f.redis(addr, args)
+		}
+
+		if _, err := nc.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (f *fakeRedis) master() string {
+	for addr, n := range f.nodes {
+		if n.role == "master" {
+			return addr
+		}
+	}
+	return ""
+}
+
+// promote makes a replica the master of the former master and its replicas.
+func (f *fakeRedis) promote(addr string) {
+	former := f.nodes[addr].master
+	for other, n := range f.nodes {
+		if other == former || n.master == former {
+			n.role, n.master = "slave", addr
+		}
+	}
+	f.nodes[addr].role, f.nodes[addr].master = "master", ""
+	f.failedOver = append(f.failedOver, former)
+}
+
+func (f *fakeRedis) redis(addr string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.nodes[addr]
+
+	switch strings.ToUpper(strings.Join(args, " ")) {
+	case "INFO REPLICATION":
+		lines := []string{"# Replication", "role:" + n.role}
+		if n.role == "master" {
+			var replicas []string
+			for other, r := range f.nodes {
+				if r.master == addr {
+					replicas = append(replicas, other)
+				}
+			}
+			sort.Strings(replicas)
+			for i, other := range replicas {
+				host, port, _ := net.SplitHostPort(other)
+				lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=online,offset=%d,lag=0",
+					i, host, port, f.nodes[other].offset))
+			}
+		} else {
+			host, port, _ := net.SplitHostPort(n.master)
+			lines = append(lines, "master_host:"+host, "master_port:"+port,
+				"master_link_status:"+n.link, fmt.Sprintf("slave_repl_offset:%d", n.offset))
+		}
+		lines = append(lines, fmt.Sprintf("master_repl_offset:%d", n.offset))
+		return bulk(strings.Join(lines, "\r\n") + "\r\n")
+
+	case "INFO CLUSTER":
+		enabled := 0
+		if f.cluster {
+			enabled = 1
+		}
+		return bulk(fmt.Sprintf("# Cluster\r\ncluster_enabled:%d\r\n", enabled))
+
+	case "CLUSTER FAILOVER":
+		f.clusterCalls++
+		if !f.cluster {
+			return "-ERR This instance has cluster support disabled\r\n"
+		}
+		if n.role != "slave" {
+			return "-ERR You should send CLUSTER FAILOVER to a replica\r\n"
+		}
+		f.promote(addr)
+		return "+OK\r\n"
+	}
+
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+func (f *fakeRedis) sentinel(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(args) != 3 || strings.ToUpper(args[0]) != "SENTINEL" || args[2] != "mymaster" {
+		return "-ERR No such master with that name\r\n"
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case "GET-MASTER-ADDR-BY-NAME":
+		host, port, _ := net.SplitHostPort(f.monitored)
+		return "*2\r\n" + bulk(host) + bulk(port)
+
+	case "FAILOVER":
+		if f.inProgress {
+			return "-INPROG Failover already in progress\r\n"
+		}
+		best := ""
+		for addr, n := range f.nodes {
+			if n.master == f.monitored && n.link == "up" && (best == "" || n.offset > f.nodes[best].offset) {
+				best = addr
+			}
+		}
+		if best == "" {
+			return "-NOGOODSLAVE No suitable replica to promote\r\n"
+		}
+		f.promote(best)
+		f.monitored = best
+		return "+OK\r\n"
+	}
+
+	return "-ERR Unknown sentinel subcommand\r\n"
+}
+
+func pod(ordinal int) *v1.Pod {
+	return hookstest.Pod(redisStatefulSet, ordinal, fmt.Sprintf("10.0.0.%d", ordinal+1))
+}
+
+func newHook(t *testing.T, f *fakeRedis, annotations map[string]string) *Hook {
+	annotations[TimeoutAnnotation] = "2s"
+
+	objs := []runtime.Object{
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "redis", Namespace: "default"},
+			Data:       map[string][]byte{passwordKey: []byte("secret")},
+		},
+	}
+
+	h, err := New(hookstest.NewFakeClient(objs...), hookstest.StatefulSet("redis", annotations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.(*Hook).addr = f.addrs.Addr
+
+	return h.(*Hook)
+}
+
+func TestClusterFailover(t *testing.T) {
+	f := newFakeRedis(t, 3)
+	defer f.close()
+	f.cluster = true
+	f.node(1).offset = 900
+	f.node(2).offset = 950
+	h := newHook(t, f, map[string]string{})
+
+	// Replicas are restarted right away
+	if err := h.PodUpdateTransition(nil, pod(1)); err != nil {
+		t.Errorf("unexpected error before restarting a replica: %v", err)
+	}
+	if f.clusterCalls != 0 {
+		t.Errorf("unexpected failover: %v", f.failedOver)
+	}
+
+	// The master is failed over to its most up to date replica
+	err := h.PodUpdateTransition(nil, pod(0))
+	if hooks.WaitReason(err) != FailoverReason {
+		t.Fatalf("expected a failover, got: %v", err)
+	}
+	if f.master() != f.addr(2) {
+		t.Errorf("expected redis-2 (%s) to be the master, got: %s", f.addr(2), f.master())
+	}
+	if err := h.PodUpdateTransition(nil, pod(0)); err != nil {
+		t.Errorf("unexpected error once failed over: %v", err)
+	}
+
+	// redis-0 restarts
+	f.node(0).link = "down"
+	err = h.PodUpdateTransition(pod(0), pod(1))
+	if err == nil || !strings.HasSuffix(err.Error(), "replica's link to its master is down") {
+		t.Errorf("expected a master link error, got: %v", err)
+	}
+
+	f.node(0).link = "up"
+	f.node(2).offset = 5000000
+	err = h.PodUpdateTransition(pod(0), pod(1))
+	want := fmt.Sprintf("replica is 4999000 bytes behind master %s (offset 1000, master offset 5000000)", f.addr(2))
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+
+	f.node(0).offset = 4999990
+	if err := h.PodUpdateTransition(pod(0), pod(1)); err != nil {
+		t.Errorf("unexpected error once in sync: %v", err)
+	}
+}
+
+func TestSentinelFailover(t *testing.T) {
+	f := newFakeRedis(t, 3)
+	defer f.close()
+	f.node(2).link = "down"
+	h := newHook(t, f, map[string]string{SentinelsAnnotation: f.sentinelAddr})
+
+	// The sentinels tell which server is the master, whatever the servers say
+	f.node(1).role = "master"
+	if err := h.PodUpdateTransition(nil, pod(1)); err != nil {
+		t.Errorf("unexpected error before restarting a replica: %v", err)
+	}
+	if len(f.failedOver) != 0 {
+		t.Errorf("unexpected failover: %v", f.failedOver)
+	}
+	f.node(1).role = "slave"
+
+	f.inProgress = true
+	err := h.PodUpdateTransition(nil, pod(0))
+	if hooks.WaitReason(err) != FailoverReason {
+		t.Fatalf("expected to wait for the failover in progress, got: %v", err)
+	}
+
+	f.inProgress = false
+	err = h.PodUpdateTransition(nil, pod(0))
+	if hooks.WaitReason(err) != FailoverReason {
+		t.Fatalf("expected a failover, got: %v", err)
+	}
+	if f.master() != f.addr(1) {
+		t.Errorf("expected redis-1 (%s) to be the master, got: %s", f.addr(1), f.master())
+	}
+
+	// redis-0 restarts as a master, until the sentinels reconfigure it
+	f.node(0).role = "master"
+	err = h.PodUpdateTransition(pod(0), nil)
+	want := fmt.Sprintf("server is a master, but the sentinels master is %s: waiting for it to become a replica", f.addr(1))
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q error, got: %v", want, err)
+	}
+
+	f.node(0).role = "slave"
+	if err := h.PodUpdateTransition(pod(0), nil); err != nil {
+		t.Errorf("unexpected error once a replica: %v", err)
+	}
+
+	// Without a replica to promote
+	f.node(0).link = "down"
+	err = h.PodUpdateTransition(nil, pod(1))
+	if err == nil || !strings.Contains(err.Error(), "failover failed: NOGOODSLAVE") {
+		t.Errorf("expected a failover error, got: %v", err)
+	}
+}
+
+func TestStandalone(t *testing.T) {
+	f := newFakeRedis(t, 2)
+	defer f.close()
+	h := newHook(t, f, map[string]string{})
+
+	// Without sentinels nor cluster, masters aren't failed over
+	if err := h.PodUpdateTransition(nil, pod(0)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if f.clusterCalls != 0 || len(f.failedOver) != 0 {
+		t.Errorf("unexpected failover: %v", f.failedOver)
+	}
+}
+
+func TestServerDown(t *testing.T) {
+	f := newFakeRedis(t, 2)
+	defer f.close()
+	f.cluster = true
+	h := newHook(t, f, map[string]string{})
+
+	// There's nothing to fail over on servers that are down
+	f.addrs.Reserve(t, "redis-2")
+	down := pod(2)
+	if err := h.PodUpdateTransition(nil, down); err != nil {
+		t.Errorf("unexpected error restarting a down server: %v", err)
+	}
+	if err := h.PodUpdateTransition(down, nil); err == nil || !strings.Contains(err.Error(), "server isn't ready yet") {
+		t.Errorf("expected a server not ready error, got: %v", err)
+	}
+
+	down.Status.Conditions[0].Status = v1.ConditionFalse
+	delete(f.addrs, "redis-2")
+	if err := h.PodUpdateTransition(nil, down); err != nil {
+		t.Errorf("unexpected error restarting a pod that isn't ready: %v", err)
+	}
+
+	// But a server that doesn't answer may still be a master
+	l := f.addrs.Listen(t, "redis-2")
+	defer l.Close()
+	h.timeout = 100 * time.Millisecond
+	if err := h.PodUpdateTransition(nil, pod(2)); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected a timeout error, got: %v", err)
+	}
+	if f.clusterCalls != 0 || len(f.failedOver) != 0 {
+		t.Errorf("unexpected failover: %v", f.failedOver)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	f := newFakeRedis(t, 1)
+	defer f.close()
+	f.password = "secret"
+
+	h := newHook(t, f, map[string]string{})
+	if err := h.PodUpdateTransition(nil, pod(0)); err == nil || !strings.Contains(err.Error(), "NOAUTH") {
+		t.Errorf("expected an authentication error, got: %v", err)
+	}
+
+	h = newHook(t, f, map[string]string{CredentialsSecretAnnotation: "redis"})
+	if err := h.PodUpdateTransition(pod(0), pod(0)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestIsPod(t *testing.T) {
+	h := &Hook{sts: redisStatefulSet, port: defaultPort, discovery: hooks.DiscoveryIP}
+	h.addr = func(pod *v1.Pod) (string, error) {
+		return hooks.PodAddr(h.sts, pod, h.discovery, h.port)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.2:6379", true},
+		{"redis-1.redis.default.svc:6379", true},
+		{"10.0.0.1:6379", false},
+		{"redis-0.redis.default.svc:6379", false},
+		{"10.0.0.2", false},
+	}
+
+	for _, tt := range tests {
+		if got := h.isPod(tt.addr, pod(1)); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.addr, tt.want, got)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{SentinelsAnnotation: "sentinel-0.sentinel:26379, sentinel-1.sentinel:26379"}, false},
+		{map[string]string{SentinelsAnnotation: "sentinel-0.sentinel"}, true},
+		{map[string]string{SentinelMasterAnnotation: ""}, true},
+		{map[string]string{DiscoveryAnnotation: "srv"}, true},
+		{map[string]string{PortAnnotation: "redis"}, true},
+		{map[string]string{MaxOffsetLagAnnotation: "-1"}, true},
+		{map[string]string{TimeoutAnnotation: "10"}, true},
+		{map[string]string{TimeoutAnnotation: "0s"}, true},
+		{map[string]string{TimeoutAnnotation: "-5s"}, true},
+		{map[string]string{CredentialsSecretAnnotation: "missing"}, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(hookstest.NewFakeClient(), hookstest.StatefulSet("redis", tt.annotations)); (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error: %v, got: %v", tt.annotations, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisError is an error reply (eg. "NOGOODSLAVE No suitable replica to promote").
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// conn is a minimal RESP connection, for the few commands the hook sends.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dial connects to a redis (or sentinel) server, and authenticates when a password is given.
+func dial(addr string, timeout time.Duration, username, password string) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := nc.SetDeadline(time.Now().Add(timeout)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	c := &conn{Conn: nc, r: bufio.NewReader(nc)}
+
+	if password != "" {
+		args := []string{"AUTH", password}
+		if username != "" {
+			args = []string{"AUTH", username, password}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to authenticate to %s: %v", addr, err)
+		}
+	}
+
+	return c, nil
+}
+
+// do sends a command, and returns its reply: a string (for simple strings and
+// bulk strings), an int64, a []interface{}, or nil. Error replies are returned
+// as redisError.
+func (c *conn) do(args ...string) (interface{}, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+func (c *conn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("invalid empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		res := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			val, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, val)
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("invalid reply %q", line)
+}
+
+// parseInfo reads the "field:value" lines of an INFO reply.
+func parseInfo(info string) map[string]string {
+	m := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			m[kv[0]] = kv[1]
+		}
+	}
+	return m
+}
+
+// replica is a master's replica, as listed in its INFO replication
+// (eg. "slave0:ip=10.8.2.14,port=6379,state=online,offset=7031,lag=0").
+type replica struct {
+	addr   string
+	state  string
+	offset int64
+}
+
+func replicas(info map[string]string) []replica {
+	var res []replica
+	for i := 0; ; i++ {
+		line, ok := info[fmt.Sprintf("slave%d", i)]
+		if !ok {
+			return res
+		}
+
+		fields := make(map[string]string)
+		for _, kv := range strings.Split(line, ",") {
+			if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+				fields[parts[0]] = parts[1]
+			}
+		}
+
+		offset, _ := strconv.ParseInt(fields["offset"], 10, 64)
+		res = append(res, replica{
+			addr:   net.JoinHostPort(fields["ip"], fields["port"]),
+			state:  fields["state"],
+			offset: offset,
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// GRPCAddressAnnotation is the gRPC server host:port.
+	GRPCAddressAnnotation = hooks.AnnotationPrefix + "grpc-address"
+
+	// GRPCTimeoutAnnotation is the calls timeout (eg. 30s).
+	GRPCTimeoutAnnotation = hooks.AnnotationPrefix + "grpc-timeout"
+
+	// GRPCTLSAnnotation enables TLS when "true".
+	GRPCTLSAnnotation = hooks.AnnotationPrefix + "grpc-tls"
+
+	// GRPCInsecureAnnotation disables the server certificate verification when "true".
+	GRPCInsecureAnnotation = hooks.AnnotationPrefix + "grpc-insecure-skip-verify"
+)
+
+// GRPCMethod is the unary method called for each transition. Its request and
+// response messages are the Transition and Verdict structs, encoded with the
+// "json" codec (ie. "application/grpc+json" content-type).
+const GRPCMethod = "/statefulsetpilot.v1.Hook/PodUpdateTransition"
+
+// JSONCodec is a gRPC codec marshaling messages as json.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(JSONCodec{})
+}
+
+// GRPCHook sends each transition to a gRPC server, and expects a Verdict in return.
+type GRPCHook struct {
+	sts     *appsv1.StatefulSet
+	address string
+	timeout time.Duration
+	creds   grpc.DialOption
+}
+
+func NewGRPC(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	address, ok := annotations[GRPCAddressAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("missing %s annotation", GRPCAddressAnnotation)
+	}
+
+	timeout, err := parseTimeout(annotations, GRPCTimeoutAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	withTLS, err := parseBool(annotations, GRPCTLSAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := parseBool(annotations, GRPCInsecureAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := grpc.WithInsecure()
+	if withTLS {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: insecure}))
+	}
+
+	return &GRPCHook{
+		sts:     sts,
+		address: address,
+		timeout: timeout,
+		creds:   creds,
+	}, nil
+}
+
+func (h *GRPCHook) Name() string {
+	return "grpc"
+}
+
+func (h *GRPCHook) PodUpdateTransition(prev, next *v1.Pod) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, h.address, h.creds, grpc.WithBlock())
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to connect to %s", h.address))
+	}
+	defer conn.Close()
+
+	v := Verdict{}
+	err = conn.Invoke(ctx, GRPCMethod, newTransition(h.sts, prev, next), &v, grpc.CallContentSubtype("json"))
+	if err != nil {
+		return errors.Wrap(err, "grpc hook call failed")
+	}
+
+	return v.err()
+}
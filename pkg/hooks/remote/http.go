@@ -0,0 +1,86 @@
+package remote
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	resty "gopkg.in/resty.v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// HTTPURLAnnotation is the url the transitions are POSTed to.
+	HTTPURLAnnotation = hooks.AnnotationPrefix + "http-url"
+
+	// HTTPTimeoutAnnotation is the requests timeout (eg. 30s).
+	HTTPTimeoutAnnotation = hooks.AnnotationPrefix + "http-timeout"
+
+	// HTTPInsecureAnnotation disables the server certificate verification when "true".
+	HTTPInsecureAnnotation = hooks.AnnotationPrefix + "http-insecure-skip-verify"
+)
+
+// HTTPHook POSTs each transition as json to an url, and expects
+// a json Verdict with a 200 status code in return.
+type HTTPHook struct {
+	sts    *appsv1.StatefulSet
+	url    string
+	client *resty.Client
+}
+
+func NewHTTP(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	url, ok := annotations[HTTPURLAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("missing %s annotation", HTTPURLAnnotation)
+	}
+
+	timeout, err := parseTimeout(annotations, HTTPTimeoutAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := parseBool(annotations, HTTPInsecureAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HTTPHook{
+		sts: sts,
+		url: url,
+		client: resty.New().
+			SetTimeout(timeout).
+			SetTLSClientConfig(&tls.Config{InsecureSkipVerify: insecure}),
+	}, nil
+}
+
+func (h *HTTPHook) Name() string {
+	return "http"
+}
+
+func (h *HTTPHook) PodUpdateTransition(prev, next *v1.Pod) error {
+	resp, err := h.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(newTransition(h.sts, prev, next)).
+		Post(h.url)
+
+	if err != nil {
+		return errors.Wrap(err, "http hook call failed")
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("http hook status code was %d: %s", resp.StatusCode(), resp.String())
+	}
+
+	v := Verdict{}
+	if err := json.Unmarshal(resp.Body(), &v); err != nil {
+		return errors.Wrap(err, "can't decode http hook verdict")
+	}
+
+	return v.err()
+}
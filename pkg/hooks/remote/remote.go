@@ -0,0 +1,84 @@
+package remote
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+)
+
+var defaultTimeout = 30 * time.Second
+
+// Transition describes a pods update transition to remote hooks.
+// Prev and Next follow the hooks.STSRolloutHooks conventions, and may be nil.
+type Transition struct {
+	Namespace       string  `json:"namespace"`
+	StatefulSet     string  `json:"statefulSet"`
+	CurrentRevision string  `json:"currentRevision"`
+	UpdateRevision  string  `json:"updateRevision"`
+	Prev            *v1.Pod `json:"prev,omitempty"`
+	Next            *v1.Pod `json:"next,omitempty"`
+}
+
+// Verdict is the remote hooks answer. The update is postponed unless Ready
+// is true, and the rollout is aborted when Abort is true.
+type Verdict struct {
+	Ready  bool   `json:"ready"`
+	Abort  bool   `json:"abort,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func newTransition(sts *appsv1.StatefulSet, prev, next *v1.Pod) *Transition {
+	return &Transition{
+		Namespace:       sts.GetNamespace(),
+		StatefulSet:     sts.GetName(),
+		CurrentRevision: sts.Status.CurrentRevision,
+		UpdateRevision:  sts.Status.UpdateRevision,
+		Prev:            prev,
+		Next:            next,
+	}
+}
+
+func (v *Verdict) err() error {
+	if v.Abort {
+		return hooks.Abort(fmt.Errorf("remote hook aborted the rollout: %s", v.Reason))
+	}
+
+	if !v.Ready {
+		return fmt.Errorf("remote hook isn't ready: %s", v.Reason)
+	}
+
+	return nil
+}
+
+func parseTimeout(annotations map[string]string, key string) (time.Duration, error) {
+	val, ok := annotations[key]
+	if !ok {
+		return defaultTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", key))
+	}
+
+	return timeout, nil
+}
+
+func parseBool(annotations map[string]string, key string) (bool, error) {
+	val, ok := annotations[key]
+	if !ok {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", key))
+	}
+
+	return b, nil
+}
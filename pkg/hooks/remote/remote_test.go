@@ -0,0 +1,151 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"google.golang.org/grpc"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func statefulset(annotations map[string]string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Status: appsv1.StatefulSetStatus{
+			CurrentRevision: "db-1",
+			UpdateRevision:  "db-2",
+		},
+	}
+}
+
+func pod(name string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+}
+
+// verdictFor is the remote side of the tests: it accepts any transition
+// but the ones involving db-1, and aborts the ones involving db-0.
+func verdictFor(t *Transition) *Verdict {
+	switch {
+	case t.StatefulSet != "db" || t.UpdateRevision != "db-2":
+		return &Verdict{Reason: "unexpected transition"}
+	case t.Next != nil && t.Next.GetName() == "db-0":
+		return &Verdict{Abort: true, Reason: "db-0 is sacred"}
+	case t.Next != nil && t.Next.GetName() == "db-1":
+		return &Verdict{Reason: "db-1 isn't ready"}
+	}
+	return &Verdict{Ready: true}
+}
+
+type transitionTest struct {
+	name    string
+	prev    *v1.Pod
+	next    *v1.Pod
+	wantErr bool
+	abort   bool
+}
+
+var transitionTests = []transitionTest{
+	{"ready", nil, pod("db-2"), false, false},
+	{"not ready", pod("db-2"), pod("db-1"), true, false},
+	{"abort", pod("db-1"), pod("db-0"), true, true},
+	{"finished", pod("db-0"), nil, false, false},
+}
+
+func runTransitionTests(t *testing.T, h hooks.STSRolloutHooks) {
+	for _, tt := range transitionTests {
+		err := h.PodUpdateTransition(tt.prev, tt.next)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: PodUpdateTransition() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if hooks.IsAbort(err) != tt.abort {
+			t.Errorf("%s: PodUpdateTransition() abort = %v, want %v", tt.name, hooks.IsAbort(err), tt.abort)
+		}
+	}
+}
+
+func TestHTTPHook(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr := &Transition{}
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(tr) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(verdictFor(tr))
+	}))
+	defer srv.Close()
+
+	h, err := NewHTTP(nil, statefulset(map[string]string{HTTPURLAnnotation: srv.URL}))
+	if err != nil {
+		t.Fatalf("failed to create hook: %v", err)
+	}
+
+	runTransitionTests(t, h)
+
+	h, _ = NewHTTP(nil, statefulset(map[string]string{HTTPURLAnnotation: srv.URL + "/nope"}))
+	srv.Config.Handler = http.NotFoundHandler()
+	if err := h.PodUpdateTransition(nil, pod("db-2")); err == nil {
+		t.Error("PodUpdateTransition() should fail on http errors")
+	}
+}
+
+func TestGRPCHook(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "statefulsetpilot.v1.Hook",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "PodUpdateTransition",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+				interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				tr := &Transition{}
+				if err := dec(tr); err != nil {
+					return nil, err
+				}
+				return verdictFor(tr), nil
+			},
+		}},
+	}, struct{}{})
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	h, err := NewGRPC(nil, statefulset(map[string]string{
+		GRPCAddressAnnotation: ln.Addr().String(),
+		GRPCTimeoutAnnotation: "5s",
+	}))
+	if err != nil {
+		t.Fatalf("failed to create hook: %v", err)
+	}
+
+	runTransitionTests(t, h)
+}
+
+func TestMissingSettings(t *testing.T) {
+	if _, err := NewHTTP(nil, statefulset(nil)); err == nil {
+		t.Error("NewHTTP() should fail without url")
+	}
+	if _, err := NewGRPC(nil, statefulset(nil)); err == nil {
+		t.Error("NewGRPC() should fail without address")
+	}
+	if _, err := NewGRPC(nil, statefulset(map[string]string{
+		GRPCAddressAnnotation: "localhost:1234",
+		GRPCTLSAnnotation:     "maybe",
+	})); err == nil {
+		t.Error("NewGRPC() should fail on invalid booleans")
+	}
+}
@@ -0,0 +1,121 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// BeforeAnnotation is the shell script run before a pod is updated.
+	BeforeAnnotation = hooks.AnnotationPrefix + "script-before"
+
+	// AfterAnnotation is the shell script run once a pod was updated.
+	AfterAnnotation = hooks.AnnotationPrefix + "script-after"
+
+	// TimeoutAnnotation is the scripts execution timeout (eg. 5m).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "script-timeout"
+
+	shell          = "/bin/sh"
+	defaultTimeout = 5 * time.Minute
+)
+
+// Hook runs shell scripts from the pilot's container. A script exiting with a
+// non-zero status postpones the update. Scripts are given the pod's description
+// in the PILOT_POD, PILOT_NAMESPACE, PILOT_ORDINAL and PILOT_STATEFULSET
+// environment variables.
+type Hook struct {
+	before  string
+	after   string
+	timeout time.Duration
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		before:  annotations[BeforeAnnotation],
+		after:   annotations[AfterAnnotation],
+		timeout: defaultTimeout,
+	}
+
+	if val, ok := annotations[TimeoutAnnotation]; ok {
+		var err error
+		if h.timeout, err = time.ParseDuration(val); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid %s annotation", TimeoutAnnotation))
+		}
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "script"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil && strings.TrimSpace(h.after) != "" {
+		if err := h.run(h.after, prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil && strings.TrimSpace(h.before) != "" {
+		if err := h.run(h.before, next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+func (h *Hook) run(script string, pod *v1.Pod) error {
+	vars, err := hooks.NewTemplateVars(pod)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(shell, "-c", script)
+	cmd.Env = append(os.Environ(),
+		"PILOT_POD="+vars.Pod,
+		"PILOT_NAMESPACE="+vars.Namespace,
+		"PILOT_ORDINAL="+strconv.Itoa(vars.Ordinal),
+		"PILOT_STATEFULSET="+vars.StatefulSet,
+	)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	// Run in a dedicated process group, so we can kill the script's children on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	timer := time.AfterFunc(h.timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("script timed out after %s: %s", h.timeout, strings.TrimSpace(output.String()))
+	}
+
+	if err != nil {
+		return fmt.Errorf("script failed: %v: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	return nil
+}
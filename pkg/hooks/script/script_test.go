@@ -0,0 +1,58 @@
+package script
+
+import (
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func pod(name string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+}
+
+func newHook(t *testing.T, annotations map[string]string) *Hook {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Annotations: annotations},
+	}
+
+	h, err := New(nil, sts)
+	if err != nil {
+		t.Fatalf("failed to create hook: %v", err)
+	}
+
+	return h.(*Hook)
+}
+
+func TestPodUpdateTransition(t *testing.T) {
+	h := newHook(t, map[string]string{
+		BeforeAnnotation: `test "$PILOT_POD" = "db-$PILOT_ORDINAL" -a "$PILOT_ORDINAL" != 0`,
+		AfterAnnotation:  `test "$PILOT_STATEFULSET/$PILOT_NAMESPACE" = db/default || { echo oops; exit 3; }`,
+	})
+
+	if err := h.PodUpdateTransition(pod("db-2"), pod("db-1")); err != nil {
+		t.Errorf("PodUpdateTransition() failed: %v", err)
+	}
+
+	if err := h.PodUpdateTransition(pod("db-1"), pod("db-0")); err == nil {
+		t.Error("PodUpdateTransition() should fail when the before script fails")
+	}
+
+	err := h.PodUpdateTransition(pod("web-1"), nil)
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("PodUpdateTransition() should report the after script output, got: %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	h := newHook(t, map[string]string{
+		BeforeAnnotation:  "sleep 10",
+		TimeoutAnnotation: "100ms",
+	})
+
+	if err := h.PodUpdateTransition(nil, pod("db-0")); err == nil {
+		t.Error("PodUpdateTransition() should fail on timeouts")
+	}
+}
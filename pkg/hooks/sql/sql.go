@@ -0,0 +1,272 @@
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	// The builtin drivers
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+var (
+	// DriverAnnotation is the database/sql driver name: mysql or postgres.
+	DriverAnnotation = hooks.AnnotationPrefix + "sql-driver"
+
+	// DSNAnnotation is the data source name template, given the TemplateVars
+	// along with the pod's IP, and the credentials Secret's Username and Password
+	// (eg. "{{.Username}}:{{.Password}}@tcp({{.IP}}:3306)/"). Credentials in URL
+	// DSNs must be escaped with userinfo, and query parameters with urlquery
+	// (eg. "postgres://{{userinfo .Username .Password}}@{{.IP}}/").
+	DSNAnnotation = hooks.AnnotationPrefix + "sql-dsn"
+
+	// CredentialsSecretAnnotation names a Secret holding a "username" and a
+	// "password", given to the DSN template.
+	CredentialsSecretAnnotation = hooks.AnnotationPrefix + "sql-credentials-secret"
+
+	// BeforeQueryAnnotation is the query template run on the next pod before its
+	// update, whose result must match BeforeExpectedAnnotation. The result is the
+	// first row's last column, so "SHOW STATUS LIKE 'wsrep_ready'" gives the status value.
+	BeforeQueryAnnotation    = hooks.AnnotationPrefix + "sql-before-query"
+	BeforeExpectedAnnotation = hooks.AnnotationPrefix + "sql-before-expected"
+
+	// AfterQueryAnnotation is the query template run on the previous pod after its
+	// update, whose result must match AfterExpectedAnnotation.
+	AfterQueryAnnotation    = hooks.AnnotationPrefix + "sql-after-query"
+	AfterExpectedAnnotation = hooks.AnnotationPrefix + "sql-after-expected"
+
+	// TimeoutAnnotation is the connections and queries timeout (a duration, defaults to 10s).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "sql-timeout"
+
+	defaultTimeout = 10 * time.Second
+)
+
+const (
+	usernameKey = "username"
+	passwordKey = "password"
+)
+
+// templateFuncs are the DSN and queries templates functions, on top of the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	// userinfo escapes credentials for URL DSNs
+	"userinfo": func(username, password string) string {
+		return url.UserPassword(username, password).String()
+	},
+}
+
+// Vars describes a pod to the DSN and queries templates.
+type Vars struct {
+	hooks.TemplateVars
+	IP       string
+	Username string
+	Password string
+}
+
+// check is a query, and the result it must return.
+type check struct {
+	query    *template.Template
+	expected string
+}
+
+// Hook gates pods updates on SQL queries results: the next pod is only
+// updated when its before query returns the expected value, and the
+// previous pod must return the after query's expected value once updated.
+type Hook struct {
+	driver   string
+	dsn      *template.Template
+	username string
+	password string
+	before   *check
+	after    *check
+	timeout  time.Duration
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{timeout: defaultTimeout}
+
+	var ok bool
+	if h.driver, ok = annotations[DriverAnnotation]; !ok {
+		return nil, fmt.Errorf("missing %s annotation", DriverAnnotation)
+	}
+	if !registered(h.driver) {
+		return nil, fmt.Errorf("invalid %s annotation: %q", DriverAnnotation, h.driver)
+	}
+
+	var err error
+	if h.dsn, err = hooks.ParseTemplate(annotations, DSNAnnotation, templateFuncs); err != nil {
+		return nil, err
+	}
+	if h.dsn == nil {
+		return nil, fmt.Errorf("missing %s annotation", DSNAnnotation)
+	}
+
+	if h.before, err = parseCheck(annotations, BeforeQueryAnnotation, BeforeExpectedAnnotation); err != nil {
+		return nil, err
+	}
+	if h.after, err = parseCheck(annotations, AfterQueryAnnotation, AfterExpectedAnnotation); err != nil {
+		return nil, err
+	}
+	if h.before == nil && h.after == nil {
+		return nil, fmt.Errorf("missing %s or %s annotation", BeforeQueryAnnotation, AfterQueryAnnotation)
+	}
+
+	if name, ok := annotations[CredentialsSecretAnnotation]; ok {
+		secret, err := hooks.GetSecret(c, sts.GetNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+
+		h.username, h.password = string(secret.Data[usernameKey]), string(secret.Data[passwordKey])
+		if h.username == "" {
+			return nil, fmt.Errorf("secret %s has no %s key", name, usernameKey)
+		}
+	}
+
+	if val, ok := annotations[TimeoutAnnotation]; ok {
+		if h.timeout, err = time.ParseDuration(val); err != nil || h.timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", TimeoutAnnotation, val)
+		}
+	}
+
+	return h, nil
+}
+
+func parseCheck(annotations map[string]string, queryKey, expectedKey string) (*check, error) {
+	query, err := hooks.ParseTemplate(annotations, queryKey, templateFuncs)
+	if err != nil || query == nil {
+		return nil, err
+	}
+
+	expected, ok := annotations[expectedKey]
+	if !ok {
+		return nil, fmt.Errorf("missing %s annotation", expectedKey)
+	}
+
+	return &check{query: query, expected: strings.TrimSpace(expected)}, nil
+}
+
+func registered(driver string) bool {
+	for _, d := range dbsql.Drivers() {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hook) Name() string {
+	return "sql"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil && h.after != nil {
+		if err := h.run(h.after, prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil && h.before != nil {
+		if err := h.run(h.before, next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+// run queries the pod's database, and compares the result with the expected value.
+func (h *Hook) run(c *check, pod *v1.Pod) error {
+	if pod.Status.PodIP == "" {
+		return fmt.Errorf("pod has no ip address yet")
+	}
+
+	tvars, err := hooks.NewTemplateVars(pod)
+	if err != nil {
+		return err
+	}
+	vars := Vars{TemplateVars: tvars, IP: pod.Status.PodIP, Username: h.username, Password: h.password}
+
+	dsn, err := hooks.Execute(h.dsn, vars)
+	if err != nil {
+		return err
+	}
+	query, err := hooks.Execute(c.query, vars)
+	if err != nil {
+		return err
+	}
+
+	val, err := h.query(dsn, query)
+	if err != nil {
+		return errors.Wrap(err, "query failed")
+	}
+
+	if val != c.expected {
+		return fmt.Errorf("query returned %q, expecting %q", val, c.expected)
+	}
+
+	return nil
+}
+
+// query returns the first row's last column.
+func (h *Hook) query(dsn, query string) (string, error) {
+	db, err := dbsql.Open(h.driver, dsn)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	if len(columns) == 0 {
+		return "", fmt.Errorf("no columns")
+	}
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("no rows")
+	}
+
+	values := make([]dbsql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return "", err
+	}
+
+	last := values[len(values)-1]
+	if !last.Valid {
+		return "NULL", nil
+	}
+
+	return strings.TrimSpace(last.String), nil
+}
@@ -0,0 +1,197 @@
+package zookeeper
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	resty "gopkg.in/resty.v1"
+)
+
+// Servers modes, as reported by srvr.
+const (
+	ModeLeader     = "leader"
+	ModeFollower   = "follower"
+	ModeObserver   = "observer"
+	ModeStandalone = "standalone"
+)
+
+// status is a server's state, from its srvr command.
+type status struct {
+	mode string
+	zxid int64
+}
+
+// epoch is the leader election epoch the zxid was issued in.
+func (s status) epoch() int64 {
+	return s.zxid >> 32
+}
+
+// counter is the transaction counter within the epoch.
+func (s status) counter() int64 {
+	return s.zxid & 0xffffffff
+}
+
+// transport sends the srvr and mntr commands to a server (at addr, its host:port).
+type transport interface {
+	srvr(addr string) (status, error)
+	mntr(addr string) (map[string]string, error)
+}
+
+// fourLetterWords speaks the 4lw protocol: the command is written to the client
+// port, and the server answers then closes the connection. The commands must be
+// allowed by the servers 4lw.commands.whitelist (since zookeeper 3.5.3).
+type fourLetterWords struct {
+	timeout time.Duration
+}
+
+func (f *fourLetterWords) send(addr, cmd string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, f.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(f.timeout)); err != nil {
+		return "", err
+	}
+
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.Contains(string(resp), "is not executed because it is not in the whitelist") {
+		return "", fmt.Errorf("%s command isn't in %s 4lw.commands.whitelist", cmd, addr)
+	}
+
+	return string(resp), nil
+}
+
+func (f *fourLetterWords) srvr(addr string) (status, error) {
+	resp, err := f.send(addr, "srvr")
+	if err != nil {
+		return status{}, err
+	}
+
+	if strings.HasPrefix(resp, "This ZooKeeper instance is not currently serving requests") {
+		return status{}, fmt.Errorf("%s isn't serving requests", addr)
+	}
+
+	s := status{}
+	scanner := bufio.NewScanner(strings.NewReader(resp))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := strings.TrimSpace(kv[1])
+
+		switch kv[0] {
+		case "Mode":
+			s.mode = val
+		case "Zxid":
+			if s.zxid, err = strconv.ParseInt(val, 0, 64); err != nil {
+				return status{}, fmt.Errorf("invalid zxid %q from %s", val, addr)
+			}
+		}
+	}
+
+	if s.mode == "" {
+		return status{}, fmt.Errorf("no mode in %s srvr response", addr)
+	}
+
+	return s, nil
+}
+
+func (f *fourLetterWords) mntr(addr string) (map[string]string, error) {
+	resp, err := f.send(addr, "mntr")
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(resp))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(kv) == 2 {
+			m[strings.TrimPrefix(kv[0], "zk_")] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	return m, nil
+}
+
+// adminServer sends the commands to the AdminServer http api (since zookeeper 3.5).
+type adminServer struct {
+	client *resty.Client
+}
+
+type zkSrvr struct {
+	Error       *string       `json:"error"`
+	ServerStats zkServerStats `json:"server_stats"`
+}
+
+type zkServerStats struct {
+	ServerState       string `json:"server_state"`
+	LastProcessedZxid int64  `json:"last_processed_zxid"`
+}
+
+func (a *adminServer) get(addr, cmd string, v interface{}) error {
+	url := fmt.Sprintf("http://%s/commands/%s", addr, cmd)
+	resp, err := a.client.R().Get(url)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("/commands/%s http status code was %d for %s", cmd, resp.StatusCode(), addr)
+	}
+
+	return json.Unmarshal(resp.Body(), v)
+}
+
+func (a *adminServer) srvr(addr string) (status, error) {
+	m := zkSrvr{}
+	if err := a.get(addr, "srvr", &m); err != nil {
+		return status{}, err
+	}
+
+	if m.Error != nil {
+		return status{}, fmt.Errorf("srvr failed on %s: %s", addr, *m.Error)
+	}
+
+	if m.ServerStats.ServerState == "" {
+		return status{}, fmt.Errorf("no server_state in %s srvr response", addr)
+	}
+
+	return status{mode: m.ServerStats.ServerState, zxid: m.ServerStats.LastProcessedZxid}, nil
+}
+
+func (a *adminServer) mntr(addr string) (map[string]string, error) {
+	var m map[string]interface{}
+	if err := a.get(addr, "mntr", &m); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	for key, val := range m {
+		switch v := val.(type) {
+		case string:
+			res[key] = v
+		case float64:
+			res[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,327 @@
+package zookeeper
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/pkg/errors"
+	resty "gopkg.in/resty.v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// ProtocolAnnotation selects how servers are queried: with the 4lw
+	// commands on the client port (the default), or through the AdminServer.
+	ProtocolAnnotation = hooks.AnnotationPrefix + "zk-protocol"
+
+	// PortAnnotation is the client port (defaults to 2181), or the AdminServer
+	// port (defaults to 8080).
+	PortAnnotation = hooks.AnnotationPrefix + "zk-port"
+
+	// DiscoveryAnnotation tells how servers are reached: on their pod ip (the
+	// default), or on their headless service DNS name.
+	DiscoveryAnnotation = hooks.AnnotationPrefix + "zk-discovery"
+
+	// MaxZxidLagAnnotation is the number of transactions a follower can be behind
+	// the leader's zxid while being considered in sync (defaults to 1000).
+	MaxZxidLagAnnotation = hooks.AnnotationPrefix + "zk-max-zxid-lag"
+
+	// TimeoutAnnotation is the servers queries timeout (a duration, defaults to 10s).
+	TimeoutAnnotation = hooks.AnnotationPrefix + "zk-timeout"
+
+	defaultTimeout         = 10 * time.Second
+	defaultMaxZxidLag      = int64(1000)
+	defaultClientPort      = 2181
+	defaultAdminServerPort = 8080
+)
+
+const (
+	Protocol4lw         = "4lw"
+	ProtocolAdminServer = "admin"
+
+	// NextPodIsLeaderReason is the retry reason while the next pod is the
+	// leader, and the followers aren't all ready to elect a new one.
+	NextPodIsLeaderReason = "NextPodIsLeader"
+)
+
+// Hook restarts zookeeper servers one at a time, keeping the ensemble's quorum:
+// a server is only restarted when a majority of the voters would remain in sync
+// with the leader without it. The next server waits until the restarted one
+// follows (or leads) again, with a zxid in sync with the leader's.
+// Restarting the leader triggers an election, so it's held back until all the
+// other voters are in sync.
+type Hook struct {
+	client     client.Client
+	sts        *appsv1.StatefulSet
+	transport  transport
+	discovery  string
+	port       int
+	maxZxidLag int64
+
+	// addr returns the host:port reaching a pod's server
+	addr func(pod *v1.Pod) (string, error)
+}
+
+// server is a pod's status, or the error we got querying it.
+type server struct {
+	pod    *v1.Pod
+	status status
+	err    error
+}
+
+func (s server) String() string {
+	if s.err != nil {
+		return fmt.Sprintf("%s (%v)", s.pod.GetName(), s.err)
+	}
+	return fmt.Sprintf("%s (%s, zxid 0x%x)", s.pod.GetName(), s.status.mode, s.status.zxid)
+}
+
+func New(c client.Client, sts *appsv1.StatefulSet) (hooks.STSRolloutHooks, error) {
+	annotations := sts.GetAnnotations()
+
+	h := &Hook{
+		client:     c,
+		sts:        sts,
+		discovery:  hooks.DiscoveryIP,
+		maxZxidLag: defaultMaxZxidLag,
+	}
+
+	if val, ok := annotations[DiscoveryAnnotation]; ok {
+		if val != hooks.DiscoveryIP && val != hooks.DiscoveryDNS {
+			return nil, fmt.Errorf("invalid %s annotation: %q", DiscoveryAnnotation, val)
+		}
+		h.discovery = val
+	}
+
+	if val, ok := annotations[MaxZxidLagAnnotation]; ok {
+		lag, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || lag < 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", MaxZxidLagAnnotation, val)
+		}
+		h.maxZxidLag = lag
+	}
+
+	timeout := defaultTimeout
+	if val, ok := annotations[TimeoutAnnotation]; ok {
+		var err error
+		if timeout, err = time.ParseDuration(val); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", TimeoutAnnotation, val)
+		}
+	}
+
+	protocol := Protocol4lw
+	if val, ok := annotations[ProtocolAnnotation]; ok {
+		protocol = val
+	}
+
+	port := defaultClientPort
+	if protocol == ProtocolAdminServer {
+		port = defaultAdminServerPort
+	}
+	if val, ok := annotations[PortAnnotation]; ok {
+		var err error
+		if port, err = strconv.Atoi(val); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s annotation: %q", PortAnnotation, val)
+		}
+	}
+
+	h.port = port
+	h.addr = func(pod *v1.Pod) (string, error) {
+		return hooks.PodAddr(h.sts, pod, h.discovery, h.port)
+	}
+
+	switch protocol {
+	case Protocol4lw:
+		h.transport = &fourLetterWords{timeout: timeout}
+	case ProtocolAdminServer:
+		h.transport = &adminServer{client: resty.New().SetTimeout(timeout)}
+	default:
+		return nil, fmt.Errorf("invalid %s annotation: %q", ProtocolAnnotation, protocol)
+	}
+
+	return h, nil
+}
+
+func (h *Hook) Name() string {
+	return "zookeeper"
+}
+
+func (h *Hook) PodUpdateTransition(prev, next *v1.Pod) error {
+	// prev or next may be nil, when we're on the rollout's first or last pod
+	if prev != nil {
+		if err := h.afterUpdate(prev); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("after update, pod: %s", prev.GetName()))
+		}
+	}
+
+	if next != nil {
+		if err := h.beforeUpdate(next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("before update, pod: %s", next.GetName()))
+		}
+	}
+
+	return nil
+}
+
+func (h *Hook) srvr(pod *v1.Pod) (status, error) {
+	addr, err := h.addr(pod)
+	if err != nil {
+		return status{}, err
+	}
+	return h.transport.srvr(addr)
+}
+
+// ensemble queries all the statefulset's servers.
+func (h *Hook) ensemble() ([]server, error) {
+	pods, err := hooks.ListPods(h.client, h.sts)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make([]server, 0, len(pods))
+	for i := range pods {
+		s := server{pod: &pods[i]}
+		s.status, s.err = h.srvr(s.pod)
+		servers = append(servers, s)
+	}
+
+	return servers, nil
+}
+
+func leader(servers []server) *server {
+	for i, s := range servers {
+		if s.err == nil && s.status.mode == ModeLeader {
+			return &servers[i]
+		}
+	}
+	return nil
+}
+
+// inSync tells if a server's zxid is close enough to the leader's one.
+func (h *Hook) inSync(s, leader status) bool {
+	return s.epoch() == leader.epoch() && leader.counter()-s.counter() <= h.maxZxidLag
+}
+
+func (h *Hook) beforeUpdate(next *v1.Pod) error {
+	servers, err := h.ensemble()
+	if err != nil {
+		return err
+	}
+
+	var target *server
+	voters := 0
+	for i, s := range servers {
+		if s.pod.GetName() == next.GetName() {
+			target = &servers[i]
+		}
+		if s.err != nil || s.status.mode != ModeObserver {
+			voters++
+		}
+	}
+
+	// There's no quorum to keep for standalone servers and observers
+	if target != nil && target.err == nil &&
+		(target.status.mode == ModeStandalone || target.status.mode == ModeObserver) {
+		return nil
+	}
+
+	l := leader(servers)
+	if l == nil {
+		return fmt.Errorf("the ensemble has no leader: %s", list(servers))
+	}
+
+	if l.pod.GetName() == next.GetName() {
+		return h.followersInSync(servers, l)
+	}
+
+	addr, err := h.addr(l.pod)
+	if err != nil {
+		return err
+	}
+	m, err := h.transport.mntr(addr)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to get the leader %s metrics", l.pod.GetName()))
+	}
+	synced, err := strconv.Atoi(m["synced_followers"])
+	if err != nil {
+		return fmt.Errorf("invalid synced_followers %q in the leader %s metrics", m["synced_followers"], l.pod.GetName())
+	}
+
+	// The leader and its synced followers, without the pod we're about to restart
+	remaining := synced + 1
+	if target != nil && target.err == nil && target.status.mode == ModeFollower {
+		remaining--
+	}
+
+	if needed := voters/2 + 1; remaining < needed {
+		return fmt.Errorf("the ensemble would lose quorum without %s: %d of %d voters would remain in sync, %d needed",
+			next.GetName(), remaining, voters, needed)
+	}
+
+	return nil
+}
+
+// followersInSync holds back the leader's restart until all the other voters are
+// in sync, so they can elect a new leader right away.
+func (h *Hook) followersInSync(servers []server, l *server) error {
+	var pending []server
+	for _, s := range servers {
+		if s.pod.GetName() == l.pod.GetName() || (s.err == nil && s.status.mode == ModeObserver) {
+			continue
+		}
+		if s.err != nil || s.status.mode != ModeFollower || !h.inSync(s.status, l.status) {
+			pending = append(pending, s)
+		}
+	}
+
+	if len(pending) > 0 {
+		return hooks.Wait(NextPodIsLeaderReason, fmt.Errorf("%s is the leader, waiting for %d followers to be in sync before restarting it: %s",
+			l.pod.GetName(), len(pending), list(pending)))
+	}
+
+	return nil
+}
+
+func (h *Hook) afterUpdate(prev *v1.Pod) error {
+	st, err := h.srvr(prev)
+	if err != nil {
+		return errors.Wrap(err, "server isn't serving yet")
+	}
+
+	switch st.mode {
+	case ModeLeader, ModeStandalone:
+		return nil
+	case ModeFollower, ModeObserver:
+	default:
+		return fmt.Errorf("server is in %s mode, waiting for follower or leader mode", st.mode)
+	}
+
+	servers, err := h.ensemble()
+	if err != nil {
+		return err
+	}
+
+	l := leader(servers)
+	if l == nil {
+		return fmt.Errorf("the ensemble has no leader: %s", list(servers))
+	}
+
+	if !h.inSync(st, l.status) {
+		return fmt.Errorf("zxid 0x%x isn't in sync yet with the leader %s zxid 0x%x",
+			st.zxid, l.pod.GetName(), l.status.zxid)
+	}
+
+	return nil
+}
+
+func list(servers []server) string {
+	var items []string
+	for _, s := range servers {
+		items = append(items, s.String())
+	}
+	return hooks.List(items, ", ")
+}
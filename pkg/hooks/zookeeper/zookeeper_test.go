@@ -0,0 +1,342 @@
+package zookeeper
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpineau/statefulset-pilot/pkg/hooks"
+	"github.com/bpineau/statefulset-pilot/pkg/hooks/hookstest"
+	resty "gopkg.in/resty.v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// fakeZK is a server answering the srvr and mntr 4lw commands.
+type fakeZK struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	mode    string
+	zxid    int64
+	synced  int
+	serving bool
+	allowed bool
+}
+
+func (z *fakeZK) set(mode string, zxid int64) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.mode, z.zxid, z.serving = mode, zxid, true
+}
+
+func (z *fakeZK) serve() {
+	for {
+		conn, err := z.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		cmd := make([]byte, 4)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(cmd); err == nil {
+			fmt.Fprint(conn, z.answer(string(cmd)))
+		}
+		conn.Close()
+	}
+}
+
+func (z *fakeZK) answer(cmd string) string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	switch {
+	case !z.allowed:
+		return cmd + " is not executed because it is not in the whitelist.\n"
+	case !z.serving:
+		return "This ZooKeeper instance is not currently serving requests\n"
+	case cmd == "srvr":
+		return fmt.Sprintf("Zookeeper version: 3.4.14-4c25d480e66aadd371de8bd2fd8da255ac140bcf, built on 03/06/2019 16:18 GMT\n"+
+			"Latency min/avg/max: 0/0/12\nReceived: 42\nSent: 41\nConnections: 1\nOutstanding: 0\n"+
+			"Zxid: 0x%x\nMode: %s\nNode count: 5\n", z.zxid, z.mode)
+	case cmd == "mntr":
+		resp := fmt.Sprintf("zk_version\t3.4.14\nzk_server_state\t%s\nzk_znode_count\t5\n", z.mode)
+		if z.mode == ModeLeader {
+			resp += fmt.Sprintf("zk_followers\t%d\nzk_synced_followers\t%d\n", z.synced, z.synced)
+		}
+		return resp
+	}
+
+	return ""
+}
+
+var zkStatefulSet = hookstest.StatefulSet("zk", nil)
+
+// newEnsemble starts n fake servers, and returns a hook for the matching zk-0 to zk-n-1 pods.
+func newEnsemble(t *testing.T, n int, annotations map[string]string) (*Hook, []*fakeZK) {
+	var servers []*fakeZK
+	var pods []runtime.Object
+	addrs := hookstest.Addrs{}
+
+	for i := 0; i < n; i++ {
+		p := pod(i)
+		z := &fakeZK{listener: addrs.Listen(t, p.GetName()), allowed: true}
+		go z.serve()
+		servers = append(servers, z)
+
+		pods = append(pods, p)
+	}
+
+	sts := hookstest.StatefulSet("zk", annotations)
+	h, err := New(hookstest.NewFakeClient(pods...), sts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.(*Hook).addr = addrs.Addr
+
+	return h.(*Hook), servers
+}
+
+func pod(ordinal int) *v1.Pod {
+	return hookstest.Pod(zkStatefulSet, ordinal, fmt.Sprintf("10.0.0.%d", ordinal+1))
+}
+
+func stop(servers []*fakeZK) {
+	for _, z := range servers {
+		z.listener.Close()
+	}
+}
+
+const epoch = int64(5) << 32
+
+func TestBeforeUpdate(t *testing.T) {
+	tests := []struct {
+		title   string
+		setup   func(zk []*fakeZK)
+		next    int
+		wantErr string
+		reason  string
+	}{
+		{
+			title: "healthy ensemble",
+			next:  2,
+		},
+		{
+			title: "another follower is down",
+			setup: func(zk []*fakeZK) {
+				zk[0].serving = false
+				zk[1].synced = 1
+			},
+			next:    2,
+			wantErr: "the ensemble would lose quorum without zk-2: 1 of 3 voters would remain in sync, 2 needed",
+		},
+		{
+			title: "a follower isn't synced yet",
+			setup: func(zk []*fakeZK) { zk[1].synced = 1 },
+			next:  2,
+			// zk-0 or zk-2 isn't synced, the leader can't tell which
+			wantErr: "the ensemble would lose quorum without zk-2",
+		},
+		{
+			title: "the next pod is down",
+			setup: func(zk []*fakeZK) {
+				zk[2].serving = false
+				zk[1].synced = 1
+			},
+			next: 2,
+		},
+		{
+			title: "no leader",
+			setup: func(zk []*fakeZK) {
+				zk[1].mode = "looking"
+			},
+			next:    2,
+			wantErr: "the ensemble has no leader",
+		},
+		{
+			title: "the next pod is the leader",
+			next:  1,
+		},
+		{
+			title:   "the next pod is the leader, with a lagging follower",
+			setup:   func(zk []*fakeZK) { zk[0].zxid = epoch + 10 },
+			next:    1,
+			wantErr: "zk-1 is the leader, waiting for 1 followers to be in sync before restarting it: zk-0 (follower, zxid 0x50000000a)",
+			reason:  NextPodIsLeaderReason,
+		},
+		{
+			title:   "the next pod is the leader, with a follower down",
+			setup:   func(zk []*fakeZK) { zk[2].serving = false },
+			next:    1,
+			wantErr: "zk-1 is the leader, waiting for 1 followers to be in sync before restarting it: zk-2",
+			reason:  NextPodIsLeaderReason,
+		},
+		{
+			title: "standalone",
+			setup: func(zk []*fakeZK) {
+				zk[2].mode = ModeStandalone
+			},
+			next: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		h, zk := newEnsemble(t, 3, map[string]string{MaxZxidLagAnnotation: "100"})
+		zk[0].set(ModeFollower, epoch+2000)
+		zk[1].set(ModeLeader, epoch+2000)
+		zk[2].set(ModeFollower, epoch+1990)
+		zk[1].synced = 2
+		if tt.setup != nil {
+			tt.setup(zk)
+		}
+
+		err := h.PodUpdateTransition(nil, pod(tt.next))
+		stop(zk)
+
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.title, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: expected %q error, got: %v", tt.title, tt.wantErr, err)
+		case hooks.WaitReason(err) != tt.reason:
+			t.Errorf("%s: expected %q reason, got %q", tt.title, tt.reason, hooks.WaitReason(err))
+		}
+	}
+}
+
+func TestAfterUpdate(t *testing.T) {
+	tests := []struct {
+		title   string
+		setup   func(zk []*fakeZK)
+		wantErr string
+	}{
+		{title: "following in sync"},
+		{
+			title:   "not serving",
+			setup:   func(zk []*fakeZK) { zk[2].serving = false },
+			wantErr: "server isn't serving yet",
+		},
+		{
+			title:   "looking for a leader",
+			setup:   func(zk []*fakeZK) { zk[2].mode = "looking" },
+			wantErr: "server is in looking mode, waiting for follower or leader mode",
+		},
+		{
+			title:   "lagging",
+			setup:   func(zk []*fakeZK) { zk[2].zxid = epoch + 100 },
+			wantErr: "zxid 0x500000064 isn't in sync yet with the leader zk-1 zxid 0x5000007d0",
+		},
+		{
+			title:   "previous epoch",
+			setup:   func(zk []*fakeZK) { zk[2].zxid = epoch - 1 },
+			wantErr: "isn't in sync yet",
+		},
+		{
+			title: "leading",
+			setup: func(zk []*fakeZK) {
+				zk[1].mode = ModeFollower
+				zk[2].mode = ModeLeader
+				zk[2].zxid = epoch
+			},
+		},
+		{
+			title: "observing",
+			setup: func(zk []*fakeZK) { zk[2].mode = ModeObserver },
+		},
+	}
+
+	for _, tt := range tests {
+		h, zk := newEnsemble(t, 3, nil)
+		zk[0].set(ModeFollower, epoch+2000)
+		zk[1].set(ModeLeader, epoch+2000)
+		zk[2].set(ModeFollower, epoch+2000)
+		if tt.setup != nil {
+			tt.setup(zk)
+		}
+
+		err := h.PodUpdateTransition(pod(2), nil)
+		stop(zk)
+
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.title, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: expected %q error, got: %v", tt.title, tt.wantErr, err)
+		}
+	}
+}
+
+func TestWhitelist(t *testing.T) {
+	h, zk := newEnsemble(t, 1, nil)
+	defer stop(zk)
+	zk[0].set(ModeStandalone, epoch)
+	zk[0].allowed = false
+
+	addr, _ := h.addr(pod(0))
+	err := h.PodUpdateTransition(pod(0), nil)
+	if err == nil || !strings.Contains(err.Error(), "srvr command isn't in "+addr+" 4lw.commands.whitelist") {
+		t.Errorf("expected a whitelist error, got: %v", err)
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/commands/srvr":
+			fmt.Fprint(w, `{"version":"3.5.9","read_only":false,"server_stats":{"packets_sent":12,`+
+				`"server_state":"leader","last_processed_zxid":21474836480},"command":"srvr","error":null}`)
+		case "/commands/mntr":
+			fmt.Fprint(w, `{"version":"3.5.9","server_state":"leader","synced_followers":2,"command":"mntr","error":null}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	a := &adminServer{client: resty.New()}
+
+	st, err := a.srvr(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.mode != ModeLeader || st.zxid != epoch {
+		t.Errorf("unexpected srvr status: %+v", st)
+	}
+
+	m, err := a.mntr(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["synced_followers"] != "2" {
+		t.Errorf("expected 2 synced_followers, got %q", m["synced_followers"])
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{ProtocolAnnotation: ProtocolAdminServer}, false},
+		{map[string]string{ProtocolAnnotation: "jmx"}, true},
+		{map[string]string{DiscoveryAnnotation: "srv"}, true},
+		{map[string]string{PortAnnotation: "0"}, true},
+		{map[string]string{MaxZxidLagAnnotation: "-1"}, true},
+		{map[string]string{TimeoutAnnotation: "10"}, true},
+		{map[string]string{TimeoutAnnotation: "0s"}, true},
+		{map[string]string{TimeoutAnnotation: "-5s"}, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(nil, hookstest.StatefulSet("zk", tt.annotations)); (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error: %v, got: %v", tt.annotations, tt.wantErr, err)
+		}
+	}
+}